@@ -0,0 +1,81 @@
+package clientproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// abortWriter cancels the request to the client as soon as writing its
+// response downstream fails, typically because the visitor went away, so the
+// client stops producing it.
+type abortWriter struct {
+	http.ResponseWriter
+	m       *Middleware
+	visitor context.Context // of the request as received
+	cancel  context.CancelFunc
+	aborted bool
+}
+
+// visitorCanceled reports if the visitor canceled the request, typically by
+// going away, as opposed to it timing out or being aborted by the proxy.
+func (w *abortWriter) visitorCanceled() bool {
+	return errors.Is(w.visitor.Err(), context.Canceled)
+}
+
+// countClientCanceled records requests the visitor canceled before the
+// response was complete.
+func (m *Middleware) countClientCanceled(w *abortWriter) {
+	if w.visitorCanceled() {
+		m.counters.clientCanceled.Add(1)
+		m.metrics.clientCanceled.Inc()
+	}
+}
+
+func (w *abortWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && !w.aborted && !errors.Is(err, http.ErrBodyNotAllowed) {
+		w.aborted = true
+		w.cancel()
+		w.m.counters.downstreamAborts.Add(1)
+		w.m.metrics.downstreamAborts.Inc()
+	}
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *abortWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recoverProxy records panics while forwarding r. The proxy raises
+// http.ErrAbortHandler when it cannot complete the response, which ends the
+// request normally if the visitor went away, and otherwise is passed on so the
+// server aborts the response. Other panics are logged with their stack before
+// being passed on.
+func (m *Middleware) recoverProxy(w *abortWriter, r *http.Request) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler {
+		m.metrics.abortPanics.Inc()
+		gone := w.aborted || w.visitorCanceled()
+		m.logger.Debug("response aborted",
+			zap.String("uri", r.RequestURI),
+			zap.Bool("downstream_gone", gone))
+		if gone {
+			return
+		}
+		panic(rec)
+	}
+	m.counters.panics.Add(1)
+	m.metrics.unexpectedPanics.Inc()
+	m.logger.Error("panic forwarding request",
+		zap.String("uri", r.RequestURI),
+		zap.Any("panic", rec),
+		zap.Stack("stack"))
+	panic(rec)
+}
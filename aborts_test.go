@@ -0,0 +1,183 @@
+package clientproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+// failingWriter fails writes after the first one, like a visitor that went
+// away mid-response.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("visitor went away")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDownstreamAbort(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	canceled := make(chan struct{})
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(canceled)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+			fmt.Fprint(w, "chunk")
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	ensure.Nil(t, m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), nil))
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client request was not canceled")
+	}
+	ensure.DeepEqual(t, m.status().Counters.DownstreamAborts, uint64(1))
+}
+
+// panickingWriter panics with v on writes after the first one.
+type panickingWriter struct {
+	*httptest.ResponseRecorder
+	v      any
+	writes int
+}
+
+func (w *panickingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		panic(w.v)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// serverRequest returns a request as received by a server, for which the
+// proxy panics to abort responses.
+func serverRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	return r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+}
+
+// streaming writes chunks until the request is canceled.
+func streaming(w http.ResponseWriter, r *http.Request) {
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Millisecond):
+		}
+		fmt.Fprint(w, "chunk")
+		w.(http.Flusher).Flush()
+	}
+}
+
+func TestPanicDownstreamGone(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "panic_gone"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(streaming))
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	ensure.Nil(t, m.ServeHTTP(w, serverRequest(), nil))
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_panics_total", "kind", "abort"), 1.0)
+	ensure.DeepEqual(t, m.status().Counters.Panics, uint64(0))
+}
+
+func TestPanicAbortHandler(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "panic_abort"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(streaming))
+	func() {
+		defer func() {
+			ensure.DeepEqual(t, recover(), http.ErrAbortHandler)
+		}()
+		w := &panickingWriter{ResponseRecorder: httptest.NewRecorder(), v: http.ErrAbortHandler}
+		m.ServeHTTP(w, serverRequest(), nil)
+	}()
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_panics_total", "kind", "abort"), 1.0)
+	ensure.DeepEqual(t, m.status().Counters.Panics, uint64(0))
+}
+
+func TestPanicUnexpected(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "panic_unexpected"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(streaming))
+	func() {
+		defer func() {
+			ensure.DeepEqual(t, recover(), "boom")
+		}()
+		w := &panickingWriter{ResponseRecorder: httptest.NewRecorder(), v: "boom"}
+		m.ServeHTTP(w, serverRequest(), nil)
+	}()
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_panics_total", "kind", "unexpected"), 1.0)
+	ensure.DeepEqual(t, m.status().Counters.Panics, uint64(1))
+	ensure.True(t, m.handler.Load() != nil)
+}
+
+func TestClientCanceled(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "client_canceled"}
+	provision(t, m)
+	s := newServer(t, m)
+	canceled := make(chan string, 2)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			streaming(w, r)
+		} else {
+			<-r.Context().Done()
+		}
+		canceled <- r.URL.Path
+	}))
+
+	for _, c := range []struct {
+		path string
+		body bool
+	}{
+		{"/stream", true},   // mid-body
+		{"/headers", false}, // waiting for the response headers
+	} {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		ensure.Nil(t, err)
+		_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\n\r\n", c.path)
+		ensure.Nil(t, err)
+		if c.body {
+			_, err = io.ReadFull(conn, make([]byte, 100))
+			ensure.Nil(t, err)
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+		// the visitor goes away, while the proxy is not writing to it
+		ensure.Nil(t, conn.Close())
+		select {
+		case path := <-canceled:
+			ensure.DeepEqual(t, path, c.path)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("client request for %s was not canceled", c.path)
+		}
+	}
+	eventually(t, func() bool { return m.status().Counters.ClientCanceled == 2 })
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_client_canceled_total"), 2.0)
+	ensure.DeepEqual(t, m.status().Counters.Failures, uint64(0))
+	ensure.DeepEqual(t, m.status().Counters.Panics, uint64(0))
+}
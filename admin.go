@@ -0,0 +1,392 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// registry tracks the provisioned Middleware instances for the admin API.
+var registry middlewares
+
+type middlewares struct {
+	mu sync.Mutex
+	ms []*Middleware
+}
+
+func (r *middlewares) add(m *Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ms = append(r.ms, m)
+}
+
+func (r *middlewares) remove(m *Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ms = slices.DeleteFunc(r.ms, func(o *Middleware) bool { return o == m })
+}
+
+// get returns the Middleware with the given name, or nil.
+func (r *middlewares) get(name string) *Middleware {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.ms {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// nameTaken reports if a Middleware provisioned by the config load is named
+// name.
+func (r *middlewares) nameTaken(name string, load <-chan struct{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.ContainsFunc(r.ms, func(m *Middleware) bool {
+		return m.Name == name && m.load == load
+	})
+}
+
+// named returns the first Middleware provisioned by the config load named
+// name, or nil.
+func (r *middlewares) named(name string, load <-chan struct{}) *Middleware {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.ms {
+		if m.Name == name && m.load == load {
+			return m
+		}
+	}
+	return nil
+}
+
+func (r *middlewares) all() []*Middleware {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.ms)
+}
+
+// Status describes a Middleware and its connected client, if any.
+type Status struct {
+	Name     string        `json:"name,omitempty"`
+	Client   *ClientStatus `json:"client,omitempty"`
+	Counters Counters      `json:"counters"`
+}
+
+// Counters count notable events.
+type Counters struct {
+	Requests         uint64 `json:"requests"`
+	Failures         uint64 `json:"failures"`
+	DownstreamAborts uint64 `json:"downstream_aborts"`
+	ClientCanceled   uint64 `json:"client_canceled"`
+	FallbackRequests uint64 `json:"fallback_requests"`
+	Panics           uint64 `json:"panics"`
+	MissingTrailers  uint64 `json:"missing_trailers"`
+	Retries          uint64 `json:"retries"`
+	StreamResets     uint64 `json:"stream_resets"`
+}
+
+// ClientStatus describes a connected client.
+type ClientStatus struct {
+	RemoteAddr     string            `json:"remote_addr"`
+	Subject        string            `json:"subject,omitempty"`
+	ConnectedAt    time.Time         `json:"connected_at"`
+	MaxRequestBody int64             `json:"max_request_body,omitempty"`
+	MaxInflight    int64             `json:"max_inflight,omitempty"`
+	Inflight       int64             `json:"inflight,omitempty"`
+	Hosts          []string          `json:"hosts,omitempty"`
+	Paths          []string          `json:"paths,omitempty"`
+	RequestTimeout caddy.Duration    `json:"request_timeout,omitempty"`
+	Verbose        bool              `json:"verbose,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Tag            string            `json:"tag,omitempty"`
+	Settings       *Settings         `json:"settings,omitempty"`
+}
+
+// Debug is a snapshot of the HTTP/2 transport state of a connected client.
+type Debug struct {
+	LocalAddr            string    `json:"local_addr"`
+	RemoteAddr           string    `json:"remote_addr"`
+	ConnectedAt          time.Time `json:"connected_at"`
+	Requests             uint64    `json:"requests"`
+	StreamsActive        int       `json:"streams_active"`
+	StreamsReserved      int       `json:"streams_reserved"`
+	StreamsPending       int       `json:"streams_pending"`
+	MaxConcurrentStreams uint32    `json:"max_concurrent_streams"`
+	Closing              bool      `json:"closing"`
+	Closed               bool      `json:"closed"`
+	IdleFor              string    `json:"idle_for,omitempty"`
+	SendWindow           int64     `json:"send_window"`
+	ReceiveWindow        int64     `json:"receive_window"`
+	Settings             *Settings `json:"settings,omitempty"`
+	LastPing             *Ping     `json:"last_ping,omitempty"`
+}
+
+// Ping is the result of sending a PING to the client.
+type Ping struct {
+	At    time.Time `json:"at"`
+	RTT   string    `json:"rtt"`
+	Error string    `json:"error,omitempty"`
+}
+
+// SelfTest is the result of requesting the self test path through a client.
+type SelfTest struct {
+	Path    string    `json:"path"`
+	At      time.Time `json:"at"`
+	Latency string    `json:"latency"`
+	Status  int       `json:"status,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Version describes the build, to help diagnose interop issues.
+type Version struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Caddy     string `json:"caddy,omitempty"`
+	HTTP2     string `json:"http2,omitempty"`
+}
+
+// buildVersion returns the Version of the running binary. Versions of
+// modules not found in the build info are left empty.
+func buildVersion() Version {
+	v := Version{
+		Module:    reflect.TypeFor[Middleware]().PkgPath(),
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	modules := append([]*debug.Module{&bi.Main}, bi.Deps...)
+	version := func(path string) string {
+		for _, mod := range modules {
+			if mod.Path != path {
+				continue
+			}
+			if mod.Replace != nil {
+				mod = mod.Replace
+			}
+			return mod.Version
+		}
+		return ""
+	}
+	if mv := version(v.Module); mv != "" {
+		v.Version = mv
+	}
+	v.Caddy = version("github.com/caddyserver/caddy/v2")
+	v.HTTP2 = version("golang.org/x/net")
+	return v
+}
+
+// adminAPI is a module that provides the /client_proxy/ endpoints for the
+// Caddy admin API.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.client_proxy",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/client_proxy/status",
+			Handler: caddy.AdminHandlerFunc(a.handleStatus),
+		},
+		{
+			Pattern: "/client_proxy/version",
+			Handler: caddy.AdminHandlerFunc(a.handleVersion),
+		},
+		{
+			Pattern: "/client_proxy/",
+			Handler: caddy.AdminHandlerFunc(a.handleNamed),
+		},
+	}
+}
+
+// handleStatus reports the Status of every provisioned Middleware.
+func (adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	results := []Status{}
+	for _, m := range registry.all() {
+		results = append(results, m.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleVersion reports the Version of the build.
+func (adminAPI) handleVersion(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(buildVersion())
+}
+
+// handleNamed handles the /client_proxy/{name}/... endpoints.
+func (a adminAPI) handleNamed(w http.ResponseWriter, r *http.Request) error {
+	name, endpoint, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/client_proxy/"), "/")
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	m := registry.get(name)
+	if m == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown client_proxy: %s", name),
+		}
+	}
+	switch endpoint {
+	case "debug":
+		return a.handleDebug(w, r, m)
+	case "self_test":
+		return a.handleSelfTest(w, r, m)
+	case "reload_secret":
+		return a.handleReloadSecret(w, r, m)
+	case "limits":
+		return a.handleLimits(w, r, m)
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("not found"),
+	}
+}
+
+// handleDebug reports the transport state of the connected client. The
+// verbose query parameter additionally measures the PING round trip time.
+func (adminAPI) handleDebug(w http.ResponseWriter, r *http.Request, m *Middleware) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	d := m.debug(r.Context(), r.URL.Query().Get("verbose") == "1")
+	if d == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        ErrNoClient,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(d)
+}
+
+// handleSelfTest requests the self test path through the connected client.
+func (adminAPI) handleSelfTest(w http.ResponseWriter, r *http.Request, m *Middleware) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	result := m.selfTest(r.Context())
+	if result == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        ErrNoClient,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// handleReloadSecret reloads the secret from the secret_file.
+func (adminAPI) handleReloadSecret(w http.ResponseWriter, r *http.Request, m *Middleware) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	if m.SecretFile == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("no secret_file configured"),
+		}
+	}
+	if err := m.loadSecretFile(); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Limits are the limits of a Middleware that can be changed at runtime.
+type Limits struct {
+	MaxInflight *int64 `json:"max_inflight,omitempty"`
+}
+
+// handleLimits reports the limits, after updating those given for a POST.
+func (adminAPI) handleLimits(w http.ResponseWriter, r *http.Request, m *Middleware) error {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var l Limits
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid limits: %w", err),
+			}
+		}
+		if l.MaxInflight != nil && *l.MaxInflight < 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("max_inflight must not be negative, got %d", *l.MaxInflight),
+			}
+		}
+		if l.MaxInflight != nil {
+			m.maxInflight.Store(*l.MaxInflight)
+			m.logger.Info("limits updated", zap.Int64("max_inflight", *l.MaxInflight))
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	maxInflight := m.maxInflight.Load()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(Limits{MaxInflight: &maxInflight})
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,229 @@
+package clientproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+)
+
+// admin makes a request to the admin API, decoding the JSON response into v.
+func admin(t testing.TB, method, target string, v any) error {
+	t.Helper()
+	return adminWith(t, method, target, nil, v)
+}
+
+// adminWith is admin with a request body.
+func adminWith(t testing.TB, method, target string, body io.Reader, v any) error {
+	t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	// the longest matching pattern wins, as with http.ServeMux
+	var h caddy.AdminHandler
+	var matched string
+	for _, route := range (adminAPI{}).Routes() {
+		ok := route.Pattern == r.URL.Path ||
+			strings.HasSuffix(route.Pattern, "/") && strings.HasPrefix(r.URL.Path, route.Pattern)
+		if ok && len(route.Pattern) > len(matched) {
+			h, matched = route.Handler, route.Pattern
+		}
+	}
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r); err != nil {
+		return err
+	}
+	if v == nil {
+		ensure.DeepEqual(t, w.Code, http.StatusNoContent)
+		return nil
+	}
+	ensure.DeepEqual(t, w.Code, http.StatusOK)
+	ensure.Nil(t, json.NewDecoder(w.Body).Decode(v))
+	return nil
+}
+
+func apiStatus(t testing.TB, err error) int {
+	var apiErr caddy.APIError
+	ensure.True(t, errors.As(err, &apiErr), err)
+	return apiErr.HTTPStatus
+}
+
+func TestAdminStatus(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "status"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	var statuses []Status
+	ensure.Nil(t, admin(t, http.MethodGet, "/client_proxy/status", &statuses))
+	var found *Status
+	for _, s := range statuses {
+		if s.Name == "status" {
+			found = &s
+		}
+	}
+	ensure.NotNil(t, found)
+	ensure.NotNil(t, found.Client)
+	err := admin(t, http.MethodPost, "/client_proxy/status", nil)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusMethodNotAllowed)
+}
+
+func TestAdminVersion(t *testing.T) {
+	var v Version
+	ensure.Nil(t, admin(t, http.MethodGet, "/client_proxy/version", &v))
+	ensure.DeepEqual(t, v.Module, "github.com/daaku/caddy-clientproxy")
+	ensure.DeepEqual(t, v.GoVersion, runtime.Version())
+	ensure.True(t, v.Version != "")
+	ensure.True(t, strings.HasPrefix(v.Caddy, "v2."), v.Caddy)
+	ensure.True(t, strings.HasPrefix(v.HTTP2, "v0."), v.HTTP2)
+	err := admin(t, http.MethodPost, "/client_proxy/version", nil)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusMethodNotAllowed)
+}
+
+func TestAdminDebug(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "debug"}
+	provision(t, m)
+	s := newServer(t, m)
+	err := admin(t, http.MethodGet, "/client_proxy/debug/debug", nil)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusNotFound)
+
+	connect(t, m, s, http.HandlerFunc(hello))
+	get(t, s, "/")
+	var d Debug
+	ensure.Nil(t, admin(t, http.MethodGet, "/client_proxy/debug/debug", &d))
+	ensure.DeepEqual(t, d.Requests, uint64(1))
+	ensure.True(t, d.LastPing == nil)
+	ensure.False(t, d.Closed)
+	ensure.NotDeepEqual(t, d.RemoteAddr, "")
+
+	ensure.Nil(t, admin(t, http.MethodGet, "/client_proxy/debug/debug?verbose=1", &d))
+	ensure.NotNil(t, d.LastPing)
+	ensure.DeepEqual(t, d.LastPing.Error, "")
+}
+
+func TestAdminSelfTest(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "self_test"}
+	provision(t, m)
+	s := newServer(t, m)
+	err := admin(t, http.MethodPost, "/client_proxy/self_test/self_test", new(SelfTest))
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusNotFound)
+
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Client-Proxy-Self-Test") != "1" {
+			http.NotFound(w, r)
+		}
+	}))
+	var result SelfTest
+	ensure.Nil(t, admin(t, http.MethodPost, "/client_proxy/self_test/self_test", &result))
+	ensure.DeepEqual(t, result.Path, "/healthz")
+	ensure.DeepEqual(t, result.Status, http.StatusOK)
+	ensure.DeepEqual(t, result.Error, "")
+	ensure.NotDeepEqual(t, result.Latency, "")
+	// real traffic is not affected
+	ensure.DeepEqual(t, m.debug(context.Background(), false).Requests, uint64(0))
+
+	m.SelfTestPath = "/missing"
+	ensure.Nil(t, admin(t, http.MethodPost, "/client_proxy/self_test/self_test", &result))
+	ensure.DeepEqual(t, result.Status, http.StatusNotFound)
+}
+
+func TestAdminSelfTestError(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "self_test_error"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(abort))
+	var result SelfTest
+	ensure.Nil(t, admin(t, http.MethodPost, "/client_proxy/self_test_error/self_test", &result))
+	ensure.DeepEqual(t, result.Status, 0)
+	ensure.NotDeepEqual(t, result.Error, "")
+}
+
+func TestAdminLimits(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "limits"}
+	provision(t, m)
+	s := newServer(t, m)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			started <- struct{}{}
+			<-unblock
+		}
+	}))
+	var limits Limits
+	ensure.Nil(t, admin(t, http.MethodGet, "/client_proxy/limits/limits", &limits))
+	ensure.DeepEqual(t, *limits.MaxInflight, int64(0))
+
+	done := make(chan int)
+	go func() {
+		res, _ := get(t, s, "/block")
+		done <- res.StatusCode
+	}()
+	<-started
+	ensure.Nil(t, adminWith(t, http.MethodPost, "/client_proxy/limits/limits",
+		strings.NewReader(`{"max_inflight": 1}`), &limits))
+	ensure.DeepEqual(t, *limits.MaxInflight, int64(1))
+	ensure.DeepEqual(t, m.status().Client.MaxInflight, int64(1))
+	// the request already in flight counts against the new limit
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+
+	ensure.Nil(t, adminWith(t, http.MethodPost, "/client_proxy/limits/limits",
+		strings.NewReader(`{"max_inflight": 0}`), &limits))
+	res, _ = get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	close(unblock)
+	ensure.DeepEqual(t, <-done, http.StatusOK)
+
+	err := adminWith(t, http.MethodPost, "/client_proxy/limits/limits",
+		strings.NewReader(`{"max_inflight": -1}`), &limits)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusBadRequest)
+	err = adminWith(t, http.MethodPost, "/client_proxy/limits/limits",
+		strings.NewReader(`{`), &limits)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusBadRequest)
+}
+
+func TestAdminUnknown(t *testing.T) {
+	err := admin(t, http.MethodGet, "/client_proxy/unknown/debug", nil)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusNotFound)
+}
+
+func TestDuplicateName(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	load := func(m *Middleware) error {
+		ensure.Nil(t, m.Validate())
+		t.Cleanup(func() { m.Cleanup() })
+		return m.Provision(ctx)
+	}
+	first := &Middleware{Secret: secret, Name: "dup"}
+	ensure.Nil(t, load(first))
+
+	// the previous config still using the name does not count
+	provision(t, &Middleware{Secret: secret, Name: "dup", OnDuplicateName: "reject"})
+
+	err := load(&Middleware{Secret: secret, Name: "dup", OnDuplicateName: "reject"})
+	ensure.Err(t, err, regexp.MustCompile("name dup is used by another client_proxy handler"))
+
+	second := &Middleware{Secret: secret, Name: "dup", OnDuplicateName: "suffix"}
+	ensure.Nil(t, load(second))
+	ensure.DeepEqual(t, second.Name, "dup-2")
+	third := &Middleware{Secret: secret, Name: "dup", OnDuplicateName: "suffix"}
+	ensure.Nil(t, load(third))
+	ensure.DeepEqual(t, third.Name, "dup-3")
+
+	// warn keeps the name, addressing the first
+	ensure.Nil(t, load(&Middleware{Secret: secret, Name: "dup"}))
+	ensure.True(t, registry.get("dup") == first)
+}
+
+func TestDuplicateNameInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, OnDuplicateName: "ignore"}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("on_duplicate_name must be warn, reject or suffix"))
+}
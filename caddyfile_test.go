@@ -0,0 +1,778 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  *Middleware
+		err   string
+	}{
+		{
+			name:  "secret",
+			input: `client_proxy the_secret`,
+			want:  &Middleware{Secret: secret},
+		},
+		{
+			name:  "missing secret",
+			input: `client_proxy`,
+			err:   "wrong argument count",
+		},
+		{
+			name: "secret_hash",
+			input: `client_proxy {
+				secret_hash $2a$10$abc
+			}`,
+			want: &Middleware{SecretHash: "$2a$10$abc"},
+		},
+		{
+			name: "credential_sources",
+			input: `client_proxy the_secret {
+				credential_sources header bearer query
+			}`,
+			want: &Middleware{Secret: secret, CredentialSources: []string{"header", "bearer", "query"}},
+		},
+		{
+			name: "secrets",
+			input: `client_proxy {
+				secrets {
+					value contractor expires 2026-12-31
+					hash $2a$10$abc not_before 2026-01-01T08:00:00Z
+				}
+				enforce_expiry_on_active
+			}`,
+			want: &Middleware{
+				Secrets: []*Credential{
+					{Value: "contractor", Expires: ptr(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC))},
+					{Hash: "$2a$10$abc", NotBefore: ptr(time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC))},
+				},
+				EnforceExpiryOnActive: true,
+			},
+		},
+		{
+			name: "secrets invalid time",
+			input: `client_proxy {
+				secrets {
+					value contractor expires tomorrow
+				}
+			}`,
+			err: "invalid expires tomorrow",
+		},
+		{
+			name: "jwt",
+			input: `client_proxy {
+				jwt {
+					public_key_file /etc/jwt.pem
+					audience client_proxy
+					issuer ci
+					leeway 30s
+				}
+			}`,
+			want: &Middleware{JWT: &JWT{
+				PublicKeyFile: "/etc/jwt.pem",
+				Audience:      "client_proxy",
+				Issuer:        "ci",
+				Leeway:        caddy.Duration(30 * time.Second),
+			}},
+		},
+		{
+			name: "secret_file",
+			input: `client_proxy {
+				secret_file /etc/secret {
+					reload_interval 1m
+				}
+			}`,
+			want: &Middleware{
+				SecretFile:         "/etc/secret",
+				SecretFileInterval: caddy.Duration(time.Minute),
+			},
+		},
+		{
+			name: "registration_listener",
+			input: `client_proxy the_secret {
+				registration_listener 10.0.0.1:8443 {
+					tls cert.pem key.pem
+				}
+			}`,
+			want: &Middleware{Secret: secret, RegistrationListener: &RegistrationListener{
+				Address:  "10.0.0.1:8443",
+				CertFile: "cert.pem",
+				KeyFile:  "key.pem",
+			}},
+		},
+		{
+			name: "registration_listener tls_domains",
+			input: `client_proxy the_secret {
+				registration_listener :8443 {
+					tls_domains internal.example.com
+				}
+			}`,
+			want: &Middleware{Secret: secret, RegistrationListener: &RegistrationListener{
+				Address:    ":8443",
+				TLSDomains: []string{"internal.example.com"},
+			}},
+		},
+		{
+			name: "registration_address",
+			input: `client_proxy the_secret {
+				registration_address register.example.com:8443
+			}`,
+			want: &Middleware{Secret: secret, RegistrationAddress: "register.example.com:8443"},
+		},
+		{
+			name: "name",
+			input: `client_proxy the_secret {
+				name app
+				on_duplicate_name suffix
+			}`,
+			want: &Middleware{Secret: secret, Name: "app", OnDuplicateName: "suffix"},
+		},
+		{
+			name: "instance_label",
+			input: `client_proxy the_secret {
+				instance_label app
+			}`,
+			want: &Middleware{Secret: secret, InstanceLabel: "app"},
+		},
+		{
+			name: "expvar",
+			input: `client_proxy the_secret {
+				expvar
+			}`,
+			want: &Middleware{Secret: secret, Expvar: true},
+		},
+		{
+			name: "require_header",
+			input: `client_proxy the_secret {
+				require_header authorization
+				require_header X-Env prod staging
+			}`,
+			want: &Middleware{Secret: secret, RequireHeaders: http.Header{
+				"Authorization": nil,
+				"X-Env":         {"prod", "staging"},
+			}},
+		},
+		{
+			name: "methods",
+			input: `client_proxy the_secret {
+				allowed_methods get head post
+				denied_methods POST
+			}`,
+			want: &Middleware{
+				Secret:         secret,
+				AllowedMethods: []string{"GET", "HEAD", "POST"},
+				DeniedMethods:  []string{"POST"},
+			},
+		},
+		{
+			name: "max_request_body",
+			input: `client_proxy the_secret {
+				max_request_body 10MB
+			}`,
+			want: &Middleware{Secret: secret, MaxRequestBody: 10_000_000},
+		},
+		{
+			name: "max_stream_memory",
+			input: `client_proxy the_secret {
+				max_stream_memory 64MiB
+			}`,
+			want: &Middleware{Secret: secret, MaxStreamMemory: 64 << 20},
+		},
+		{
+			name: "allowed_hosts",
+			input: `client_proxy the_secret {
+				allowed_hosts A.example.com *.example.org
+			}`,
+			want: &Middleware{Secret: secret, AllowedHosts: []string{"a.example.com", "*.example.org"}},
+		},
+		{
+			name: "host_mismatch_status",
+			input: `client_proxy the_secret {
+				host_mismatch_status 421
+			}`,
+			want: &Middleware{Secret: secret, HostMismatchStatus: 421},
+		},
+		{
+			name: "min_reconnect_interval",
+			input: `client_proxy the_secret {
+				max_clients_per_ip 2
+				max_clients 100
+				on_max_clients reject
+				min_reconnect_interval 5s
+				handshake_timeout 2s
+				max_pending_registrations 8
+				handshake_retries 2
+				flush_timeout 1s
+				rehandshake_interval 24h
+			}`,
+			want: &Middleware{
+				Secret:                  secret,
+				MaxClientsPerIP:         2,
+				MaxClients:              100,
+				OnMaxClients:            "reject",
+				MinReconnectInterval:    caddy.Duration(5 * time.Second),
+				HandshakeTimeout:        caddy.Duration(2 * time.Second),
+				MaxPendingRegistrations: 8,
+				HandshakeRetries:        2,
+				FlushTimeout:            caddy.Duration(time.Second),
+				RehandshakeInterval:     caddy.Duration(24 * time.Hour),
+			},
+		},
+		{
+			name: "timeouts",
+			input: `client_proxy the_secret {
+				request_timeout 30s
+				max_request_timeout 5m
+				response_header_timeout 10s
+				try_duration 10s
+				try_interval 1s
+				retry_methods put delete
+				retry_idempotency_key
+				retry_idempotent false
+			}`,
+			want: &Middleware{
+				Secret:                secret,
+				RequestTimeout:        caddy.Duration(30 * time.Second),
+				MaxRequestTimeout:     caddy.Duration(5 * time.Minute),
+				ResponseHeaderTimeout: caddy.Duration(10 * time.Second),
+				TryDuration:           caddy.Duration(10 * time.Second),
+				TryInterval:           caddy.Duration(time.Second),
+				RetryMethods:          []string{"PUT", "DELETE"},
+				RetryIdempotencyKey:   true,
+				RetryIdempotent:       ptr(false),
+			},
+		},
+		{
+			name: "bandwidth",
+			input: `client_proxy the_secret {
+				max_bandwidth_up 2MB
+				max_bandwidth_down 1MiB
+			}`,
+			want: &Middleware{Secret: secret, MaxBandwidthUp: 2_000_000, MaxBandwidthDown: 1 << 20},
+		},
+		{
+			name: "debug_headers",
+			input: `client_proxy the_secret {
+				debug_headers {
+					redact Authorization X-Api-Key
+					max_size 1KiB
+				}
+				debug_token trace_me
+			}`,
+			want: &Middleware{Secret: secret, DebugToken: "trace_me", DebugHeaders: &DebugHeaders{
+				Redact:  []string{"Authorization", "X-Api-Key"},
+				MaxSize: 1024,
+			}},
+		},
+		{
+			name: "rewrite_redirects",
+			input: `client_proxy the_secret {
+				rewrite_redirects localhost:8080 *.internal
+			}`,
+			want: &Middleware{Secret: secret, RewriteRedirects: []string{"localhost:8080", "*.internal"}},
+		},
+		{
+			name: "strip_path_prefix",
+			input: `client_proxy the_secret {
+				strip_path_prefix /app
+				strip_path_prefix_required
+			}`,
+			want: &Middleware{Secret: secret, StripPathPrefix: "/app", StripPathPrefixRequired: true},
+		},
+		{
+			name: "add_path_prefix",
+			input: `client_proxy the_secret {
+				add_path_prefix /app
+			}`,
+			want: &Middleware{Secret: secret, AddPathPrefix: "/app"},
+		},
+		{
+			name: "sanitize_path",
+			input: `client_proxy the_secret {
+				sanitize_path
+			}`,
+			want: &Middleware{Secret: secret, SanitizePath: true},
+		},
+		{
+			name: "sign_requests",
+			input: `client_proxy the_secret {
+				sign_requests {
+					key the_key
+					headers Content-Type X-Request-Id
+				}
+			}`,
+			want: &Middleware{Secret: secret, SignRequests: &SignRequests{
+				Key:     "the_key",
+				Headers: []string{"Content-Type", "X-Request-Id"},
+			}},
+		},
+		{
+			name: "replace_response",
+			input: `client_proxy the_secret {
+				replace_response {
+					replace http://localhost:8080 https://example.com
+					replace "old name" "new name"
+					max_size 64KiB
+				}
+			}`,
+			want: &Middleware{Secret: secret, ReplaceResponse: &ReplaceResponse{
+				Replace: []*Replacement{
+					{Search: "http://localhost:8080", Replace: "https://example.com"},
+					{Search: "old name", Replace: "new name"},
+				},
+				MaxSize: 64 << 10,
+			}},
+		},
+		{
+			name: "tls_headers",
+			input: `client_proxy the_secret {
+				tls_headers {
+					version X-TLS-Version
+					resumed X-TLS-Resumed
+				}
+			}`,
+			want: &Middleware{Secret: secret, TLSHeaders: &TLSHeaders{
+				Version: "X-TLS-Version",
+				Resumed: "X-TLS-Resumed",
+			}},
+		},
+		{
+			name: "max_inflight",
+			input: `client_proxy the_secret {
+				max_inflight 8
+			}`,
+			want: &Middleware{Secret: secret, MaxInflight: 8},
+		},
+		{
+			name: "max_request_header_size",
+			input: `client_proxy the_secret {
+				max_request_header_size 16KiB
+				max_request_header_count 50
+				max_response_header_bytes 64KiB
+			}`,
+			want: &Middleware{
+				Secret:                 secret,
+				MaxRequestHeaderSize:   16 << 10,
+				MaxRequestHeaderCount:  50,
+				MaxResponseHeaderBytes: 64 << 10,
+			},
+		},
+		{
+			name: "preserve_request_uri",
+			input: `client_proxy the_secret {
+				preserve_request_uri
+			}`,
+			want: &Middleware{Secret: secret, PreserveRequestURI: true},
+		},
+		{
+			name: "preserve_host",
+			input: `client_proxy the_secret {
+				preserve_host false
+			}`,
+			want: &Middleware{Secret: secret, PreserveHost: new(bool)},
+		},
+		{
+			name: "default_host",
+			input: `client_proxy the_secret {
+				default_host example.com
+			}`,
+			want: &Middleware{Secret: secret, DefaultHost: "example.com"},
+		},
+		{
+			name: "allowed_paths",
+			input: `client_proxy the_secret {
+				allowed_paths /api/ /webhooks/
+			}`,
+			want: &Middleware{Secret: secret, AllowedPaths: []string{"/api/", "/webhooks/"}},
+		},
+		{
+			name: "allowed_alpn",
+			input: `client_proxy the_secret {
+				allowed_alpn http/1.1
+			}`,
+			want: &Middleware{Secret: secret, AllowedALPN: []string{"http/1.1"}},
+		},
+		{
+			name: "forward_sni_header",
+			input: `client_proxy the_secret {
+				forward_sni_header X-SNI
+			}`,
+			want: &Middleware{Secret: secret, ForwardSNIHeader: "X-SNI"},
+		},
+		{
+			name: "registration_body",
+			input: `client_proxy the_secret {
+				registration_body
+			}`,
+			want: &Middleware{Secret: secret, RegistrationBody: true},
+		},
+		{
+			name: "echo_tag",
+			input: `client_proxy the_secret {
+				echo_tag
+			}`,
+			want: &Middleware{Secret: secret, EchoTag: true},
+		},
+		{
+			name: "cors",
+			input: `client_proxy the_secret {
+				cors {
+					allowed_origins https://a.example.com https://b.example.com
+					allowed_methods GET POST
+					allowed_headers *
+					allow_credentials
+					max_age 1h
+				}
+			}`,
+			want: &Middleware{Secret: secret, CORS: &CORS{
+				AllowedOrigins:   []string{"https://a.example.com", "https://b.example.com"},
+				AllowedMethods:   []string{"GET", "POST"},
+				AllowedHeaders:   []string{"*"},
+				AllowCredentials: true,
+				MaxAge:           caddy.Duration(time.Hour),
+			}},
+		},
+		{
+			name: "finalize_missing_trailers",
+			input: `client_proxy the_secret {
+				finalize_missing_trailers
+			}`,
+			want: &Middleware{Secret: secret, FinalizeMissingTrailers: true},
+		},
+		{
+			name: "reject_on_shutdown",
+			input: `client_proxy the_secret {
+				reject_on_shutdown
+				cleanup_grace 5s
+				shutdown_mode immediate
+			}`,
+			want: &Middleware{
+				Secret:           secret,
+				RejectOnShutdown: true,
+				CleanupGrace:     caddy.Duration(5 * time.Second),
+				ShutdownMode:     "immediate",
+			},
+		},
+		{
+			name: "self_test_path",
+			input: `client_proxy the_secret {
+				self_test_path /ping
+			}`,
+			want: &Middleware{Secret: secret, SelfTestPath: "/ping"},
+		},
+		{
+			name: "status_path",
+			input: `client_proxy the_secret {
+				status_path /_status
+				status_allowed_ips 10.0.0.1 192.168.0.0/16
+				status_allowed_ips ::1
+			}`,
+			want: &Middleware{
+				Secret:           secret,
+				StatusPath:       "/_status",
+				StatusAllowedIPs: []string{"10.0.0.1", "192.168.0.0/16", "::1"},
+			},
+		},
+		{
+			name: "abort_upload_on_response",
+			input: `client_proxy the_secret {
+				abort_upload_on_response
+			}`,
+			want: &Middleware{Secret: secret, AbortUploadOnResponse: true},
+		},
+		{
+			name: "stream_reset_status",
+			input: `client_proxy the_secret {
+				stream_reset_status 503
+			}`,
+			want: &Middleware{Secret: secret, StreamResetStatus: 503},
+		},
+		{
+			name: "server_timing",
+			input: `client_proxy the_secret {
+				server_timing
+			}`,
+			want: &Middleware{Secret: secret, ServerTiming: true},
+		},
+		{
+			name: "coalesce_requests",
+			input: `client_proxy the_secret {
+				coalesce_requests {
+					headers Accept Accept-Encoding
+					max_size 1KiB
+				}
+			}`,
+			want: &Middleware{Secret: secret, CoalesceRequests: &Coalesce{
+				Headers: []string{"Accept", "Accept-Encoding"},
+				MaxSize: 1024,
+			}},
+		},
+		{
+			name: "idempotency_cache",
+			input: `client_proxy the_secret {
+				idempotency_cache {
+					ttl 1m
+					max_entries 100
+					max_size 64KiB
+					headers X-Tenant
+				}
+			}`,
+			want: &Middleware{Secret: secret, IdempotencyCache: &Idempotency{
+				TTL:        caddy.Duration(time.Minute),
+				MaxEntries: 100,
+				MaxSize:    64 << 10,
+				Headers:    []string{"X-Tenant"},
+			}},
+		},
+		{
+			name: "on_no_client_webhook",
+			input: `client_proxy the_secret {
+				on_no_client_webhook https://wake.example.com/ {
+					interval 1m
+					timeout 2s
+				}
+				wait_for_client 30s
+				fallback_upstream http://standby.internal:8080
+			}`,
+			want: &Middleware{
+				Secret: secret,
+				OnNoClientWebhook: &NoClientWebhook{
+					URL:      "https://wake.example.com/",
+					Interval: caddy.Duration(time.Minute),
+					Timeout:  caddy.Duration(2 * time.Second),
+				},
+				WaitForClient:    caddy.Duration(30 * time.Second),
+				FallbackUpstream: "http://standby.internal:8080",
+			},
+		},
+		{
+			name: "offline_redirect",
+			input: `client_proxy the_secret {
+				offline_redirect https://status.example.com/ 307 {
+					preserve_path
+				}
+			}`,
+			want: &Middleware{Secret: secret, OfflineRedirect: &OfflineRedirect{
+				URL:          "https://status.example.com/",
+				Status:       http.StatusTemporaryRedirect,
+				PreservePath: true,
+			}},
+		},
+		{
+			name: "offline_redirect without status",
+			input: `client_proxy the_secret {
+				offline_redirect https://status.example.com/
+			}`,
+			want: &Middleware{Secret: secret, OfflineRedirect: &OfflineRedirect{URL: "https://status.example.com/"}},
+		},
+		{
+			name: "route",
+			input: `client_proxy the_secret {
+				route api {
+					path /api/*
+				}
+				route tenant_b {
+					header X-Tenant b
+				}
+			}`,
+			want: &Middleware{Secret: secret, Routes: []*TunnelRoute{
+				{
+					Tunnel:         "api",
+					MatcherSetsRaw: caddyhttp.RawMatcherSets{{"path": json.RawMessage(`["/api/*"]`)}},
+				},
+				{
+					Tunnel:         "tenant_b",
+					MatcherSetsRaw: caddyhttp.RawMatcherSets{{"header": json.RawMessage(`{"X-Tenant":["b"]}`)}},
+				},
+			}},
+		},
+		{
+			name: "route without matchers",
+			input: `client_proxy the_secret {
+				route api
+			}`,
+			err: "route to api requires a matcher",
+		},
+		{
+			name: "spool",
+			input: `client_proxy the_secret {
+				spool {
+					methods post
+					paths /hooks/*
+					max_requests 10
+					max_body_size 64KiB
+					max_age 10m
+					status 204
+				}
+			}`,
+			want: &Middleware{Secret: secret, Spool: &Spool{
+				Methods:     []string{"POST"},
+				Paths:       []string{"/hooks/*"},
+				MaxRequests: 10,
+				MaxBodySize: 64 << 10,
+				MaxAge:      caddy.Duration(10 * time.Minute),
+				Status:      204,
+			}},
+		},
+		{
+			name: "connect_forwarding",
+			input: `client_proxy the_secret {
+				connect_forwarding {
+					secret connect_secret
+					allowed_destinations db.internal:5432 *.lan:*
+					dial_timeout 5s
+					idle_timeout 10m
+				}
+			}`,
+			want: &Middleware{Secret: secret, ConnectForwarding: &ConnectForwarding{
+				Secret:              "connect_secret",
+				AllowedDestinations: []string{"db.internal:5432", "*.lan:*"},
+				DialTimeout:         caddy.Duration(5 * time.Second),
+				IdleTimeout:         caddy.Duration(10 * time.Minute),
+			}},
+		},
+		{
+			name: "performance",
+			input: `client_proxy the_secret {
+				performance {
+					max_read_frame_size 1MiB
+					write_buffer_size 64KiB
+					flush_interval 2ms
+					read_idle_timeout 30s
+					ping_timeout 5s
+					socket_read_buffer 4MiB
+					socket_write_buffer 2MiB
+					tcp_nodelay false
+				}
+			}`,
+			want: &Middleware{Secret: secret, Performance: &Performance{
+				MaxReadFrameSize:  1 << 20,
+				WriteBufferSize:   64 << 10,
+				FlushInterval:     caddy.Duration(2 * time.Millisecond),
+				ReadIdleTimeout:   caddy.Duration(30 * time.Second),
+				PingTimeout:       caddy.Duration(5 * time.Second),
+				SocketReadBuffer:  4 << 20,
+				SocketWriteBuffer: 2 << 20,
+				TCPNoDelay:        ptr(false),
+			}},
+		},
+		{
+			name: "unknown",
+			input: `client_proxy the_secret {
+				bogus
+			}`,
+			err: "unrecognized subdirective bogus",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var m Middleware
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(c.input))
+			if c.err != "" {
+				ensure.Err(t, err, regexp.MustCompile(c.err))
+				return
+			}
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, &m, c.want)
+		})
+	}
+}
+
+// adapt adapts the Caddyfile, returning the configured client_proxy handlers.
+func adapt(t testing.TB, caddyfile string) []map[string]any {
+	t.Helper()
+	b, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+	ensure.Nil(t, err)
+	var config struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []struct {
+						Handle []struct {
+							Routes []struct {
+								Handle []map[string]any `json:"handle"`
+							} `json:"routes"`
+						} `json:"handle"`
+					} `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	ensure.Nil(t, json.Unmarshal(b, &config))
+	var handlers []map[string]any
+	for _, s := range config.Apps.HTTP.Servers {
+		for _, r := range s.Routes {
+			for _, h := range r.Handle {
+				for _, sr := range h.Routes {
+					handlers = append(handlers, sr.Handle...)
+				}
+			}
+		}
+	}
+	return handlers
+}
+
+func TestDefaults(t *testing.T) {
+	handlers := adapt(t, `
+		{
+			order client_proxy before respond
+			client_proxy_defaults {
+				server_timing
+				coalesce_requests {
+					max_size 1KiB
+				}
+			}
+		}
+		a.example.com {
+			client_proxy a_secret
+		}
+		b.example.com {
+			client_proxy b_secret {
+				coalesce_requests {
+					headers Accept
+				}
+			}
+		}
+	`)
+	ensure.DeepEqual(t, len(handlers), 2)
+	for _, h := range handlers {
+		ensure.DeepEqual(t, h["server_timing"], true)
+		switch h["secret"] {
+		case "a_secret":
+			ensure.DeepEqual(t, h["coalesce_requests"], map[string]any{"max_size": 1024.0})
+		case "b_secret":
+			ensure.DeepEqual(t, h["coalesce_requests"], map[string]any{"headers": []any{"Accept"}})
+		default:
+			t.Fatalf("unexpected handler: %v", h)
+		}
+	}
+}
+
+func TestNoDefaults(t *testing.T) {
+	handlers := adapt(t, `
+		{
+			order client_proxy before respond
+		}
+		example.com {
+			client_proxy the_secret
+		}
+	`)
+	ensure.DeepEqual(t, handlers, []map[string]any{{"handler": "client_proxy", "secret": "the_secret"}})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
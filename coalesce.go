@@ -0,0 +1,170 @@
+package clientproxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultCoalesceMaxSize = 1 << 20
+
+// Coalesce configures sharing a single response between concurrent identical
+// GET requests.
+type Coalesce struct {
+	// Request headers that are part of the key, in addition to the method,
+	// host and URI. Authorization and Cookie are always part of the key.
+	Headers []string `json:"headers,omitempty"`
+
+	// Responses larger than this many bytes are not shared, and waiting
+	// requests are instead sent to the client individually. Defaults to 1MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// coalescer shares in-flight responses between requests with the same key.
+type coalescer struct {
+	headers []string
+	maxSize int64
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is an in-flight request, whose response is available once done is
+// closed. res is nil if the response could not be shared.
+type call struct {
+	done chan struct{}
+	res  *sharedResponse
+}
+
+type sharedResponse struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+func newCoalescer(c *Coalesce) *coalescer {
+	maxSize := c.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultCoalesceMaxSize
+	}
+	headers := append([]string{"Authorization", "Cookie"}, c.Headers...)
+	return &coalescer{
+		headers: headers,
+		maxSize: maxSize,
+		calls:   make(map[string]*call),
+	}
+}
+
+func (c *coalescer) key(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.Host)
+	sb.WriteString(r.URL.RequestURI())
+	for _, h := range c.headers {
+		sb.WriteByte('\n')
+		sb.WriteString(h)
+		sb.WriteString(": ")
+		sb.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+// serve sends r using next, unless an identical request is already in flight
+// in which case its response is shared.
+func (c *coalescer) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.Method != http.MethodGet || r.ContentLength > 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+	key := c.key(r)
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-cl.done:
+		case <-r.Context().Done():
+			return
+		}
+		if cl.res == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// each waiter gets its own copy, which later handlers may modify
+		for k, v := range cl.res.header.Clone() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(cl.res.code)
+		w.Write(cl.res.body)
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	rec := &recorder{ResponseWriter: w, max: c.maxSize}
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		cl.res = rec.shared()
+		close(cl.done)
+	}()
+	next.ServeHTTP(rec, r)
+	rec.complete = true
+}
+
+// recorder writes through to the ResponseWriter while keeping a copy of the
+// response, as long as it stays under max bytes.
+type recorder struct {
+	http.ResponseWriter
+	max      int64
+	code     int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+	complete bool
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+		r.header = r.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(p)) > r.max {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// shared returns the recorded response if it is safe to share.
+func (r *recorder) shared() *sharedResponse {
+	if !r.complete || r.overflow || r.code == 0 {
+		return nil
+	}
+	if r.header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	cc := r.header.Get("Cache-Control")
+	if strings.Contains(cc, "private") || strings.Contains(cc, "no-store") {
+		return nil
+	}
+	return &sharedResponse{code: r.code, header: r.header, body: r.body.Bytes()}
+}
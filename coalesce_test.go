@@ -0,0 +1,82 @@
+package clientproxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func testCoalesce(t *testing.T, body string, maxSize int64) (calls int32, bodies []string) {
+	const n = 5
+	m := &Middleware{Secret: secret, CoalesceRequests: &Coalesce{MaxSize: maxSize}}
+	provision(t, m)
+	var arrived atomic.Int32
+	s := newUnstartedServer(m)
+	h := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/same" {
+			arrived.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	})
+	s.Start()
+	t.Cleanup(s.Close)
+	release := make(chan struct{})
+	var upstream atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstream.Add(1) == 1 {
+			<-release
+		}
+		w.Write([]byte(body))
+	}))
+	var wg sync.WaitGroup
+	bodies = make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, bodies[i] = get(t, s, "/same")
+		}()
+	}
+	// the first request holds the call open until all of them arrived, and
+	// had the time to reach it
+	eventually(t, func() bool { return arrived.Load() == n && upstream.Load() >= 1 })
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return upstream.Load(), bodies
+}
+
+func TestCoalesce(t *testing.T) {
+	calls, bodies := testCoalesce(t, "hello", 0)
+	ensure.DeepEqual(t, calls, int32(1))
+	for _, b := range bodies {
+		ensure.DeepEqual(t, b, "hello")
+	}
+}
+
+func TestCoalesceTooLarge(t *testing.T) {
+	body := strings.Repeat("x", 1024)
+	calls, bodies := testCoalesce(t, body, 100)
+	ensure.DeepEqual(t, calls, int32(5))
+	for _, b := range bodies {
+		ensure.DeepEqual(t, b, body)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	c := newCoalescer(&Coalesce{Headers: []string{"Accept"}})
+	a, _ := http.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil)
+	b, _ := http.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil)
+	ensure.DeepEqual(t, c.key(a), c.key(b))
+	b.Header.Set("Accept", "text/html")
+	ensure.NotDeepEqual(t, c.key(a), c.key(b))
+	b.Header.Del("Accept")
+	b.Header.Set("Cookie", "session=1")
+	ensure.NotDeepEqual(t, c.key(a), c.key(b))
+}
@@ -0,0 +1,287 @@
+package clientproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const defaultConnectDialTimeout = 10 * time.Second
+
+// ConnectForwarding configures forwarding CONNECT requests through the client,
+// which dials the requested destination and relays the bytes both ways.
+type ConnectForwarding struct {
+	// The secret CONNECT requests must present in the X-Client-Proxy-Connect
+	// header. Defaults to the secret of the handler.
+	Secret string `json:"secret,omitempty"`
+
+	// The destinations CONNECT requests may ask for, as host:port where the
+	// host may be a wildcard like *.example.com, and the port may be *. If
+	// empty, any destination is sent to the client, which should enforce its
+	// own allowlist.
+	AllowedDestinations []string `json:"allowed_destinations,omitempty"`
+
+	// The maximum time to wait for the client to connect to the destination.
+	// Defaults to 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// Close sessions without traffic in either direction for this long.
+	// Defaults to no timeout.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+}
+
+func (c *ConnectForwarding) validate() error {
+	for _, d := range c.AllowedDestinations {
+		if _, _, err := net.SplitHostPort(d); err != nil {
+			return fmt.Errorf("invalid connect_forwarding destination %s: %w", d, err)
+		}
+	}
+	return nil
+}
+
+// allowed reports if the host:port target matches AllowedDestinations.
+func (c *ConnectForwarding) allowed(target string) bool {
+	if len(c.AllowedDestinations) == 0 {
+		return true
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, d := range c.AllowedDestinations {
+		dhost, dport, _ := net.SplitHostPort(d)
+		if (dport == "*" || dport == port) && hostMatches(strings.ToLower(dhost), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isConnect reports if r is a CONNECT request to forward through the client.
+func (m *Middleware) isConnect(r *http.Request) bool {
+	return m.ConnectForwarding != nil && r.Method == http.MethodConnect && r.Host != DialAuthority
+}
+
+// connectAuthorized reports if r presents the connect_forwarding secret.
+func (m *Middleware) connectAuthorized(r *http.Request) bool {
+	v := r.Header.Get("X-Client-Proxy-Connect")
+	if v == "" {
+		return false
+	}
+	if s := m.ConnectForwarding.Secret; s != "" {
+		return subtle.ConstantTimeCompare([]byte(v), []byte(s)) == 1
+	}
+	return m.secretMatches(r.Context(), v)
+}
+
+// serveConnect forwards a CONNECT request through the client.
+func (m *Middleware) serveConnect(w http.ResponseWriter, r *http.Request) error {
+	if !m.connectAuthorized(r) {
+		return caddyhttp.Error(http.StatusProxyAuthRequired,
+			fmt.Errorf("client_proxy: missing or invalid X-Client-Proxy-Connect"))
+	}
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest,
+			fmt.Errorf("client_proxy: invalid CONNECT destination %s: %w", target, err))
+	}
+	if !m.ConnectForwarding.allowed(target) {
+		return caddyhttp.Error(http.StatusForbidden,
+			fmt.Errorf("client_proxy: CONNECT destination not allowed: %s", target))
+	}
+	h := m.handler.Load()
+	if h == nil {
+		return caddyhttp.Error(http.StatusBadGateway,
+			fmt.Errorf("client_proxy: %w", ErrNoClient))
+	}
+
+	timeout := time.Duration(m.ConnectForwarding.DialTimeout)
+	if timeout == 0 {
+		timeout = defaultConnectDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	up, err := h.openStream(ctx, target, tunnelAddr(target))
+	cancel()
+	if err != nil {
+		status := http.StatusBadGateway
+		var se statusError
+		switch {
+		case errors.As(err, &se) && int(se) >= 400 && int(se) < 500:
+			status = int(se)
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusGatewayTimeout
+		}
+		return caddyhttp.Error(status, fmt.Errorf("client_proxy: CONNECT %s: %w", target, err))
+	}
+	defer up.Close()
+
+	var down downstream
+	if r.ProtoMajor == 1 {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return fmt.Errorf("client_proxy: unable to hijack CONNECT: %w", err)
+		}
+		defer conn.Close()
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return fmt.Errorf("client_proxy: unable to clear deadline: %w", err)
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return nil
+		}
+		down = &hijackedDownstream{Conn: conn, r: buf.Reader}
+	} else {
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+		down = &streamDownstream{body: r.Body, w: w, rc: rc}
+	}
+
+	start := time.Now()
+	sent, received := relay(down, up, time.Duration(m.ConnectForwarding.IdleTimeout))
+	m.logger.Info("CONNECT session ended",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("destination", target),
+		zap.Duration("duration", time.Since(start)),
+		zap.Int64("bytes_sent", sent),
+		zap.Int64("bytes_received", received),
+	)
+	return nil
+}
+
+// downstream is the visitor side of a CONNECT session.
+type downstream interface {
+	io.ReadWriter
+	// closeWrite signals no more data will be written.
+	closeWrite()
+	// close aborts the session.
+	close()
+}
+
+// hijackedDownstream is an HTTP/1 CONNECT session.
+type hijackedDownstream struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (d *hijackedDownstream) Read(p []byte) (int, error) { return d.r.Read(p) }
+
+func (d *hijackedDownstream) closeWrite() {
+	if cw, ok := d.Conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+func (d *hijackedDownstream) close() { d.Conn.Close() }
+
+// streamDownstream is an HTTP/2 CONNECT session. The response can only be
+// ended by returning from the handler, so it does not support half-close.
+type streamDownstream struct {
+	body io.ReadCloser
+	w    io.Writer
+	rc   *http.ResponseController
+}
+
+func (d *streamDownstream) Read(p []byte) (int, error) { return d.body.Read(p) }
+
+func (d *streamDownstream) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if err == nil {
+		err = d.rc.Flush()
+	}
+	return n, err
+}
+
+func (d *streamDownstream) closeWrite() {}
+
+func (d *streamDownstream) close() { d.body.Close() }
+
+// relay copies between down and up until both directions are done, closing
+// the write side of each once its source ends. It returns the bytes sent to
+// and received from the client.
+func relay(down downstream, up *streamConn, idle time.Duration) (sent, received int64) {
+	var closeOnce sync.Once
+	abort := func() {
+		closeOnce.Do(func() {
+			down.close()
+			up.Close()
+		})
+	}
+	var last atomic.Int64
+	touch := func() { last.Store(time.Now().UnixNano()) }
+	touch()
+	if idle > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			t := time.NewTimer(idle)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+				}
+				if since := time.Since(time.Unix(0, last.Load())); since < idle {
+					t.Reset(idle - since)
+					continue
+				}
+				abort()
+				return
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(up, activityReader{down, touch})
+		up.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		var err error
+		received, err = io.Copy(down, activityReader{up, touch})
+		if err != nil {
+			// the visitor went away, or the client aborted
+			abort()
+			return
+		}
+		down.closeWrite()
+		if _, ok := down.(*streamDownstream); ok {
+			// the response ends with the handler, so stop reading too
+			abort()
+		}
+	}()
+	wg.Wait()
+	abort()
+	return sent, received
+}
+
+// activityReader calls touch after every read.
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.touch()
+	return n, err
+}
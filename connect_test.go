@@ -0,0 +1,165 @@
+package clientproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// connectClient echoes CONNECT sessions to db.internal:5432, waits without
+// responding for idle.internal:1, and rejects other destinations.
+func connectClient(w http.ResponseWriter, r *http.Request) {
+	switch r.Host {
+	case "db.internal:5432":
+		echoStreams(w, &http.Request{Method: http.MethodConnect, Host: DialAuthority, Body: r.Body})
+	case "idle.internal:1":
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	default:
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+func newConnectMiddleware(t testing.TB, c *ConnectForwarding) (*Middleware, *observer.ObservedLogs) {
+	m := &Middleware{Secret: secret, ConnectForwarding: c}
+	provision(t, m)
+	core, logs := observer.New(zapcore.InfoLevel)
+	m.logger = zap.New(core)
+	return m, logs
+}
+
+// dialConnect sends an HTTP/1.1 CONNECT request for target on a new
+// connection.
+func dialConnect(t testing.TB, s *httptest.Server, target, auth string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Client-Proxy-Connect: %s\r\n\r\n", target, target, auth)
+	ensure.Nil(t, err)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	ensure.Nil(t, err)
+	return conn, br, res
+}
+
+func TestConnectForwarding(t *testing.T) {
+	m, logs := newConnectMiddleware(t, &ConnectForwarding{})
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(connectClient))
+
+	conn, br, res := dialConnect(t, s, "db.internal:5432", secret)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	_, err := io.WriteString(conn, "ping")
+	ensure.Nil(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(b), "ping")
+
+	// half-close: the client sees the end, and its response still arrives
+	_, err = io.WriteString(conn, "last")
+	ensure.Nil(t, err)
+	ensure.Nil(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(br)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(rest), "last")
+
+	eventually(t, func() bool { return logs.FilterMessage("CONNECT session ended").Len() == 1 })
+	fields := logs.FilterMessage("CONNECT session ended").All()[0].ContextMap()
+	ensure.DeepEqual(t, fields["destination"], "db.internal:5432")
+	ensure.DeepEqual(t, fields["bytes_sent"], int64(8))
+	ensure.DeepEqual(t, fields["bytes_received"], int64(8))
+}
+
+func TestConnectForwardingHTTP2(t *testing.T) {
+	m, _ := newConnectMiddleware(t, &ConnectForwarding{})
+	connect(t, m, newServer(t, m), http.HandlerFunc(connectClient))
+	s := newUnstartedServer(m)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, s.URL, pr)
+	ensure.Nil(t, err)
+	req.Host = "db.internal:5432"
+	req.Header.Set("X-Client-Proxy-Connect", secret)
+	res, err := s.Client().Do(req)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	ensure.DeepEqual(t, res.ProtoMajor, 2)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	_, err = io.WriteString(pw, "ping")
+	ensure.Nil(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(res.Body, b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(b), "ping")
+	ensure.Nil(t, pw.Close())
+	rest, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(rest), "")
+}
+
+func TestConnectForwardingRejected(t *testing.T) {
+	m, _ := newConnectMiddleware(t, &ConnectForwarding{
+		Secret:              "connect_secret",
+		AllowedDestinations: []string{"*.internal:5432", "other.internal:*"},
+	})
+	s := newServer(t, m)
+
+	_, _, res := dialConnect(t, s, "db.internal:5432", "connect_secret")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway, "no client")
+
+	connect(t, m, s, http.HandlerFunc(connectClient))
+	for _, c := range []struct {
+		target, auth string
+		status       int
+	}{
+		{"db.internal:5432", "connect_secret", http.StatusOK},
+		{"db.internal:5432", secret, http.StatusProxyAuthRequired},
+		{"db.internal:5432", "", http.StatusProxyAuthRequired},
+		{"db.internal:22", "connect_secret", http.StatusForbidden},
+		{"example.com:5432", "connect_secret", http.StatusForbidden},
+		{"other.internal:80", "connect_secret", http.StatusForbidden},
+	} {
+		_, _, res := dialConnect(t, s, c.target, c.auth)
+		ensure.DeepEqual(t, res.StatusCode, c.status, c.target, c.auth)
+	}
+}
+
+func TestConnectForwardingIdleTimeout(t *testing.T) {
+	m, logs := newConnectMiddleware(t, &ConnectForwarding{
+		IdleTimeout: caddy.Duration(100 * time.Millisecond),
+	})
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(connectClient))
+
+	start := time.Now()
+	_, br, res := dialConnect(t, s, "idle.internal:1", secret)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	_, err := io.ReadAll(br)
+	ensure.Nil(t, err)
+	ensure.True(t, time.Since(start) >= 100*time.Millisecond)
+	eventually(t, func() bool { return logs.FilterMessage("CONNECT session ended").Len() == 1 })
+}
+
+func TestConnectForwardingInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, ConnectForwarding: &ConnectForwarding{
+		AllowedDestinations: []string{"db.internal"},
+	}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("invalid connect_forwarding destination db.internal"))
+}
@@ -0,0 +1,89 @@
+package clientproxy
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// CORS configures answering CORS preflight requests without forwarding them
+// to the client.
+type CORS struct {
+	// Origins allowed to make requests, or * for any.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+
+	// Methods allowed in requests. Defaults to GET, HEAD and POST.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// Headers allowed in requests, or * to allow those requested.
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+
+	// Allow requests with credentials.
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+
+	// How long browsers may cache the preflight response.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	return origin != "" && (slices.Contains(c.AllowedOrigins, "*") || slices.Contains(c.AllowedOrigins, origin))
+}
+
+// setOrigin sets the headers allowing the origin, if it is allowed.
+func (c *CORS) setOrigin(h http.Header, origin string) bool {
+	h.Add("Vary", "Origin")
+	if !c.allowsOrigin(origin) {
+		return false
+	}
+	if c.AllowCredentials || !slices.Contains(c.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// servePreflight answers a preflight request.
+func (c *CORS) servePreflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	if c.setOrigin(h, r.Header.Get("Origin")) {
+		methods := c.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if slices.Contains(c.AllowedHeaders, "*") {
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+		} else if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge).Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// modifyResponse allows the origin on responses from the client, unless the
+// client handles CORS itself.
+func (c *CORS) modifyResponse(res *http.Response) error {
+	if res.Header.Get("Access-Control-Allow-Origin") == "" {
+		c.setOrigin(res.Header, res.Request.Header.Get("Origin"))
+	}
+	return nil
+}
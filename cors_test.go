@@ -0,0 +1,80 @@
+package clientproxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+)
+
+func newCORSServer(t *testing.T, upstream http.HandlerFunc) (*Middleware, string) {
+	m := &Middleware{Secret: secret, CORS: &CORS{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPut},
+		AllowedHeaders: []string{"*"},
+		MaxAge:         caddy.Duration(time.Hour),
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, upstream)
+	return m, s.URL
+}
+
+func options(t *testing.T, url string, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodOptions, url, nil)
+	ensure.Nil(t, err)
+	req.Header = header
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	return res
+}
+
+func TestCORSPreflight(t *testing.T) {
+	_, url := newCORSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight was forwarded")
+	})
+	res := options(t, url, http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {http.MethodPut},
+		"Access-Control-Request-Headers": {"X-Custom"},
+	})
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNoContent)
+	ensure.DeepEqual(t, res.Header.Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	ensure.DeepEqual(t, res.Header.Get("Access-Control-Allow-Methods"), "GET, PUT")
+	ensure.DeepEqual(t, res.Header.Get("Access-Control-Allow-Headers"), "X-Custom")
+	ensure.DeepEqual(t, res.Header.Get("Access-Control-Max-Age"), "3600")
+
+	res = options(t, url, http.Header{
+		"Origin":                        {"https://evil.example.com"},
+		"Access-Control-Request-Method": {http.MethodPut},
+	})
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNoContent)
+	ensure.DeepEqual(t, res.Header.Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestCORSForwarded(t *testing.T) {
+	var forwarded atomic.Int32
+	_, url := newCORSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.Header().Set("Allow", "GET, OPTIONS")
+	})
+	// not a preflight
+	res := options(t, url, http.Header{})
+	ensure.DeepEqual(t, forwarded.Load(), int32(1))
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, res.Header.Get("Allow"), "GET, OPTIONS")
+
+	// actual CORS request
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("Origin", "https://app.example.com")
+	res, err = http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, forwarded.Load(), int32(2))
+	ensure.DeepEqual(t, res.Header.Get("Access-Control-Allow-Origin"), "https://app.example.com")
+}
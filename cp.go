@@ -2,12 +2,20 @@ package clientproxy
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +23,9 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
 
@@ -22,16 +33,104 @@ var h2t = http2.Transport{}
 
 const (
 	shutdownTimeout = time.Minute
+	monitorInterval = time.Second
+	pingTimeout     = 10 * time.Second
+
+	defaultHandshakeTimeout = 10 * time.Second
+
+	// the wait before the first retry of the HTTP/2 handshake, doubling with
+	// every retry
+	handshakeRetryBackoff = 50 * time.Millisecond
+
+	hijackedErrorTimeout = time.Second
+
+	// the nonstandard status used by Caddy and nginx for requests canceled
+	// by the visitor, which only appears in logs
+	statusClientClosedRequest = 499
+
+	defaultSelfTestPath = "/healthz"
 )
 
 func init() {
 	caddy.RegisterModule(&Middleware{})
 	httpcaddyfile.RegisterHandlerDirective("client_proxy", parseCaddyfile)
+	httpcaddyfile.RegisterGlobalOption("client_proxy_defaults", parseDefaults)
 }
 
 type handler struct {
-	proxy *httputil.ReverseProxy
-	done  chan struct{}
+	proxy       *httputil.ReverseProxy
+	transport   http.RoundTripper // of a single attempt, for retries
+	conn        *http2.ClientConn
+	done        chan struct{} // closed by close, and nowhere else
+	closeOnce   sync.Once
+	remoteAddr  string
+	localAddr   string
+	connectedAt time.Time
+	sc          *settingsConn
+	flow        *flowConn
+	requests    atomic.Uint64
+	lastPing    atomic.Pointer[Ping]
+	maxBody     int64
+	maxInflight int64 // as declared by the client
+	inflight    atomic.Int64
+	lastUsed    atomic.Int64 // unix nanoseconds of the last request, or registration
+	hosts       []string
+	paths       []string
+	timeout     time.Duration
+	subject     string
+	expires     time.Time
+	verbose     bool // requests are logged at the info level
+	metadata    map[string]string
+	tag         string // echoed on responses, if echo_tag is set
+}
+
+// serves reports if the client wants to serve the request. Streams for Dial
+// are never served for visitors.
+func (h *handler) serves(r *http.Request) bool {
+	return h.servesHost(r) && (len(h.paths) == 0 || hasAnyPrefix(h.paths, r.URL.Path))
+}
+
+// servesHost reports if the client claimed the host of the request.
+func (h *handler) servesHost(r *http.Request) bool {
+	if r.Method == http.MethodConnect && r.Host == DialAuthority {
+		return false
+	}
+	return len(h.hosts) == 0 || matchesAny(h.hosts, requestHost(r.Host))
+}
+
+// acquire reserves a slot for a request, reporting false if the client
+// already has limit requests, unless limit is 0. Acquired slots must be
+// released.
+func (h *handler) acquire(limit int64) bool {
+	if h.inflight.Add(1) > limit && limit > 0 {
+		h.inflight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release frees a slot reserved by acquire.
+func (h *handler) release() {
+	h.inflight.Add(-1)
+}
+
+// closed reports if close was called.
+func (h *handler) closed() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close signals the handler is no longer in use, counting the eviction with
+// evicted. It is safe to call multiple times, only the first counts.
+func (h *handler) close(evicted prometheus.Counter) {
+	h.closeOnce.Do(func() {
+		evicted.Inc()
+		close(h.done)
+	})
 }
 
 // Middleware implements an HTTP handler that allows for a client to become the
@@ -40,8 +139,441 @@ type Middleware struct {
 	// The secret to allow for registering a client.
 	Secret string `json:"secret,omitempty"`
 
+	// A bcrypt or argon2id encoded hash of the secret, used instead of Secret
+	// to keep the plaintext out of the config.
+	SecretHash string `json:"secret_hash,omitempty"`
+
+	// Accept registrations only on this dedicated listener, instead of the
+	// sites the handler is used in.
+	RegistrationListener *RegistrationListener `json:"registration_listener,omitempty"`
+
+	// The address advertised to clients trying to register over HTTP/2, which
+	// cannot take over the connection, such as a registration_listener or a
+	// site only serving HTTP/1.1.
+	RegistrationAddress string `json:"registration_address,omitempty"`
+
+	// A file to read the secret from, used instead of Secret.
+	SecretFile string `json:"secret_file,omitempty"`
+
+	// Reload SecretFile this often, so the secret can be rotated without a
+	// config reload. It may also be reloaded using the admin API.
+	SecretFileInterval caddy.Duration `json:"secret_file_interval,omitempty"`
+
+	// Name identifies the handler in the admin API.
+	Name string `json:"name,omitempty"`
+
+	// What to do when another handler in the same config has the Name:
+	// "warn" logs a warning, leaving the admin API to address the first of
+	// them, "reject" fails provisioning, and "suffix" appends -2, -3 and so on
+	// to make the name unique. Defaults to warn.
+	OnDuplicateName string `json:"on_duplicate_name,omitempty"`
+
+	// The instance label of metrics, also included in logs. Defaults to the
+	// Name, or client_proxy.
+	InstanceLabel string `json:"instance_label,omitempty"`
+
+	// Publish the counters of the handler using expvar, under client_proxy
+	// keyed by the instance label.
+	Expvar bool `json:"expvar,omitempty"`
+
+	// Add a Server-Timing header to proxied responses, reporting the time
+	// spent in the tunnel and the time to first byte from the client.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	// Headers that must be present on requests before they are forwarded to
+	// the client. If values are given, the header must have one of them.
+	// Requests missing them are rejected with a 400, or a 401 for
+	// Authorization.
+	RequireHeaders http.Header `json:"require_headers,omitempty"`
+
+	// The methods of requests that may be forwarded to the client. Others are
+	// rejected with a 405. Defaults to any method.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// Reject requests with these methods with a 405 instead of forwarding
+	// them to the client.
+	DeniedMethods []string `json:"denied_methods,omitempty"`
+
+	// The maximum size in bytes of request bodies forwarded to the client.
+	// Clients may declare a smaller limit when registering using the
+	// X-Client-Proxy-Max-Body header.
+	MaxRequestBody int64 `json:"max_request_body,omitempty"`
+
+	// The maximum number of requests forwarded to the client at once, beyond
+	// which requests are rejected with a 503. Clients may declare a smaller
+	// limit when registering using the X-Client-Proxy-Max-Inflight header.
+	MaxInflight int64 `json:"max_inflight,omitempty"`
+
+	// The maximum size in bytes of the header fields of requests forwarded to
+	// the client, as serialized in HTTP/1 and including cookies. Larger
+	// requests are rejected with a 431.
+	MaxRequestHeaderSize int64 `json:"max_request_header_size,omitempty"`
+
+	// The maximum number of header fields of requests forwarded to the
+	// client. Requests with more are rejected with a 431.
+	MaxRequestHeaderCount int `json:"max_request_header_count,omitempty"`
+
+	// The maximum size in bytes of the header fields of responses from the
+	// client, as counted by HTTP/2, which adds 32 bytes per field. Larger
+	// responses are answered with a 502, and a single larger field also
+	// closes the connection to the client. Defaults to 10MiB.
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes,omitempty"`
+
+	// The hosts clients may claim when registering using the
+	// X-Client-Proxy-Hosts header. Entries are exact names, or wildcards like
+	// *.example.com. If empty, clients may claim any host.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	// The path prefixes clients may claim when registering using the
+	// X-Client-Proxy-Paths header. Claims must start with one of them. If
+	// empty, clients may claim any path.
+	AllowedPaths []string `json:"allowed_paths,omitempty"`
+
+	// The ALPN protocols the TLS connection of a registration may have
+	// negotiated, like http/1.1. Other registrations, including those without
+	// TLS, are rejected with a 400. If empty, any protocol is accepted.
+	AllowedALPN []string `json:"allowed_alpn,omitempty"`
+
+	// Read a JSON RegistrationBody of up to 64KiB from registrations with a
+	// Content-Type of application/json, to describe the client without many
+	// headers.
+	RegistrationBody bool `json:"registration_body,omitempty"`
+
+	// Set the X-Client-Proxy-Tag header a client sends when registering on
+	// every response it serves, so it can tell which tunnel served a request.
+	EchoTag bool `json:"echo_tag,omitempty"`
+
+	// Respond with this status, either 421 or 502, to requests for hosts the
+	// connected client did not claim, instead of passing them down the chain.
+	HostMismatchStatus int `json:"host_mismatch_status,omitempty"`
+
+	// Reject registrations with a 429 from an IP address that already has
+	// this many clients connected, to this or other client_proxy handlers.
+	// The client a registration would replace is not counted. Defaults to no
+	// limit.
+	MaxClientsPerIP int `json:"max_clients_per_ip,omitempty"`
+
+	// The maximum number of clients connected to this and other client_proxy
+	// handlers in the process. The client a registration would replace is not
+	// counted. Defaults to no limit.
+	MaxClients int `json:"max_clients,omitempty"`
+
+	// What to do with a registration beyond max_clients, either evict, which
+	// disconnects the least recently used client of any handler to admit it,
+	// or reject, which rejects it with a 429. Defaults to evict.
+	OnMaxClients string `json:"on_max_clients,omitempty"`
+
+	// Reject registrations within this long of the previous one with a 429,
+	// so a client reconnecting in a tight loop does not keep replacing the
+	// connected client. Defaults to no limit.
+	MinReconnectInterval caddy.Duration `json:"min_reconnect_interval,omitempty"`
+
+	// The maximum time from hijacking the registration request until the
+	// client completed the HTTP/2 handshake, after which the connection is
+	// closed. Defaults to 10s.
+	HandshakeTimeout caddy.Duration `json:"handshake_timeout,omitempty"`
+
+	// Reject registrations with a 503 while this many others have not yet
+	// completed the HTTP/2 handshake, so stalled handshakes cannot tie up
+	// resources until handshake_timeout. Defaults to no limit.
+	MaxPendingRegistrations int `json:"max_pending_registrations,omitempty"`
+
+	// Retry starting HTTP/2 on a registration up to this many times when
+	// writing its preface fails before any of it was written, as for a
+	// momentary error. The retries wait 50ms, doubling each time, and are
+	// bounded by handshake_timeout. Defaults to no retries.
+	HandshakeRetries int `json:"handshake_retries,omitempty"`
+
+	// The maximum time to write out what was buffered for the registration
+	// request once it is hijacked, after which the registration fails.
+	// Defaults to handshake_timeout, which also bounds it when longer.
+	FlushTimeout caddy.Duration `json:"flush_timeout,omitempty"`
+
+	// Disconnect clients gracefully once they have been connected this long,
+	// so they reconnect with fresh TLS and HTTP/2 handshakes. Neither can be
+	// redone over the established connection. Defaults to never.
+	RehandshakeInterval caddy.Duration `json:"rehandshake_interval,omitempty"`
+
+	// The maximum time a forwarded request may take, including reading the
+	// response. Defaults to no timeout.
+	RequestTimeout caddy.Duration `json:"request_timeout,omitempty"`
+
+	// The maximum request timeout clients may declare when registering using
+	// the X-Client-Proxy-Request-Timeout header. Declared timeouts are capped
+	// to this, and ignored if it is not set.
+	MaxRequestTimeout caddy.Duration `json:"max_request_timeout,omitempty"`
+
+	// The maximum time to wait for the client to start responding, after
+	// sending it the request. Defaults to no timeout.
+	ResponseHeaderTimeout caddy.Duration `json:"response_header_timeout,omitempty"`
+
+	// The maximum bandwidth in bytes per second from the client, shared by all
+	// requests. Defaults to no limit.
+	MaxBandwidthUp int64 `json:"max_bandwidth_up,omitempty"`
+
+	// The maximum bandwidth in bytes per second to the client, shared by all
+	// requests. Defaults to no limit.
+	MaxBandwidthDown int64 `json:"max_bandwidth_down,omitempty"`
+
+	// Log the headers of forwarded requests and their responses at the debug
+	// level.
+	DebugHeaders *DebugHeaders `json:"debug_headers,omitempty"`
+
+	// Clients registering with this token in the X-Client-Proxy-Debug header
+	// have their forwarded requests and responses logged at the info level,
+	// as with DebugHeaders, to trace one client without logging all of them.
+	DebugToken string `json:"debug_token,omitempty"`
+
+	// Answer CORS preflight requests without forwarding them to the client.
+	CORS *CORS `json:"cors,omitempty"`
+
+	// When the client declares trailers but fails before sending them, end
+	// the response with empty trailers instead of aborting it.
+	FinalizeMissingTrailers bool `json:"finalize_missing_trailers,omitempty"`
+
+	// The status to respond with when the client resets the stream of a
+	// request before responding. Defaults to 502.
+	StreamResetStatus int `json:"stream_reset_status,omitempty"`
+
+	// Respond with a 503 and close the connection for requests reaching the
+	// handler once it is shutting down, instead of passing them down the
+	// chain.
+	RejectOnShutdown bool `json:"reject_on_shutdown,omitempty"`
+
+	// How long the handler waits on shutdown for the requests in flight on
+	// the connected client, and any it replaced, to finish, after which the
+	// connections are closed. Defaults to 1m.
+	CleanupGrace caddy.Duration `json:"cleanup_grace,omitempty"`
+
+	// How the connection of a client is shut down once it is replaced,
+	// evicted or the handler shuts down, either graceful, letting in-flight
+	// requests finish, or immediate, closing it right away and aborting them.
+	// Defaults to graceful.
+	ShutdownMode string `json:"shutdown_mode,omitempty"`
+
+	// End the upload of the request body once the client responds, instead
+	// of continuing to stream it while the response is forwarded.
+	AbortUploadOnResponse bool `json:"abort_upload_on_response,omitempty"`
+
+	// Retry failed requests for up to this long, using the newest registered
+	// client for each attempt. Only Retryable requests are retried, unless
+	// retry_idempotent is false, with bodies of up to 1MiB.
+	TryDuration caddy.Duration `json:"try_duration,omitempty"`
+
+	// How long to wait between attempts. Defaults to 250ms.
+	TryInterval caddy.Duration `json:"try_interval,omitempty"`
+
+	// Methods to retry in addition to GET, HEAD, OPTIONS and TRACE.
+	RetryMethods []string `json:"retry_methods,omitempty"`
+
+	// Retry requests carrying an Idempotency-Key header, whatever their
+	// method.
+	RetryIdempotencyKey bool `json:"retry_idempotency_key,omitempty"`
+
+	// Only retry idempotent requests, as reported by Retryable. Defaults to
+	// true. If false, requests of any method are retried.
+	RetryIdempotent *bool `json:"retry_idempotent,omitempty"`
+
+	// The path requested through the client by the admin API self-test.
+	// Defaults to /healthz.
+	SelfTestPath string `json:"self_test_path,omitempty"`
+
+	// Serve a JSON document summarizing the handler, its client and limits
+	// at this path, without the admin API. It is only served to requests
+	// from StatusAllowedIPs, or presenting the secret.
+	StatusPath string `json:"status_path,omitempty"`
+
+	// The addresses and CIDR ranges allowed to read the StatusPath without
+	// the secret.
+	StatusAllowedIPs []string `json:"status_allowed_ips,omitempty"`
+
+	// Call this webhook when a request arrives while no client is connected,
+	// for example to wake a suspended machine.
+	OnNoClientWebhook *NoClientWebhook `json:"on_no_client_webhook,omitempty"`
+
+	// Wait up to this long for a client to register when a request arrives
+	// while none is connected, instead of passing it down the chain.
+	WaitForClient caddy.Duration `json:"wait_for_client,omitempty"`
+
+	// Queue matching requests while no client is connected, and replay them
+	// once one registers.
+	Spool *Spool `json:"spool,omitempty"`
+
+	// Proxy requests to this http or https URL while no client is connected,
+	// instead of passing them down the chain. Spooled requests are not.
+	FallbackUpstream string `json:"fallback_upstream,omitempty"`
+
+	// Redirect requests to a backup or status page while no client is
+	// connected, instead of passing them down the chain. Spooled requests
+	// are not.
+	OfflineRedirect *OfflineRedirect `json:"offline_redirect,omitempty"`
+
+	// Send requests matching a route to the client of the named handler,
+	// instead of the client of this one. The first matching route is used.
+	Routes []*TunnelRoute `json:"routes,omitempty"`
+
+	// Coalesce concurrent identical GET requests, so only one of them is sent
+	// to the client and its response is shared.
+	CoalesceRequests *Coalesce `json:"coalesce_requests,omitempty"`
+
+	// Keep the responses to requests carrying an Idempotency-Key header, and
+	// return them for repeated requests with the same key instead of sending
+	// those to the client.
+	IdempotencyCache *Idempotency `json:"idempotency_cache,omitempty"`
+
+	// Forward authenticated CONNECT requests through the client, which dials
+	// the requested destination.
+	ConnectForwarding *ConnectForwarding `json:"connect_forwarding,omitempty"`
+
+	// Where registrations may present the secret, checked in order: header
+	// for X-Client-Proxy, bearer for an Authorization bearer token, and query
+	// for the cp_token query parameter, which is removed from requests before
+	// they are logged or forwarded. Defaults to header. Bearer tokens are
+	// compared against the secret values only, never hashed, as visitors send
+	// their own.
+	CredentialSources []string `json:"credential_sources,omitempty"`
+
+	// Additional secrets accepted for registration, each optionally only
+	// within a validity window.
+	Secrets []*Credential `json:"secrets,omitempty"`
+
+	// Disconnect clients once the credential they registered with expires.
+	// By default established tunnels are left alone.
+	EnforceExpiryOnActive bool `json:"enforce_expiry_on_active,omitempty"`
+
+	// Accept registrations presenting a token signed with the configured key,
+	// in addition to or instead of the secret.
+	JWT *JWT `json:"jwt,omitempty"`
+
+	// Authorities the client uses internally, like localhost:8080, to replace
+	// with the one the request was made to in the Location header of
+	// redirects. Entries without a port match any port, and may be a wildcard
+	// like *.internal.
+	RewriteRedirects []string `json:"rewrite_redirects,omitempty"`
+
+	// A path prefix, like /app, to remove from requests before forwarding them
+	// to the client, for clients serving at / what is exposed under a subpath.
+	// Requests without it are forwarded unchanged. With rewrite_redirects, it
+	// is added back to absolute paths in the Location header of redirects.
+	StripPathPrefix string `json:"strip_path_prefix,omitempty"`
+
+	// Reject requests without the strip_path_prefix with a 404, instead of
+	// forwarding them unchanged.
+	StripPathPrefixRequired bool `json:"strip_path_prefix_required,omitempty"`
+
+	// A path prefix, like /app, to add to requests before forwarding them to
+	// the client, for clients serving under a subpath. It is added after
+	// strip_path_prefix is removed.
+	AddPathPrefix string `json:"add_path_prefix,omitempty"`
+
+	// Reject requests whose path has .. segments or NUL bytes with a 400, and
+	// remove duplicate slashes and . segments from the path of others before
+	// forwarding them to the client.
+	SanitizePath bool `json:"sanitize_path,omitempty"`
+
+	// Forward the path exactly as the visitor sent it, instead of escaping
+	// characters like " that should have been. strip_path_prefix,
+	// add_path_prefix and sanitize_path still apply.
+	PreserveRequestURI bool `json:"preserve_request_uri,omitempty"`
+
+	// Send requests to the client with the Host they were made to. If false,
+	// they are instead sent with the Host the client registered at, with the
+	// original in the X-Forwarded-Host header. Defaults to true.
+	PreserveHost *bool `json:"preserve_host,omitempty"`
+
+	// The Host to forward requests that arrived without one, like HTTP/1.0
+	// requests, with. If empty, they are rejected with a 400 instead of being
+	// forwarded with an empty :authority, which the client cannot accept.
+	DefaultHost string `json:"default_host,omitempty"`
+
+	// Forward details of the TLS connection requests arrived on to the client
+	// in request headers.
+	TLSHeaders *TLSHeaders `json:"tls_headers,omitempty"`
+
+	// Forward the TLS server name (SNI) requests arrived with to the client in
+	// this header, for clients routing virtual hosts on it. Values for it sent
+	// by the visitor are always removed.
+	ForwardSNIHeader string `json:"forward_sni_header,omitempty"`
+
+	// Reject new requests with a 503 while the responses being forwarded are
+	// estimated to take more than this many bytes, to protect constrained
+	// clients buffering them. Responses count their remaining length, or the
+	// 4MiB stream flow control window if it is unknown.
+	MaxStreamMemory int64 `json:"max_stream_memory,omitempty"`
+
+	// Sign forwarded requests in the X-CP-Signature header, so the client can
+	// verify they came through the handler.
+	SignRequests *SignRequests `json:"sign_requests,omitempty"`
+
+	// Make simple substitutions in the body of text responses from the
+	// client, which it did not compress.
+	ReplaceResponse *ReplaceResponse `json:"replace_response,omitempty"`
+
+	// Tune the HTTP/2 connection to the client.
+	Performance *Performance `json:"performance,omitempty"`
+
+	// OnAccept, if set, is called with registration requests before the
+	// connection is taken over. Returning an error rejects the registration,
+	// with a 403 unless it is a caddyhttp.HandlerError. It can only be set by
+	// programs embedding the module.
+	OnAccept func(r *http.Request) error `json:"-"`
+
 	// stores a *handler, when available
-	handler atomic.Value
+	handler atomic.Pointer[handler]
+
+	logger      *zap.Logger
+	metrics     *instanceMetrics
+	h2t         *http2.Transport
+	coalescer   *coalescer
+	spooler     *spooler
+	idempotency *idempotencyCache
+	fallback    *httputil.ReverseProxy
+	redact      map[string]bool
+	counters    counters
+	hash        secretHash
+	hashes      *hashGuard
+	fileSecret  atomic.Pointer[string]
+	mu          sync.Mutex // guards stopping with the tunnels being added
+	stopping    atomic.Bool
+	tunnels     sync.WaitGroup
+	forceClose  context.Context // canceled once cleanup_grace has passed
+	forceCancel context.CancelFunc
+	load        <-chan struct{} // done once the config provisioning it stops
+
+	lastRegistration time.Time     // guarded by mu
+	registered       chan struct{} // guarded by mu, closed on registration
+	lastWebhook      atomic.Int64
+	streamMemory     atomic.Int64
+	maxInflight      atomic.Int64 // MaxInflight, or as updated by the admin API
+	pending          atomic.Int64 // registrations not yet ready
+	statusIPs        []netip.Prefix
+}
+
+// counters tracks notable events for the status output.
+type counters struct {
+	requests         atomic.Uint64
+	failures         atomic.Uint64
+	downstreamAborts atomic.Uint64
+	clientCanceled   atomic.Uint64
+	fallbacks        atomic.Uint64
+	panics           atomic.Uint64
+	missingTrailers  atomic.Uint64
+	retries          atomic.Uint64
+	streamResets     atomic.Uint64
+}
+
+func (c *counters) snapshot() Counters {
+	return Counters{
+		Requests:         c.requests.Load(),
+		Failures:         c.failures.Load(),
+		DownstreamAborts: c.downstreamAborts.Load(),
+		ClientCanceled:   c.clientCanceled.Load(),
+		FallbackRequests: c.fallbacks.Load(),
+		Panics:           c.panics.Load(),
+		MissingTrailers:  c.missingTrailers.Load(),
+		Retries:          c.retries.Load(),
+		StreamResets:     c.streamResets.Load(),
+	}
 }
 
 // CaddyModule returns the Caddy module information.
@@ -54,105 +586,2207 @@ func (*Middleware) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner.
 func (m *Middleware) Provision(ctx caddy.Context) error {
+	// first, as Cleanup is called even if provisioning fails
+	m.forceClose, m.forceCancel = context.WithCancel(context.Background())
+	// before the name is used for the instance label
+	m.load = ctx.Done()
+	if err := m.claimName(ctx.Logger()); err != nil {
+		return err
+	}
+	m.logger = ctx.Logger().With(zap.String("instance", m.instanceLabel()))
+	metrics, err := newInstanceMetrics(ctx.GetMetricsRegistry(), m.instanceLabel())
+	if err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+	m.metrics = metrics
+	m.hashes = newHashGuard()
+	if m.SecretHash != "" {
+		hash, err := parseSecretHash(m.SecretHash)
+		if err != nil {
+			return err
+		}
+		m.hash = hash
+	}
+	if m.SecretFile != "" {
+		if err := m.loadSecretFile(); err != nil {
+			return err
+		}
+		if m.SecretFileInterval > 0 {
+			go m.pollSecretFile(ctx, m.logger, time.Duration(m.SecretFileInterval))
+		}
+	}
+	for _, c := range m.Secrets {
+		if err := c.provision(); err != nil {
+			return err
+		}
+	}
+	if slices.Contains(m.CredentialSources, "bearer") && m.hasSecretHashes() {
+		m.logger.Warn("bearer credentials are only compared against secret values, not hashes, " +
+			"as visitors send bearer tokens of their own")
+	}
+	statusIPs, err := parseStatusAllowedIPs(m.StatusAllowedIPs)
+	if err != nil {
+		return err
+	}
+	m.statusIPs = statusIPs
+	if m.JWT != nil {
+		if err := m.JWT.provision(); err != nil {
+			return err
+		}
+	}
+	m.h2t = m.Performance.transport(uint32(m.MaxResponseHeaderBytes))
+	m.maxInflight.Store(m.MaxInflight)
+	if m.CoalesceRequests != nil {
+		m.coalescer = newCoalescer(m.CoalesceRequests)
+	}
+	if m.Spool != nil {
+		m.spooler = newSpooler(m.Spool)
+	}
+	if m.IdempotencyCache != nil {
+		m.idempotency = newIdempotencyCache(m.IdempotencyCache)
+	}
+	if m.FallbackUpstream != "" {
+		fallback, err := m.newFallbackProxy()
+		if err != nil {
+			return err
+		}
+		m.fallback = fallback
+	}
+	for _, tr := range m.Routes {
+		if err := tr.provision(ctx); err != nil {
+			return err
+		}
+	}
+	if m.RegistrationListener != nil {
+		if err := m.RegistrationListener.listen(ctx, m); err != nil {
+			return err
+		}
+	}
+	if m.DebugHeaders != nil || m.DebugToken != "" {
+		m.redact = m.DebugHeaders.redacted()
+	}
+	registry.add(m)
+	if m.Expvar {
+		initExpvar()
+	}
+	return nil
+}
+
+// claimName resolves a Name used by another handler of the same config
+// according to on_duplicate_name. Handlers of the previous config are still
+// provisioned during a reload, and do not count.
+func (m *Middleware) claimName(logger *zap.Logger) error {
+	if m.Name == "" || !registry.nameTaken(m.Name, m.load) {
+		return nil
+	}
+	switch m.OnDuplicateName {
+	case "reject":
+		return fmt.Errorf("name %s is used by another client_proxy handler", m.Name)
+	case "suffix":
+		for i := 2; ; i++ {
+			if name := m.Name + "-" + strconv.Itoa(i); !registry.nameTaken(name, m.load) {
+				logger.Info("name used by another client_proxy handler, renamed",
+					zap.String("name", m.Name), zap.String("renamed", name))
+				m.Name = name
+				return nil
+			}
+		}
+	}
+	logger.Warn("name used by another client_proxy handler, the admin API addresses the first",
+		zap.String("name", m.Name))
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper.
+func (m *Middleware) Cleanup() error {
+	m.mu.Lock()
+	m.stopping.Store(true)
+	h := m.handler.Swap(nil)
+	m.notifyRegistered()
+	m.mu.Unlock()
+	registry.remove(m)
+	var err error
+	if m.RegistrationListener != nil {
+		err = m.RegistrationListener.close()
+	}
+	// drain the client, waiting for in-flight requests to finish
+	if h != nil {
+		h.close(m.metrics.evictedShutdown)
+	}
+	grace := time.Duration(m.CleanupGrace)
+	if grace == 0 {
+		grace = shutdownTimeout
+	}
+	drained := make(chan struct{})
+	go func() {
+		m.tunnels.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+		m.logger.Warn("requests still in flight after cleanup_grace, closing clients",
+			zap.Duration("cleanup_grace", grace))
+		m.forceCancel()
+		<-drained
+	}
+	m.forceCancel()
+	return err
+}
+
 // Validate implements caddy.Validator.
 func (m *Middleware) Validate() error {
-	if m.Secret == "" {
+	var secrets int
+	for _, v := range []string{m.Secret, m.SecretHash, m.SecretFile} {
+		if v != "" {
+			secrets++
+		}
+	}
+	if secrets > 1 {
+		return fmt.Errorf("only one of secret, secret_hash and secret_file may be set")
+	}
+	if strings.ContainsAny(m.DefaultHost, "/ ") {
+		return fmt.Errorf("default_host must be a host, got %q", m.DefaultHost)
+	}
+	switch m.HostMismatchStatus {
+	case 0, http.StatusMisdirectedRequest, http.StatusBadGateway:
+	default:
+		return fmt.Errorf("host_mismatch_status must be 421 or 502, got %d", m.HostMismatchStatus)
+	}
+	if m.StreamResetStatus != 0 && (m.StreamResetStatus < 400 || m.StreamResetStatus > 599) {
+		return fmt.Errorf("stream_reset_status must be an error status, got %d", m.StreamResetStatus)
+	}
+	if m.RegistrationListener != nil {
+		if err := m.RegistrationListener.validate(); err != nil {
+			return err
+		}
+	}
+	if m.ConnectForwarding != nil {
+		if err := m.ConnectForwarding.validate(); err != nil {
+			return err
+		}
+	}
+	if m.OnNoClientWebhook != nil {
+		if err := m.OnNoClientWebhook.validate(); err != nil {
+			return err
+		}
+	}
+	if m.Spool != nil {
+		if err := m.Spool.validate(); err != nil {
+			return err
+		}
+	}
+	if m.IdempotencyCache != nil {
+		if err := m.IdempotencyCache.validate(); err != nil {
+			return err
+		}
+	}
+	if m.OfflineRedirect != nil {
+		if m.FallbackUpstream != "" {
+			return fmt.Errorf("only one of fallback_upstream and offline_redirect may be set")
+		}
+		if err := m.OfflineRedirect.validate(); err != nil {
+			return err
+		}
+	}
+	if m.FallbackUpstream != "" {
+		if err := validateFallbackUpstream(m.FallbackUpstream); err != nil {
+			return err
+		}
+	}
+	for _, tr := range m.Routes {
+		if err := tr.validate(); err != nil {
+			return err
+		}
+	}
+	if m.CleanupGrace < 0 {
+		return fmt.Errorf("cleanup_grace must not be negative, got %s", time.Duration(m.CleanupGrace))
+	}
+	switch m.ShutdownMode {
+	case "", "graceful", "immediate":
+	default:
+		return fmt.Errorf("shutdown_mode must be graceful or immediate, got %s", m.ShutdownMode)
+	}
+	if m.MaxClientsPerIP < 0 {
+		return fmt.Errorf("max_clients_per_ip must not be negative, got %d", m.MaxClientsPerIP)
+	}
+	if m.MaxResponseHeaderBytes < 0 || m.MaxResponseHeaderBytes > math.MaxUint32-1 {
+		return fmt.Errorf("max_response_header_bytes must be between 0 and 4GiB, got %d", m.MaxResponseHeaderBytes)
+	}
+	if m.HandshakeRetries < 0 {
+		return fmt.Errorf("handshake_retries must not be negative, got %d", m.HandshakeRetries)
+	}
+	if m.StatusPath != "" && !strings.HasPrefix(m.StatusPath, "/") {
+		return fmt.Errorf("status_path must start with /, got %q", m.StatusPath)
+	}
+	if _, err := parseStatusAllowedIPs(m.StatusAllowedIPs); err != nil {
+		return err
+	}
+	if m.MaxPendingRegistrations < 0 {
+		return fmt.Errorf("max_pending_registrations must not be negative, got %d", m.MaxPendingRegistrations)
+	}
+	if m.MaxClients < 0 {
+		return fmt.Errorf("max_clients must not be negative, got %d", m.MaxClients)
+	}
+	switch m.OnMaxClients {
+	case "", "evict", "reject":
+	default:
+		return fmt.Errorf("on_max_clients must be evict or reject, got %s", m.OnMaxClients)
+	}
+	if m.RehandshakeInterval < 0 {
+		return fmt.Errorf("rehandshake_interval must not be negative, got %s", time.Duration(m.RehandshakeInterval))
+	}
+	if m.FlushTimeout < 0 {
+		return fmt.Errorf("flush_timeout must not be negative, got %s", time.Duration(m.FlushTimeout))
+	}
+	switch m.OnDuplicateName {
+	case "", "warn", "reject", "suffix":
+	default:
+		return fmt.Errorf("on_duplicate_name must be warn, reject or suffix, got %s", m.OnDuplicateName)
+	}
+	if m.HandshakeTimeout < 0 {
+		return fmt.Errorf("handshake_timeout must not be negative, got %s", time.Duration(m.HandshakeTimeout))
+	}
+	if m.MaxInflight < 0 {
+		return fmt.Errorf("max_inflight must not be negative, got %d", m.MaxInflight)
+	}
+	if m.SignRequests != nil && m.SignRequests.Key == "" && m.Secret == "" && m.SecretFile == "" {
+		return fmt.Errorf("sign_requests requires a key without a secret or secret_file")
+	}
+	if m.SignRequests != nil {
+		if err := m.SignRequests.validate(); err != nil {
+			return err
+		}
+	}
+	if m.ReplaceResponse != nil {
+		if err := m.ReplaceResponse.validate(); err != nil {
+			return err
+		}
+	}
+	if m.Performance != nil {
+		if err := m.Performance.validate(); err != nil {
+			return err
+		}
+	}
+	if m.JWT != nil {
+		if err := m.JWT.validate(); err != nil {
+			return err
+		}
+	}
+	if m.StripPathPrefix != "" && !strings.HasPrefix(m.StripPathPrefix, "/") {
+		return fmt.Errorf("strip_path_prefix must start with /, got %s", m.StripPathPrefix)
+	}
+	if m.StripPathPrefixRequired && m.StripPathPrefix == "" {
+		return fmt.Errorf("strip_path_prefix_required requires strip_path_prefix")
+	}
+	if m.AddPathPrefix != "" && !strings.HasPrefix(m.AddPathPrefix, "/") {
+		return fmt.Errorf("add_path_prefix must start with /, got %s", m.AddPathPrefix)
+	}
+	for _, s := range m.CredentialSources {
+		switch s {
+		case "header", "bearer", "query":
+		default:
+			return fmt.Errorf("credential_sources must be header, bearer or query, got %s", s)
+		}
+	}
+	now := time.Now()
+	for _, c := range m.Secrets {
+		if err := c.validate(now); err != nil {
+			return err
+		}
+	}
+	if m.SecretHash != "" {
+		_, err := parseSecretHash(m.SecretHash)
+		return err
+	}
+	if m.Secret == "" && m.SecretFile == "" && m.JWT == nil && len(m.Secrets) == 0 {
 		return fmt.Errorf("no secret")
 	}
 	return nil
 }
 
-func (m *Middleware) acceptProxy(w http.ResponseWriter, r *http.Request) error {
+// acceptProxy registers the client making r, authenticated as id if it used
+// more than the secret. The claims of a registration token are trusted over
+// the headers.
+func (m *Middleware) acceptProxy(w http.ResponseWriter, r *http.Request, id *identity) error {
+	if r.ProtoMajor != 1 {
+		m.rejectHTTP2Registration(w, r)
+		return nil
+	}
+	if err := checkRegistrationHeaders(r); err != nil {
+		return err
+	}
+	if err := m.checkALPN(r); err != nil {
+		return err
+	}
+	body, err := m.readRegistrationBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	maxBody := m.MaxRequestBody
+	if v := r.Header.Get("X-Client-Proxy-Max-Body"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return caddyhttp.Error(http.StatusBadRequest,
+				fmt.Errorf("client_proxy: invalid X-Client-Proxy-Max-Body: %q", v))
+		}
+		if maxBody == 0 || n < maxBody {
+			maxBody = n
+		}
+	}
+
+	var maxInflight int64
+	if v := r.Header.Get("X-Client-Proxy-Max-Inflight"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return caddyhttp.Error(http.StatusBadRequest,
+				fmt.Errorf("client_proxy: invalid X-Client-Proxy-Max-Inflight: %q", v))
+		}
+		maxInflight = n
+	}
+
+	timeout := time.Duration(m.RequestTimeout)
+	if v := r.Header.Get("X-Client-Proxy-Request-Timeout"); v != "" && m.MaxRequestTimeout > 0 {
+		d, err := caddy.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return caddyhttp.Error(http.StatusBadRequest,
+				fmt.Errorf("client_proxy: invalid X-Client-Proxy-Request-Timeout: %q", v))
+		}
+		timeout = min(d, time.Duration(m.MaxRequestTimeout))
+	}
+
+	hosts := parseHosts(r.Header.Get("X-Client-Proxy-Hosts"))
+	if hosts == nil {
+		hosts = parseHosts(strings.Join(body.Hosts, ","))
+	}
+	if id == nil {
+		id = &identity{}
+	}
+	if id.token {
+		hosts = id.hosts
+	}
+	if len(m.AllowedHosts) > 0 {
+		for _, h := range hosts {
+			if !matchesAny(m.AllowedHosts, h) {
+				return caddyhttp.Error(http.StatusForbidden,
+					withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: host not allowed: %s", h)))
+			}
+		}
+	}
+	paths := parsePaths(r.Header.Get("X-Client-Proxy-Paths"))
+	if paths == nil {
+		paths = parsePaths(strings.Join(body.Paths, ","))
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return caddyhttp.Error(http.StatusBadRequest,
+				fmt.Errorf("client_proxy: invalid X-Client-Proxy-Paths, must start with /: %s", p))
+		}
+		if len(m.AllowedPaths) > 0 && !hasAnyPrefix(m.AllowedPaths, p) {
+			return caddyhttp.Error(http.StatusForbidden,
+				withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: path not allowed: %s", p)))
+		}
+	}
+
+	if m.OnAccept != nil {
+		if err := m.OnAccept(r); err != nil {
+			var herr caddyhttp.HandlerError
+			if errors.As(err, &herr) {
+				return err
+			}
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("client_proxy: %w: %w", ErrRegistrationRejected, err))
+		}
+	}
+
+	if err := m.checkClientsPerIP(r); err != nil {
+		return err
+	}
+	if err := m.checkMaxClients(); err != nil {
+		return err
+	}
+	if err := m.reservePending(); err != nil {
+		return err
+	}
+	defer m.pending.Add(-1)
+	if err := m.checkReconnectInterval(w); err != nil {
+		return err
+	}
+
 	rc := http.NewResponseController(w)
 	if err := rc.EnableFullDuplex(); err != nil {
-		return fmt.Errorf("client_proxy: must connect using HTTP/1.1: %w", err)
+		return fmt.Errorf("client_proxy: %w: %w", ErrNotHTTP1, err)
 	}
 	conn, buf, err := rc.Hijack()
 	if err != nil {
-		return fmt.Errorf("client_proxy: must connect using HTTP/1.1: %w", err)
+		return fmt.Errorf("client_proxy: %w: %w", ErrNotHTTP1, err)
+	}
+	// the server may have set deadlines for the registration request, which
+	// must not apply to the long lived tunnel, so only the handshake is
+	// limited, and unblocks a client that never responds
+	handshakeTimeout := time.Duration(m.HandshakeTimeout)
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+	handshakeDeadline := time.Now().Add(handshakeTimeout)
+	if err := conn.SetDeadline(handshakeDeadline); err != nil {
+		rejectHijacked(conn, "unable to set deadline")
+		return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: unable to set deadline: %w", err))
+	}
+	// a congested client may not read what was buffered, which must not hold
+	// the registration for the whole handshake
+	if flushTimeout := time.Duration(m.FlushTimeout); flushTimeout > 0 && flushTimeout < handshakeTimeout {
+		if err := conn.SetWriteDeadline(time.Now().Add(flushTimeout)); err != nil {
+			rejectHijacked(conn, "unable to set deadline")
+			return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: unable to set deadline: %w", err))
+		}
 	}
-	defer conn.Close() // backup close, normally h2conn.Shutdown will handle this
 	if err := buf.Flush(); err != nil {
-		return fmt.Errorf("client_proxy: unexpected flush error: %w", err)
+		rejectHijacked(conn, "unexpected flush error")
+		return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: unexpected flush error: %w", err))
+	}
+	if m.FlushTimeout > 0 {
+		if err := conn.SetWriteDeadline(handshakeDeadline); err != nil {
+			rejectHijacked(conn, "unable to set deadline")
+			return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: unable to set deadline: %w", err))
+		}
+	}
+	raw := conn
+	if err := m.Performance.setSocketBuffers(raw); err != nil {
+		// the defaults work, if not as well
+		m.logger.Warn("unable to set socket buffers",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Error(err))
+	}
+	if err := m.Performance.setNoDelay(raw); err != nil {
+		m.logger.Warn("unable to set tcp_nodelay",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Error(err))
+	}
+	if m.MaxBandwidthUp > 0 || m.MaxBandwidthDown > 0 {
+		conn = newThrottleConn(conn, m.MaxBandwidthUp, m.MaxBandwidthDown)
 	}
 	if buf.Reader.Buffered() > 0 {
 		conn = &bufConn{Conn: conn, Reader: buf.Reader}
 	}
-	h2conn, err := h2t.NewClientConn(conn)
-	if err != nil {
-		return fmt.Errorf("client_proxy: unable to create ClientConn: %w", err)
+	conn = m.Performance.wrap(conn)
+	var (
+		hc     *holdCloseConn
+		mc     *monitorConn
+		sc     *settingsConn
+		fc     *flowConn
+		h2conn *http2.ClientConn
+	)
+	backoff := handshakeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		// the ClientConn closes the connection when it fails to start, which
+		// must wait until the client is told why, or the start is retried
+		wc := &writeCountConn{Conn: conn}
+		hc = &holdCloseConn{Conn: wc, held: true}
+		mc = &monitorConn{Conn: hc, broken: make(chan struct{})}
+		sc = newSettingsConn(mc)
+		fc = newFlowConn(sc)
+		h2conn, err = m.h2t.NewClientConn(fc)
+		if err == nil {
+			break
+		}
+		// starting over is only safe if the client saw none of the preface
+		if attempt >= m.HandshakeRetries || wc.written.Load() > 0 || time.Now().Add(backoff).After(handshakeDeadline) {
+			rejectHijacked(raw, "unable to start HTTP/2")
+			return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: unable to create ClientConn: %w", err))
+		}
+		m.logger.Debug("retrying HTTP/2 handshake",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Int("attempt", attempt+1),
+			zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	hc.release()
+
+	h := &handler{
+		conn:        h2conn,
+		done:        make(chan struct{}),
+		remoteAddr:  r.RemoteAddr,
+		localAddr:   conn.LocalAddr().String(),
+		connectedAt: time.Now(),
+		sc:          sc,
+		flow:        fc,
+		maxBody:     maxBody,
+		maxInflight: maxInflight,
+		hosts:       hosts,
+		paths:       paths,
+		timeout:     timeout,
+		proxy:       m.newProxy(replacedTransport{m: m, conn: h2conn}, r.Host),
+		transport:   m.attemptTransport(replacedTransport{m: m, conn: h2conn}),
+		subject:     id.subject,
+		expires:     id.expires,
+		verbose:     m.verboseRequested(r),
+		metadata:    body.Metadata,
+	}
+	h.lastUsed.Store(h.connectedAt.UnixNano())
+	if m.EchoTag {
+		h.tag = r.Header.Get("X-Client-Proxy-Tag")
+	}
+	if h.tag != "" {
+		echoTag(h.proxy, h.tag)
+	}
+	if h.verbose {
+		m.logVerbose(h.proxy)
+	}
+	if err := awaitReady(r.Context(), h2conn, sc, mc, handshakeTimeout); err != nil {
+		h2conn.Close()
+		raw.Close()
+		m.logger.Debug("client handshake failed",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Error(err))
+		return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: client not ready: %w", err))
+	}
+	if err := raw.SetDeadline(time.Time{}); err != nil {
+		h2conn.Close()
+		raw.Close()
+		return withSentinel(ErrUpgradeFailed, fmt.Errorf("client_proxy: unable to clear deadline: %w", err))
 	}
 
+	m.mu.Lock()
+	if m.stopping.Load() {
+		m.mu.Unlock()
+		raw.Close()
+		return fmt.Errorf("client_proxy: %w", ErrShuttingDown)
+	}
+	m.tunnels.Add(1)
+	old := m.handler.Swap(h)
+	m.lastRegistration = time.Now()
+	m.notifyRegistered()
+	m.mu.Unlock()
+	m.metrics.registrations.Inc()
+	m.metrics.connected.Inc()
 	// close the old one, if one is there
-	if handler, ok := m.handler.Load().(*handler); ok {
-		close(handler.done)
-	}
-
-	done := make(chan struct{})
-	m.handler.Store(&handler{
-		done: done,
-		proxy: &httputil.ReverseProxy{
-			Transport: h2conn,
-			Director: func(r *http.Request) {
-				// TODO: what
-				r.URL.Scheme = "https"
-			},
-		},
-	})
-	<-done // wait until we're being replaced
-	ctx, cancel := context.WithTimeout(r.Context(), shutdownTimeout)
+	if old != nil {
+		old.close(m.metrics.evictedReplaced)
+	} else {
+		m.evictLeastRecentlyUsed()
+	}
+	go m.monitor(h, mc)
+	go m.serveTunnel(h, raw)
+	if m.spooler != nil {
+		go m.replaySpool(h)
+	}
+
+	// the request is done once the client is registered, and the tunnel is
+	// owned by serveTunnel
+	m.logger.Info("client registered",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("subject", id.subject),
+		zap.Strings("hosts", hosts),
+		zap.Any("settings", sc.settings))
+	return nil
+}
+
+// awaitReady waits up to timeout for the client to send its SETTINGS and
+// answer a PING, so it only serves requests once the connection is known to
+// work.
+func awaitReady(ctx context.Context, conn *http2.ClientConn, sc *settingsConn, mc *monitorConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	if err := h2conn.Shutdown(ctx); err != nil {
-		if errors.Is(err, net.ErrClosed) {
-			return nil
+	select {
+	case <-sc.ready:
+	case <-mc.broken:
+		return errors.New("connection closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return conn.Ping(ctx)
+}
+
+// rejectHTTP2Registration tells a client that registered over HTTP/2, for
+// example because ALPN negotiated h2, to use HTTP/1.1, and where to if a
+// registration_address is configured. The response is written directly, as
+// the message is meant for whoever runs the client.
+func (m *Middleware) rejectHTTP2Registration(w http.ResponseWriter, r *http.Request) {
+	msg := fmt.Sprintf("client_proxy: registration requires HTTP/1.1, got %s; "+
+		"configure the client to not negotiate h2 using ALPN", r.Proto)
+	if m.RegistrationAddress != "" {
+		msg += ", or register at " + m.RegistrationAddress
+		w.Header().Set("X-Client-Proxy-Registration-Address", m.RegistrationAddress)
+	}
+	m.logger.Debug("registration over HTTP/2 rejected",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("proto", r.Proto))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusHTTPVersionNotSupported)
+	fmt.Fprintln(w, msg)
+}
+
+// rejectHijacked responds with a 500 and closes conn, for failures after the
+// registration request was hijacked, so the client learns why instead of
+// seeing only a dropped connection. A short write deadline keeps a dead peer
+// from blocking.
+func rejectHijacked(conn net.Conn, reason string) {
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(hijackedErrorTimeout))
+	body := "client_proxy: " + reason + "\n"
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 500 Internal Server Error\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s", len(body), body)
+}
+
+// serveTunnel owns the connection of h, shutting it down once h is replaced
+// or the client goes away.
+func (m *Middleware) serveTunnel(h *handler, conn net.Conn) {
+	defer m.tunnels.Done()
+	defer conn.Close() // backup close, normally h.conn.Shutdown will handle this
+	<-h.done
+	m.metrics.connected.Dec()
+	if m.ShutdownMode == "immediate" {
+		if err := h.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			m.logger.Debug("error closing ClientConn",
+				zap.String("remote_addr", h.remoteAddr),
+				zap.Error(err))
 		}
-		return fmt.Errorf("client_proxy: error shutting down ClientConn: %w", err)
+		return
 	}
-	return nil
+	ctx, cancel := context.WithTimeout(m.forceClose, shutdownTimeout)
+	defer cancel()
+	err := h.conn.Shutdown(ctx)
+	switch {
+	case errors.Is(err, context.Canceled):
+		m.logger.Warn("closing client with requests in flight",
+			zap.String("remote_addr", h.remoteAddr))
+	case err != nil && !errors.Is(err, net.ErrClosed):
+		m.logger.Debug("error shutting down ClientConn",
+			zap.String("remote_addr", h.remoteAddr),
+			zap.Error(err))
+	}
+}
+
+// newProxy returns the ReverseProxy that forwards requests over transport, to
+// a client that registered at host.
+func (m *Middleware) newProxy(transport http.RoundTripper, host string) *httputil.ReverseProxy {
+	var modifiers []func(*http.Response) error
+	transport = m.attemptTransport(transport)
+	if m.TryDuration > 0 {
+		transport = retryTransport{m: m, transport: transport}
+	}
+	if m.ServerTiming {
+		transport = timingTransport{transport}
+		modifiers = append(modifiers, addServerTiming)
+	}
+	if m.CORS != nil {
+		modifiers = append(modifiers, m.CORS.modifyResponse)
+	}
+	if len(m.RewriteRedirects) > 0 {
+		modifiers = append(modifiers, m.rewriteRedirects)
+	}
+	if m.MaxStreamMemory > 0 {
+		modifiers = append(modifiers, m.trackStreamMemory)
+	}
+	// after max_stream_memory, which counts the length sent by the client
+	if m.ReplaceResponse != nil {
+		modifiers = append(modifiers, m.replaceResponse)
+	}
+	// before finalize_missing_trailers, which hides the reset
+	modifiers = append(modifiers, m.countStreamResets, closeHTTP10, stripHeadBody)
+	if m.FinalizeMissingTrailers {
+		modifiers = append(modifiers, m.finalizeMissingTrailers)
+	}
+	if m.AbortUploadOnResponse {
+		modifiers = append(modifiers, abortUpload)
+	}
+	// last, to log the final response headers
+	if m.DebugHeaders != nil {
+		modifiers = append(modifiers, m.logResponse)
+	}
+	return &httputil.ReverseProxy{
+		Transport:      transport,
+		Director:       func(r *http.Request) { m.director(r, host) },
+		ModifyResponse: chainModifiers(modifiers),
+		ErrorHandler:   m.proxyError,
+	}
+}
+
+// director prepares requests to be forwarded to the client, which registered
+// at host.
+func (m *Middleware) director(r *http.Request, host string) {
+	// TODO: what
+	r.URL.Scheme = "https"
+	// ReverseProxy re-encodes the query if the form was parsed, which must
+	// reach the client as it was received
+	r.Form = nil
+	if m.PreserveRequestURI {
+		preserveRequestURI(r)
+	} else if r.URL.RawPath != "" {
+		r.URL.RawPath = escapedPath(r.URL)
+	}
+	m.stripPrefix(r.URL)
+	m.addPrefix(r.URL)
+	if m.PreserveHost != nil && !*m.PreserveHost {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		r.Host = host
+	}
+	if m.TLSHeaders != nil {
+		m.TLSHeaders.set(r)
+	}
+	if m.ForwardSNIHeader != "" {
+		setSNIHeader(r, m.ForwardSNIHeader)
+	}
+	if m.SignRequests != nil {
+		m.signRequest(r, time.Now())
+	}
+	// last, to log the final request headers
+	if m.DebugHeaders != nil {
+		m.logRequest(r)
+	}
+}
+
+// chainModifiers returns a ModifyResponse function calling each of modifiers,
+// or nil if there are none.
+func chainModifiers(modifiers []func(*http.Response) error) func(*http.Response) error {
+	if len(modifiers) == 0 {
+		return nil
+	}
+	return func(res *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// proxyError responds to a request that could not be forwarded to the client.
+// Responses from the client, including errors, never reach it: only failures
+// to get a response do, so a 503 from the client is not a 502 here.
+func (m *Middleware) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) && errors.Is(r.Context().Err(), context.Canceled) {
+		// the visitor went away, and the client was told by the cancellation
+		m.logger.Debug("request canceled by visitor", zap.String("uri", r.RequestURI))
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	status := http.StatusBadGateway
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	case isResponseHeaderTooLarge(err):
+		// rejected by the transport, rather than reset by the client
+		m.logger.Warn("response headers from client exceed max_response_header_bytes",
+			zap.String("uri", r.RequestURI))
+	case isStreamReset(err):
+		m.streamReset(r, err)
+		if m.StreamResetStatus != 0 {
+			status = m.StreamResetStatus
+		}
+	}
+	m.counters.failures.Add(1)
+	m.logger.Debug("proxy error", zap.String("uri", r.RequestURI), zap.Error(err))
+	w.WriteHeader(status)
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if r.Header.Get("X-Client-Proxy") == m.Secret {
-		return m.acceptProxy(w, r)
+	if err := m.checkStopping(w); err != nil {
+		return err
+	}
+	r = m.scrubQueryCredential(r)
+	if m.StatusPath != "" && r.URL.Path == m.StatusPath {
+		return m.serveStatus(w, r)
 	}
-	if handler, ok := m.handler.Load().(*handler); ok {
+	if m.RegistrationListener == nil {
+		if id, ok, err := m.authenticate(r); ok {
+			if err != nil {
+				return err
+			}
+			return m.acceptProxy(w, r, id)
+		}
+	} else {
+		// registrations are only accepted on the listener, so the secret a
+		// client sent here must not be forwarded
+		r.Header.Del("X-Client-Proxy")
+	}
+	if m.isConnect(r) {
+		return m.serveConnect(w, r)
+	}
+	target, err := m.route(r)
+	if err != nil {
+		return err
+	}
+	return target.forward(w, r, next)
+}
+
+// forward sends r to the connected client, or handles it without one.
+func (m *Middleware) forward(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// before matching the hosts the client claimed
+	if r.Host == "" && m.DefaultHost != "" {
+		r.Host = m.DefaultHost
+	}
+	handler := m.handler.Load()
+	if handler == nil {
+		m.callNoClientWebhook(r)
+		if m.WaitForClient > 0 {
+			handler = m.waitForClient(r.Context(), time.Duration(m.WaitForClient))
+		}
+	}
+	if handler != nil && handler.serves(r) {
+		if m.CORS != nil && isPreflight(r) {
+			m.CORS.servePreflight(w, r)
+			return nil
+		}
+		if err := m.checkMethod(w, r); err != nil {
+			return err
+		}
+		if r.Host == "" {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: request has no Host"))
+		}
+		if err := m.checkRequiredHeaders(r); err != nil {
+			return err
+		}
+		if err := m.checkHeaderLimits(r); err != nil {
+			return err
+		}
+		if err := m.sanitizePath(r); err != nil {
+			return err
+		}
+		if err := m.checkStripPrefix(r); err != nil {
+			return err
+		}
+		if err := m.checkStreamMemory(); err != nil {
+			return err
+		}
+		live, err := m.liveHandler(handler, r)
+		if err != nil {
+			return err
+		}
+		handler = live
+		if limit := m.inflightLimit(handler); !handler.acquire(limit) {
+			return caddyhttp.Error(http.StatusServiceUnavailable,
+				fmt.Errorf("client_proxy: client has its max_inflight of %d requests", limit))
+		}
+		defer handler.release()
+		if handler.maxBody > 0 {
+			if r.ContentLength > handler.maxBody {
+				return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+					fmt.Errorf("client_proxy: request body of %d bytes exceeds limit of %d", r.ContentLength, handler.maxBody))
+			}
+			if r.ContentLength < 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, handler.maxBody)
+			}
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			// keep streaming the request body while the response is written,
+			// which HTTP/1 servers do not do by default
+			if r.ProtoMajor == 1 {
+				_ = http.NewResponseController(w).EnableFullDuplex()
+			}
+			if m.AbortUploadOnResponse {
+				r.Body = &uploadBody{ReadCloser: r.Body}
+			}
+		}
+		m.setVars(r, handler)
+		handler.requests.Add(1)
+		handler.lastUsed.Store(time.Now().UnixNano())
+		m.counters.requests.Add(1)
+		m.metrics.requests.Inc()
+		if handler.timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), handler.timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if m.ServerTiming {
+			r = r.WithContext(context.WithValue(r.Context(), timingKey{}, &timing{start: time.Now()}))
+		}
+		if m.TryDuration > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), handlerKey{}, handler))
+		}
+		visitor := r.Context()
+		ctx, cancel := context.WithCancel(visitor)
+		defer cancel()
+		r = r.WithContext(ctx)
+		aw := &abortWriter{ResponseWriter: w, m: m, visitor: visitor, cancel: cancel}
+		w = aw
+		defer m.countClientCanceled(aw)
+		defer m.recoverProxy(aw, r)
+		if m.idempotency != nil && r.Header.Get("Idempotency-Key") != "" {
+			m.idempotency.serve(w, r, handler.proxy)
+			return nil
+		}
+		if m.coalescer != nil {
+			m.coalescer.serve(w, r, handler.proxy)
+			return nil
+		}
 		handler.proxy.ServeHTTP(w, r)
 		return nil
+	} else if handler == nil && m.spooler != nil && m.Spool.matches(r) {
+		return m.spool(w, r)
+	} else if handler == nil && m.fallback != nil {
+		m.countFallback(r, "upstream")
+		m.fallback.ServeHTTP(w, r)
+		return nil
+	} else if handler == nil && m.OfflineRedirect != nil {
+		m.countFallback(r, "redirect")
+		m.OfflineRedirect.serve(w, r)
+		return nil
+	} else if handler != nil && m.HostMismatchStatus != 0 && !handler.servesHost(r) {
+		return caddyhttp.Error(m.HostMismatchStatus,
+			fmt.Errorf("client_proxy: client does not serve host: %s", r.Host))
+	}
+	if handler == nil {
+		m.countFallback(r, "next")
 	}
 	return next.ServeHTTP(w, r)
 }
 
+// liveHandler returns h, or the client that replaced it if h was closed since
+// it was loaded, as happens when clients register and are evicted in quick
+// succession. Handlers are removed before being closed, so the one loaded
+// again is only closed if it was also replaced. A client whose connection is
+// closing, as it is once the client sent a GOAWAY, is evicted right away
+// rather than once the monitor notices.
+func (m *Middleware) liveHandler(h *handler, r *http.Request) (*handler, error) {
+	for {
+		if !h.closed() && isClosing(h.conn) {
+			m.handler.CompareAndSwap(h, nil)
+			h.close(m.metrics.evictedError)
+		}
+		if !h.closed() {
+			return h, nil
+		}
+		next := m.handler.Load()
+		if next == nil || next == h || !next.serves(r) {
+			return nil, caddyhttp.Error(http.StatusServiceUnavailable,
+				withSentinel(ErrNoClient, fmt.Errorf("client_proxy: client disconnected")))
+		}
+		h = next
+	}
+}
+
+// inflightLimit returns the smaller of the max_inflight of the handler, which
+// may be changed using the admin API, and the one declared by the client of
+// h, where 0 is no limit.
+func (m *Middleware) inflightLimit(h *handler) int64 {
+	limit := m.maxInflight.Load()
+	if limit == 0 || h.maxInflight > 0 && h.maxInflight < limit {
+		limit = h.maxInflight
+	}
+	return limit
+}
+
+// setVars records the client serving r in the vars of the request, for the
+// handlers, matchers and logs around this one.
+func (m *Middleware) setVars(r *http.Request, h *handler) {
+	ctx := r.Context()
+	caddyhttp.SetVar(ctx, "client_proxy.selected", m.instanceLabel())
+	caddyhttp.SetVar(ctx, "client_proxy.client_addr", h.remoteAddr)
+	if h.subject != "" {
+		caddyhttp.SetVar(ctx, "client_proxy.subject", h.subject)
+	}
+	for k, v := range h.metadata {
+		caddyhttp.SetVar(ctx, "client_proxy.metadata."+k, v)
+	}
+}
+
+// checkStopping rejects requests once shutting down, if configured to.
+func (m *Middleware) checkStopping(w http.ResponseWriter) error {
+	if !m.RejectOnShutdown || !m.stopping.Load() {
+		return nil
+	}
+	w.Header().Set("Connection", "close")
+	return caddyhttp.Error(http.StatusServiceUnavailable,
+		fmt.Errorf("client_proxy: %w", ErrShuttingDown))
+}
+
+// checkALPN rejects a registration whose TLS connection did not negotiate one
+// of allowed_alpn, to catch clients speaking an unexpected protocol before
+// the tunnel starts.
+func (m *Middleware) checkALPN(r *http.Request) error {
+	if len(m.AllowedALPN) == 0 {
+		return nil
+	}
+	if r.TLS == nil {
+		return caddyhttp.Error(http.StatusBadRequest,
+			withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: registration must use TLS negotiating one of %s",
+				strings.Join(m.AllowedALPN, ", "))))
+	}
+	if !slices.Contains(m.AllowedALPN, r.TLS.NegotiatedProtocol) {
+		return caddyhttp.Error(http.StatusBadRequest,
+			withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: registration negotiated ALPN %q, expected one of %s",
+				r.TLS.NegotiatedProtocol, strings.Join(m.AllowedALPN, ", "))))
+	}
+	return nil
+}
+
+// checkClientsPerIP rejects a registration from an IP address with
+// max_clients_per_ip clients connected to the other handlers.
+func (m *Middleware) checkClientsPerIP(r *http.Request) error {
+	if m.MaxClientsPerIP <= 0 {
+		return nil
+	}
+	ip := requestHost(r.RemoteAddr)
+	var n int
+	for _, o := range registry.all() {
+		if h := o.handler.Load(); o != m && h != nil && requestHost(h.remoteAddr) == ip {
+			n++
+		}
+	}
+	if n >= m.MaxClientsPerIP {
+		return caddyhttp.Error(http.StatusTooManyRequests,
+			withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: %s already has %d clients connected", ip, n)))
+	}
+	return nil
+}
+
+// connectedClients returns the clients connected to the handlers other than
+// m.
+func (m *Middleware) connectedClients() map[*handler]*Middleware {
+	clients := make(map[*handler]*Middleware)
+	for _, o := range registry.all() {
+		if h := o.handler.Load(); o != m && h != nil {
+			clients[h] = o
+		}
+	}
+	return clients
+}
+
+// checkMaxClients rejects a registration with max_clients clients connected
+// to the other handlers, unless they are to be evicted instead.
+func (m *Middleware) checkMaxClients() error {
+	if m.MaxClients <= 0 || m.OnMaxClients != "reject" {
+		return nil
+	}
+	if n := len(m.connectedClients()); n >= m.MaxClients {
+		return caddyhttp.Error(http.StatusTooManyRequests,
+			withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: max_clients of %d reached", n)))
+	}
+	return nil
+}
+
+// evictLeastRecentlyUsed disconnects the clients of the other handlers that
+// were used least recently, until at most max_clients are connected
+// including the newly registered client of m.
+func (m *Middleware) evictLeastRecentlyUsed() {
+	if m.MaxClients <= 0 || m.OnMaxClients == "reject" {
+		return
+	}
+	clients := m.connectedClients()
+	for len(clients) >= m.MaxClients {
+		var lru *handler
+		for h := range clients {
+			if lru == nil || h.lastUsed.Load() < lru.lastUsed.Load() {
+				lru = h
+			}
+		}
+		o := clients[lru]
+		delete(clients, lru)
+		// it may have been replaced or gone away meanwhile
+		if !o.handler.CompareAndSwap(lru, nil) {
+			continue
+		}
+		lru.close(o.metrics.evictedMaxClients)
+		m.logger.Info("max_clients reached, evicted least recently used client",
+			zap.String("name", o.Name),
+			zap.String("remote_addr", lru.remoteAddr),
+			zap.Time("last_used", time.Unix(0, lru.lastUsed.Load())))
+	}
+}
+
+// reservePending reserves one of the max_pending_registrations for a
+// registration until it returns, rejecting it if none is left. A reservation
+// is made even without a limit, and must be released.
+func (m *Middleware) reservePending() error {
+	n := m.pending.Add(1)
+	if m.MaxPendingRegistrations > 0 && n > int64(m.MaxPendingRegistrations) {
+		m.pending.Add(-1)
+		return caddyhttp.Error(http.StatusServiceUnavailable,
+			withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: max_pending_registrations of %d reached", m.MaxPendingRegistrations)))
+	}
+	return nil
+}
+
+// checkReconnectInterval rejects a registration within the
+// min_reconnect_interval of the previous successful one, which is recorded
+// once the client is swapped in, so a failed handshake can be retried.
+func (m *Middleware) checkReconnectInterval(w http.ResponseWriter) error {
+	if m.MinReconnectInterval <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if wait := time.Until(m.lastRegistration.Add(time.Duration(m.MinReconnectInterval))); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		return caddyhttp.Error(http.StatusTooManyRequests,
+			withSentinel(ErrRegistrationRejected, fmt.Errorf("client_proxy: registration within min_reconnect_interval, retry in %v", wait)))
+	}
+	return nil
+}
+
+// checkMethod rejects requests whose method is not allowed, or denied. The
+// Allow header lists the allowed methods, if any.
+func (m *Middleware) checkMethod(w http.ResponseWriter, r *http.Request) error {
+	if (len(m.AllowedMethods) == 0 || slices.Contains(m.AllowedMethods, r.Method)) &&
+		!slices.Contains(m.DeniedMethods, r.Method) {
+		return nil
+	}
+	if len(m.AllowedMethods) > 0 {
+		allowed := slices.DeleteFunc(slices.Clone(m.AllowedMethods), func(method string) bool {
+			return slices.Contains(m.DeniedMethods, method)
+		})
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	return caddyhttp.Error(http.StatusMethodNotAllowed,
+		fmt.Errorf("client_proxy: method not allowed: %s", r.Method))
+}
+
+// checkRequiredHeaders returns an error if r is missing a required header.
+func (m *Middleware) checkRequiredHeaders(r *http.Request) error {
+	for name, want := range m.RequireHeaders {
+		values := r.Header.Values(name)
+		if len(values) > 0 && (len(want) == 0 || slices.ContainsFunc(values, func(v string) bool {
+			return slices.Contains(want, v)
+		})) {
+			continue
+		}
+		status := http.StatusBadRequest
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			status = http.StatusUnauthorized
+		}
+		return caddyhttp.Error(status, fmt.Errorf("client_proxy: missing required header %s", name))
+	}
+	return nil
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume directive name
 
-	// require an argument
-	if !d.NextArg() {
+	// the secret is optional when secret_hash, secret_file, secrets or jwt is
+	// used
+	if d.NextArg() {
+		m.Secret = d.Val()
+	}
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if err := m.unmarshalOptions(d); err != nil {
+		return err
+	}
+	if m.Secret == "" && m.SecretHash == "" && m.SecretFile == "" && m.JWT == nil && len(m.Secrets) == 0 {
 		return d.ArgErr()
 	}
+	return nil
+}
 
-	// store the argument
-	m.Secret = d.Val()
+// unmarshalOptions unmarshals the block of options.
+func (m *Middleware) unmarshalOptions(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "secret_hash", "secret_file":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if name == "secret_hash" {
+				m.SecretHash = d.Val()
+			} else {
+				m.SecretFile = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for name == "secret_file" && d.NextBlock(1) {
+				switch d.Val() {
+				case "reload_interval":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid reload_interval %s: %v", d.Val(), err)
+					}
+					m.SecretFileInterval = caddy.Duration(dur)
+				default:
+					return d.Errf("unrecognized secret_file subdirective %s", d.Val())
+				}
+			}
+		case "registration_listener":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l := &RegistrationListener{Address: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "tls":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
+						return d.ArgErr()
+					}
+					l.CertFile, l.KeyFile = args[0], args[1]
+				case "tls_domains":
+					l.TLSDomains = d.RemainingArgs()
+					if len(l.TLSDomains) == 0 {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unrecognized registration_listener subdirective %s", d.Val())
+				}
+			}
+			m.RegistrationListener = l
+		case "registration_address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RegistrationAddress = d.Val()
+		case "name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Name = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "on_duplicate_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnDuplicateName = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "instance_label":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.InstanceLabel = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "require_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if m.RequireHeaders == nil {
+				m.RequireHeaders = make(http.Header)
+			}
+			name := http.CanonicalHeaderKey(d.Val())
+			m.RequireHeaders[name] = append(m.RequireHeaders[name], d.RemainingArgs()...)
+		case "max_request_body", "max_stream_memory", "max_request_header_size", "max_response_header_bytes":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+			}
+			switch name {
+			case "max_request_body":
+				m.MaxRequestBody = int64(size)
+			case "max_stream_memory":
+				m.MaxStreamMemory = int64(size)
+			case "max_response_header_bytes":
+				m.MaxResponseHeaderBytes = int64(size)
+			default:
+				m.MaxRequestHeaderSize = int64(size)
+			}
+		case "max_request_header_count":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return d.Errf("invalid max_request_header_count %s", d.Val())
+			}
+			m.MaxRequestHeaderCount = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_clients_per_ip":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return d.Errf("invalid max_clients_per_ip %s", d.Val())
+			}
+			m.MaxClientsPerIP = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "handshake_retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 0 {
+				return d.Errf("invalid handshake_retries %s", d.Val())
+			}
+			m.HandshakeRetries = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_pending_registrations":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return d.Errf("invalid max_pending_registrations %s", d.Val())
+			}
+			m.MaxPendingRegistrations = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_clients":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return d.Errf("invalid max_clients %s", d.Val())
+			}
+			m.MaxClients = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "on_max_clients":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnMaxClients = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_inflight":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil || n <= 0 {
+				return d.Errf("invalid max_inflight %s", d.Val())
+			}
+			m.MaxInflight = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "allowed_hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return d.ArgErr()
+			}
+			for _, h := range hosts {
+				m.AllowedHosts = append(m.AllowedHosts, strings.ToLower(h))
+			}
+		case "allowed_paths":
+			paths := d.RemainingArgs()
+			if len(paths) == 0 {
+				return d.ArgErr()
+			}
+			m.AllowedPaths = append(m.AllowedPaths, paths...)
+		case "allowed_alpn":
+			protos := d.RemainingArgs()
+			if len(protos) == 0 {
+				return d.ArgErr()
+			}
+			m.AllowedALPN = append(m.AllowedALPN, protos...)
+		case "allowed_methods", "denied_methods":
+			name := d.Val()
+			methods := d.RemainingArgs()
+			if len(methods) == 0 {
+				return d.ArgErr()
+			}
+			for _, method := range methods {
+				if name == "allowed_methods" {
+					m.AllowedMethods = append(m.AllowedMethods, strings.ToUpper(method))
+				} else {
+					m.DeniedMethods = append(m.DeniedMethods, strings.ToUpper(method))
+				}
+			}
+		case "retry_methods":
+			methods := d.RemainingArgs()
+			if len(methods) == 0 {
+				return d.ArgErr()
+			}
+			for _, method := range methods {
+				m.RetryMethods = append(m.RetryMethods, strings.ToUpper(method))
+			}
+		case "retry_idempotency_key":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RetryIdempotencyKey = true
+		case "retry_idempotent":
+			v := true
+			if d.NextArg() {
+				var err error
+				if v, err = strconv.ParseBool(d.Val()); err != nil {
+					return d.Errf("invalid retry_idempotent value %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			m.RetryIdempotent = &v
+		case "host_mismatch_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid host_mismatch_status %s: %v", d.Val(), err)
+			}
+			m.HostMismatchStatus = status
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "request_timeout", "max_request_timeout", "response_header_timeout", "try_duration", "try_interval", "min_reconnect_interval", "handshake_timeout", "cleanup_grace", "flush_timeout", "rehandshake_interval", "wait_for_client":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+			}
+			switch name {
+			case "request_timeout":
+				m.RequestTimeout = caddy.Duration(dur)
+			case "max_request_timeout":
+				m.MaxRequestTimeout = caddy.Duration(dur)
+			case "response_header_timeout":
+				m.ResponseHeaderTimeout = caddy.Duration(dur)
+			case "try_duration":
+				m.TryDuration = caddy.Duration(dur)
+			case "try_interval":
+				m.TryInterval = caddy.Duration(dur)
+			case "min_reconnect_interval":
+				m.MinReconnectInterval = caddy.Duration(dur)
+			case "handshake_timeout":
+				m.HandshakeTimeout = caddy.Duration(dur)
+			case "cleanup_grace":
+				m.CleanupGrace = caddy.Duration(dur)
+			case "flush_timeout":
+				m.FlushTimeout = caddy.Duration(dur)
+			case "rehandshake_interval":
+				m.RehandshakeInterval = caddy.Duration(dur)
+			case "wait_for_client":
+				m.WaitForClient = caddy.Duration(dur)
+			}
+		case "max_bandwidth_up", "max_bandwidth_down":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+			}
+			if name == "max_bandwidth_up" {
+				m.MaxBandwidthUp = int64(size)
+			} else {
+				m.MaxBandwidthDown = int64(size)
+			}
+		case "debug_headers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DebugHeaders = new(DebugHeaders)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "redact":
+					m.DebugHeaders.Redact = append(m.DebugHeaders.Redact, d.RemainingArgs()...)
+				case "max_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_size %s: %v", d.Val(), err)
+					}
+					m.DebugHeaders.MaxSize = int(size)
+				default:
+					return d.Errf("unrecognized debug_headers subdirective %s", d.Val())
+				}
+			}
+		case "debug_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DebugToken = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "rewrite_redirects":
+			authorities := d.RemainingArgs()
+			if len(authorities) == 0 {
+				return d.ArgErr()
+			}
+			m.RewriteRedirects = append(m.RewriteRedirects, authorities...)
+		case "cors":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CORS = new(CORS)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "allowed_origins":
+					m.CORS.AllowedOrigins = append(m.CORS.AllowedOrigins, d.RemainingArgs()...)
+				case "allowed_methods":
+					m.CORS.AllowedMethods = append(m.CORS.AllowedMethods, d.RemainingArgs()...)
+				case "allowed_headers":
+					m.CORS.AllowedHeaders = append(m.CORS.AllowedHeaders, d.RemainingArgs()...)
+				case "allow_credentials":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.CORS.AllowCredentials = true
+				case "max_age":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_age %s: %v", d.Val(), err)
+					}
+					m.CORS.MaxAge = caddy.Duration(dur)
+				default:
+					return d.Errf("unrecognized cors subdirective %s", d.Val())
+				}
+			}
+		case "sign_requests":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SignRequests = new(SignRequests)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "key":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					m.SignRequests.Key = d.Val()
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "headers":
+					headers := d.RemainingArgs()
+					if len(headers) == 0 {
+						return d.ArgErr()
+					}
+					m.SignRequests.Headers = append(m.SignRequests.Headers, headers...)
+				default:
+					return d.Errf("unrecognized sign_requests subdirective %s", d.Val())
+				}
+			}
+		case "replace_response":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ReplaceResponse = new(ReplaceResponse)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "replace":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
+						return d.ArgErr()
+					}
+					m.ReplaceResponse.Replace = append(m.ReplaceResponse.Replace,
+						&Replacement{Search: args[0], Replace: args[1]})
+				case "max_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_size %s: %v", d.Val(), err)
+					}
+					m.ReplaceResponse.MaxSize = int64(size)
+				default:
+					return d.Errf("unrecognized replace_response subdirective %s", d.Val())
+				}
+			}
+		case "tls_headers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.TLSHeaders = new(TLSHeaders)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				var name *string
+				switch d.Val() {
+				case "version":
+					name = &m.TLSHeaders.Version
+				case "cipher":
+					name = &m.TLSHeaders.Cipher
+				case "server_name":
+					name = &m.TLSHeaders.ServerName
+				case "resumed":
+					name = &m.TLSHeaders.Resumed
+				default:
+					return d.Errf("unrecognized tls_headers subdirective %s", d.Val())
+				}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				*name = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+		case "finalize_missing_trailers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.FinalizeMissingTrailers = true
+		case "abort_upload_on_response":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.AbortUploadOnResponse = true
+		case "stream_reset_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid stream_reset_status %s: %v", d.Val(), err)
+			}
+			m.StreamResetStatus = status
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "reject_on_shutdown":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RejectOnShutdown = true
+		case "shutdown_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ShutdownMode = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "strip_path_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.StripPathPrefix = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "strip_path_prefix_required":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.StripPathPrefixRequired = true
+		case "add_path_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.AddPathPrefix = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "preserve_host":
+			v := true
+			if d.NextArg() {
+				var err error
+				if v, err = strconv.ParseBool(d.Val()); err != nil {
+					return d.Errf("invalid preserve_host value %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			m.PreserveHost = &v
+		case "default_host":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DefaultHost = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "preserve_request_uri":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.PreserveRequestURI = true
+		case "sanitize_path":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SanitizePath = true
+		case "self_test_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SelfTestPath = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "status_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.StatusPath = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "status_allowed_ips":
+			ips := d.RemainingArgs()
+			if len(ips) == 0 {
+				return d.ArgErr()
+			}
+			m.StatusAllowedIPs = append(m.StatusAllowedIPs, ips...)
+		case "forward_sni_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ForwardSNIHeader = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "registration_body":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RegistrationBody = true
+		case "echo_tag":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.EchoTag = true
+		case "server_timing":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ServerTiming = true
+		case "expvar":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Expvar = true
+		case "coalesce_requests":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CoalesceRequests = new(Coalesce)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "headers":
+					m.CoalesceRequests.Headers = append(m.CoalesceRequests.Headers, d.RemainingArgs()...)
+				case "max_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_size %s: %v", d.Val(), err)
+					}
+					m.CoalesceRequests.MaxSize = int64(size)
+				default:
+					return d.Errf("unrecognized coalesce_requests subdirective %s", d.Val())
+				}
+			}
+		case "idempotency_cache":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.IdempotencyCache = new(Idempotency)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "ttl":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid ttl %s: %v", d.Val(), err)
+					}
+					m.IdempotencyCache.TTL = caddy.Duration(dur)
+				case "max_entries":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_entries %s: %v", d.Val(), err)
+					}
+					m.IdempotencyCache.MaxEntries = n
+				case "max_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_size %s: %v", d.Val(), err)
+					}
+					m.IdempotencyCache.MaxSize = int64(size)
+				case "headers":
+					m.IdempotencyCache.Headers = append(m.IdempotencyCache.Headers, d.RemainingArgs()...)
+				default:
+					return d.Errf("unrecognized idempotency_cache subdirective %s", d.Val())
+				}
+			}
+		case "on_no_client_webhook":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OnNoClientWebhook = &NoClientWebhook{URL: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "interval", "timeout":
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+					}
+					if name == "interval" {
+						m.OnNoClientWebhook.Interval = caddy.Duration(dur)
+					} else {
+						m.OnNoClientWebhook.Timeout = caddy.Duration(dur)
+					}
+				default:
+					return d.Errf("unrecognized on_no_client_webhook subdirective %s", d.Val())
+				}
+			}
+		case "fallback_upstream":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.FallbackUpstream = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "offline_redirect":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OfflineRedirect = &OfflineRedirect{URL: d.Val()}
+			if d.NextArg() {
+				status, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid offline_redirect status %s", d.Val())
+				}
+				m.OfflineRedirect.Status = status
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "preserve_path":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.OfflineRedirect.PreservePath = true
+				default:
+					return d.Errf("unrecognized offline_redirect subdirective %s", d.Val())
+				}
+			}
+		case "route":
+			tr, err := unmarshalRoute(d)
+			if err != nil {
+				return err
+			}
+			m.Routes = append(m.Routes, tr)
+		case "spool":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Spool = new(Spool)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "methods":
+					for _, method := range d.RemainingArgs() {
+						m.Spool.Methods = append(m.Spool.Methods, strings.ToUpper(method))
+					}
+				case "paths":
+					m.Spool.Paths = append(m.Spool.Paths, d.RemainingArgs()...)
+				case "max_requests", "status":
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+					}
+					if name == "max_requests" {
+						m.Spool.MaxRequests = n
+					} else {
+						m.Spool.Status = n
+					}
+				case "max_body_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_body_size %s: %v", d.Val(), err)
+					}
+					m.Spool.MaxBodySize = int64(size)
+				case "max_age":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid max_age %s: %v", d.Val(), err)
+					}
+					m.Spool.MaxAge = caddy.Duration(dur)
+				default:
+					return d.Errf("unrecognized spool subdirective %s", d.Val())
+				}
+			}
+		case "credential_sources":
+			sources := d.RemainingArgs()
+			if len(sources) == 0 {
+				return d.ArgErr()
+			}
+			m.CredentialSources = append(m.CredentialSources, sources...)
+		case "secrets":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				c := new(Credential)
+				switch d.Val() {
+				case "value", "hash":
+					kind := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					if kind == "value" {
+						c.Value = d.Val()
+					} else {
+						c.Hash = d.Val()
+					}
+				default:
+					return d.Errf("unrecognized secrets subdirective %s", d.Val())
+				}
+				for d.NextArg() {
+					name := d.Val()
+					if name != "not_before" && name != "expires" {
+						return d.Errf("unrecognized secrets option %s", name)
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					t, err := parseTime(d.Val())
+					if err != nil {
+						return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+					}
+					if name == "not_before" {
+						c.NotBefore = &t
+					} else {
+						c.Expires = &t
+					}
+				}
+				m.Secrets = append(m.Secrets, c)
+			}
+		case "enforce_expiry_on_active":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.EnforceExpiryOnActive = true
+		case "jwt":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.JWT = new(JWT)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "hmac_key", "public_key_file", "audience", "issuer":
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					switch name {
+					case "hmac_key":
+						m.JWT.HMACKey = d.Val()
+					case "public_key_file":
+						m.JWT.PublicKeyFile = d.Val()
+					case "audience":
+						m.JWT.Audience = d.Val()
+					default:
+						m.JWT.Issuer = d.Val()
+					}
+				case "leeway":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid leeway %s: %v", d.Val(), err)
+					}
+					m.JWT.Leeway = caddy.Duration(dur)
+				default:
+					return d.Errf("unrecognized jwt subdirective %s", d.Val())
+				}
+			}
+		case "performance":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Performance = new(Performance)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "max_read_frame_size", "write_buffer_size", "socket_read_buffer", "socket_write_buffer":
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+					}
+					switch name {
+					case "max_read_frame_size":
+						if size > maxFrameSize {
+							return d.Errf("invalid %s %s: must be at most 16MiB", name, d.Val())
+						}
+						m.Performance.MaxReadFrameSize = uint32(size)
+					case "write_buffer_size":
+						m.Performance.WriteBufferSize = int(size)
+					case "socket_read_buffer":
+						m.Performance.SocketReadBuffer = int(size)
+					default:
+						m.Performance.SocketWriteBuffer = int(size)
+					}
+				case "flush_interval", "read_idle_timeout", "ping_timeout":
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+					}
+					switch name {
+					case "flush_interval":
+						m.Performance.FlushInterval = caddy.Duration(dur)
+					case "read_idle_timeout":
+						m.Performance.ReadIdleTimeout = caddy.Duration(dur)
+					default:
+						m.Performance.PingTimeout = caddy.Duration(dur)
+					}
+				case "tcp_nodelay":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid tcp_nodelay value %s", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.Performance.TCPNoDelay = &v
+				default:
+					return d.Errf("unrecognized performance subdirective %s", d.Val())
+				}
+			}
+		case "connect_forwarding":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ConnectForwarding = new(ConnectForwarding)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "secret":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					m.ConnectForwarding.Secret = d.Val()
+				case "allowed_destinations":
+					m.ConnectForwarding.AllowedDestinations = append(m.ConnectForwarding.AllowedDestinations, d.RemainingArgs()...)
+				case "dial_timeout", "idle_timeout":
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid %s %s: %v", name, d.Val(), err)
+					}
+					if name == "dial_timeout" {
+						m.ConnectForwarding.DialTimeout = caddy.Duration(dur)
+					} else {
+						m.ConnectForwarding.IdleTimeout = caddy.Duration(dur)
+					}
+				default:
+					return d.Errf("unrecognized connect_forwarding subdirective %s", d.Val())
+				}
+			}
+		default:
+			return d.Errf("unrecognized subdirective %s", d.Val())
+		}
+	}
 	return nil
 }
 
-// parseCaddyfile unmarshals tokens from h into a new Middleware.
+// parseCaddyfile unmarshals tokens from h into a new Middleware, starting from
+// the client_proxy_defaults global option if one was given.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m Middleware
+	if defaults, ok := h.Option("client_proxy_defaults").(*Middleware); ok {
+		// round trip through JSON to copy only the configuration
+		b, err := json.Marshal(defaults)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+	}
 	err := m.UnmarshalCaddyfile(h.Dispenser)
 	return &m, err
 }
 
+// parseDefaults unmarshals the client_proxy_defaults global option, which
+// accepts the same options as the client_proxy directive block.
+func parseDefaults(d *caddyfile.Dispenser, _ any) (any, error) {
+	d.Next() // consume option name
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	m := new(Middleware)
+	if err := m.unmarshalOptions(d); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// bufConn reads the data buffered while hijacking the connection before
+// reading from the connection itself. Reads are only made by the ClientConn
+// read loop, so dropping the Reader once drained needs no locking.
 type bufConn struct {
 	net.Conn
 	*bufio.Reader
 }
 
 func (c *bufConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
 	if c.Reader == nil {
 		return c.Conn.Read(p)
 	}
@@ -167,9 +2801,317 @@ func (c *bufConn) Read(p []byte) (int, error) {
 	return c.Reader.Read(p)
 }
 
+// writeCountConn counts the bytes written to the connection.
+type writeCountConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *writeCountConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// holdCloseConn defers closing the connection while held, closing it on
+// release if it was closed in the meantime.
+type holdCloseConn struct {
+	net.Conn
+	mu     sync.Mutex
+	held   bool
+	closed bool
+}
+
+func (c *holdCloseConn) Close() error {
+	c.mu.Lock()
+	if c.held {
+		c.closed = true
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *holdCloseConn) release() {
+	c.mu.Lock()
+	c.held = false
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		c.Conn.Close()
+	}
+}
+
+// monitorConn closes broken when a read fails, which is how the ClientConn
+// read loop learns the client has gone away. err is the error of the failed
+// read, and must only be used once broken is closed.
+type monitorConn struct {
+	net.Conn
+	once   sync.Once
+	broken chan struct{}
+	err    error
+}
+
+func (c *monitorConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.once.Do(func() {
+			c.err = err
+			close(c.broken)
+		})
+	}
+	return n, err
+}
+
+// Settings are the HTTP/2 settings advertised by the client.
+type Settings struct {
+	HeaderTableSize       uint32 `json:"header_table_size"`
+	MaxConcurrentStreams  uint32 `json:"max_concurrent_streams,omitempty"`
+	InitialWindowSize     uint32 `json:"initial_window_size"`
+	MaxFrameSize          uint32 `json:"max_frame_size"`
+	MaxHeaderListSize     uint32 `json:"max_header_list_size,omitempty"`
+	EnableConnectProtocol bool   `json:"enable_connect_protocol"`
+}
+
+// settingsConn captures the first frame read from the client, which per the
+// HTTP/2 server connection preface must be its SETTINGS frame. Reads are only
+// made by the ClientConn read loop, so buf needs no locking.
+type settingsConn struct {
+	net.Conn
+	buf      []byte
+	ready    chan struct{}
+	settings Settings
+}
+
+func newSettingsConn(conn net.Conn) *settingsConn {
+	return &settingsConn{
+		Conn:  conn,
+		buf:   make([]byte, 0, 64),
+		ready: make(chan struct{}),
+		// defaults as specified in RFC 9113 section 6.5.2
+		settings: Settings{
+			HeaderTableSize:   4096,
+			InitialWindowSize: 65535,
+			MaxFrameSize:      16384,
+		},
+	}
+}
+
+func (c *settingsConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.buf != nil && n > 0 {
+		c.observe(p[:n])
+	}
+	return n, err
+}
+
+func (c *settingsConn) observe(p []byte) {
+	const frameHeaderLen = 9
+	c.buf = append(c.buf, p...)
+	if len(c.buf) < frameHeaderLen {
+		return
+	}
+	length := int(c.buf[0])<<16 | int(c.buf[1])<<8 | int(c.buf[2])
+	if length <= 16384 && len(c.buf) < frameHeaderLen+length {
+		return
+	}
+	f, err := http2.NewFramer(nil, bytes.NewReader(c.buf)).ReadFrame()
+	if sf, ok := f.(*http2.SettingsFrame); ok && err == nil {
+		_ = sf.ForeachSetting(func(s http2.Setting) error {
+			switch s.ID {
+			case http2.SettingHeaderTableSize:
+				c.settings.HeaderTableSize = s.Val
+			case http2.SettingMaxConcurrentStreams:
+				c.settings.MaxConcurrentStreams = s.Val
+			case http2.SettingInitialWindowSize:
+				c.settings.InitialWindowSize = s.Val
+			case http2.SettingMaxFrameSize:
+				c.settings.MaxFrameSize = s.Val
+			case http2.SettingMaxHeaderListSize:
+				c.settings.MaxHeaderListSize = s.Val
+			case http2.SettingEnableConnectProtocol:
+				c.settings.EnableConnectProtocol = s.Val == 1
+			}
+			return nil
+		})
+	}
+	c.buf = nil
+	close(c.ready)
+}
+
+// Settings returns the settings advertised by the client, or nil if they
+// haven't been received yet.
+func (c *settingsConn) Settings() *Settings {
+	select {
+	case <-c.ready:
+		s := c.settings
+		return &s
+	default:
+		return nil
+	}
+}
+
+// monitor removes h once its connection becomes unusable, as soon as a read
+// failed, or within monitorInterval of the client sending a GOAWAY, which
+// requests notice right away.
+func (m *Middleware) monitor(h *handler, mc *monitorConn) {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	var expired <-chan time.Time
+	if m.EnforceExpiryOnActive && !h.expires.IsZero() {
+		timer := time.NewTimer(time.Until(h.expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var rehandshake <-chan time.Time
+	if m.RehandshakeInterval > 0 {
+		timer := time.NewTimer(time.Duration(m.RehandshakeInterval))
+		defer timer.Stop()
+		rehandshake = timer.C
+	}
+	evicted := m.metrics.evictedError
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-expired:
+			m.logger.Info("credential expired, disconnecting client",
+				zap.String("remote_addr", h.remoteAddr),
+				zap.Time("expires", h.expires))
+			evicted = m.metrics.evictedLifetime
+		case <-rehandshake:
+			// the in-flight requests are drained as the client reconnects
+			m.logger.Info("rehandshake_interval elapsed, disconnecting client",
+				zap.String("remote_addr", h.remoteAddr),
+				zap.Duration("connected_for", time.Since(h.connectedAt)))
+			evicted = m.metrics.evictedLifetime
+		case <-mc.broken:
+			// the transport closes the connection itself when a ping is lost,
+			// while reads fail otherwise when the client goes away
+			if m.h2t.ReadIdleTimeout > 0 && errors.Is(mc.err, net.ErrClosed) {
+				evicted = m.metrics.evictedKeepalive
+			}
+		case <-ticker.C:
+			if state := h.conn.State(); !state.Closed && !state.Closing {
+				continue
+			}
+		}
+		m.handler.CompareAndSwap(h, nil)
+		h.close(evicted)
+		return
+	}
+}
+
+// debug returns a snapshot of the transport state of the connected client, or
+// nil if no client is connected. If ping is true, the client is sent a PING to
+// measure the round trip time.
+func (m *Middleware) debug(ctx context.Context, ping bool) *Debug {
+	h := m.handler.Load()
+	if h == nil {
+		return nil
+	}
+	if ping {
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		start := time.Now()
+		err := h.conn.Ping(ctx)
+		p := &Ping{At: start, RTT: time.Since(start).String()}
+		if err != nil {
+			p.Error = err.Error()
+		}
+		h.lastPing.Store(p)
+	}
+	state := h.conn.State()
+	d := &Debug{
+		LocalAddr:            h.localAddr,
+		RemoteAddr:           h.remoteAddr,
+		ConnectedAt:          h.connectedAt,
+		Requests:             h.requests.Load(),
+		StreamsActive:        state.StreamsActive,
+		StreamsReserved:      state.StreamsReserved,
+		StreamsPending:       state.StreamsPending,
+		MaxConcurrentStreams: state.MaxConcurrentStreams,
+		Closing:              state.Closing,
+		Closed:               state.Closed,
+		SendWindow:           h.flow.send.Load(),
+		ReceiveWindow:        h.flow.recv.Load(),
+		Settings:             h.sc.Settings(),
+		LastPing:             h.lastPing.Load(),
+	}
+	if state.StreamsActive == 0 && !state.LastIdle.IsZero() {
+		d.IdleFor = time.Since(state.LastIdle).String()
+	}
+	return d
+}
+
+// selfTest sends a GET request for the SelfTestPath through the connected
+// client, bypassing the proxy so it does not count as traffic. It returns nil
+// if no client is connected.
+func (m *Middleware) selfTest(ctx context.Context) *SelfTest {
+	h := m.handler.Load()
+	if h == nil {
+		return nil
+	}
+	path := m.SelfTestPath
+	if path == "" {
+		path = defaultSelfTestPath
+	}
+	host := "localhost"
+	if len(h.hosts) > 0 && !strings.HasPrefix(h.hosts[0], "*.") {
+		host = h.hosts[0]
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	result := &SelfTest{Path: path, At: time.Now()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+path, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("X-Client-Proxy-Self-Test", "1")
+	res, err := h.conn.RoundTrip(req)
+	result.Latency = time.Since(result.At).String()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer res.Body.Close()
+	result.Status = res.StatusCode
+	return result
+}
+
+// status returns the current Status.
+func (m *Middleware) status() Status {
+	handler := m.handler.Load()
+	if handler == nil {
+		return Status{Name: m.Name, Counters: m.counters.snapshot()}
+	}
+	return Status{
+		Name:     m.Name,
+		Counters: m.counters.snapshot(),
+		Client: &ClientStatus{
+			RemoteAddr:     handler.remoteAddr,
+			Subject:        handler.subject,
+			ConnectedAt:    handler.connectedAt,
+			MaxRequestBody: handler.maxBody,
+			MaxInflight:    m.inflightLimit(handler),
+			Inflight:       handler.inflight.Load(),
+			Hosts:          handler.hosts,
+			Paths:          handler.paths,
+			RequestTimeout: caddy.Duration(handler.timeout),
+			Verbose:        handler.verbose,
+			Metadata:       handler.metadata,
+			Tag:            handler.tag,
+			Settings:       handler.sc.Settings(),
+		},
+	}
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddy.Validator             = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
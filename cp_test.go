@@ -1,13 +1,31 @@
 package clientproxy
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/daaku/ensure"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/http2"
 )
 
 // normal request
@@ -18,8 +36,108 @@ import (
 
 const secret = "the_secret"
 
+var serverTimingRE = regexp.MustCompile(`^tunnel;dur=\d+\.\d, upstream;dur=\d+\.\d$`)
+
 func newMiddleware(t testing.TB) *Middleware {
-	return &Middleware{Secret: secret}
+	m := &Middleware{Secret: secret}
+	provision(t, m)
+	return m
+}
+
+func provision(t testing.TB, m *Middleware) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	provisionIn(t, ctx, m)
+}
+
+// provisionIn provisions m as part of the config loaded by ctx.
+func provisionIn(t testing.TB, ctx caddy.Context, m *Middleware) {
+	ensure.Nil(t, m.Validate())
+	ensure.Nil(t, m.Provision(ctx))
+	m.logger = zap.NewNop()
+	t.Cleanup(func() { m.Cleanup() })
+}
+
+// newServer serves m, responding with a 404 when the request falls through.
+func newServer(t testing.TB, m *Middleware) *httptest.Server {
+	s := newUnstartedServer(m)
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newUnstartedServer(m *Middleware) *httptest.Server {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		http.NotFound(w, r)
+		return nil
+	})
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.ServeHTTP(w, r, next); err != nil {
+			status := http.StatusInternalServerError
+			var herr caddyhttp.HandlerError
+			if errors.As(err, &herr) {
+				status = herr.StatusCode
+			}
+			http.Error(w, err.Error(), status)
+		}
+	}))
+	s.Config.ErrorLog = log.New(io.Discard, "", 0)
+	return s
+}
+
+// connect registers a client serving h, and waits until it is installed.
+func connect(t testing.TB, m *Middleware, s *httptest.Server, h http.Handler) net.Conn {
+	return connectWith(t, m, s, &http2.Server{}, nil, h)
+}
+
+// connectWith registers a client served by h2s, sending the additional
+// registration headers.
+func connectWith(t testing.TB, m *Middleware, s *httptest.Server, h2s *http2.Server, header http.Header, h http.Handler) net.Conn {
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	return connectOver(t, m, conn, h2s, header, h)
+}
+
+// connectOver registers a client over conn, as connectWith does.
+func connectOver(t testing.TB, m *Middleware, conn net.Conn, h2s *http2.Server, header http.Header, h http.Handler) net.Conn {
+	prev := m.handler.Load()
+	t.Cleanup(func() { conn.Close() })
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ensure.Nil(t, err)
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("X-Client-Proxy", secret)
+	ensure.Nil(t, req.Write(conn))
+	go h2s.ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+	eventually(t, func() bool { return m.handler.Load() != prev })
+	return conn
+}
+
+// eventually waits for f to return true.
+func eventually(t testing.TB, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func get(t testing.TB, s *httptest.Server, path string) (*http.Response, string) {
+	res, err := http.Get(s.URL + path)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	return res, string(body)
+}
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "hello")
 }
 
 func TestNoHandler(t *testing.T) {
@@ -37,3 +155,1235 @@ func TestNoHandler(t *testing.T) {
 	ensure.DeepEqual(t, err, ge)
 	ensure.True(t, called)
 }
+
+func TestProxy(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+	connect(t, m, s, http.HandlerFunc(hello))
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+}
+
+func TestClientErrorStatus(t *testing.T) {
+	m := &Middleware{Secret: secret, TryDuration: caddy.Duration(time.Second)}
+	provision(t, m)
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/reset" {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "down for maintenance")
+	}))
+
+	// the response of the client passes through, without a retry
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+	ensure.DeepEqual(t, res.Header.Get("Retry-After"), "30")
+	ensure.DeepEqual(t, body, "down for maintenance")
+	ensure.DeepEqual(t, calls.Load(), int32(1))
+	ensure.DeepEqual(t, m.status().Counters.Failures, uint64(0))
+
+	// failing to get a response is a 502
+	res, body = get(t, s, "/reset")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+	ensure.DeepEqual(t, body, "")
+	ensure.DeepEqual(t, m.status().Counters.Failures, uint64(1))
+}
+
+func TestSecondClient(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "second")
+	}))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "second")
+}
+
+func TestStatusSettings(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	ensure.True(t, m.status().Client == nil)
+	connectWith(t, m, s, &http2.Server{
+		MaxConcurrentStreams:     7,
+		MaxReadFrameSize:         1 << 20,
+		MaxUploadBufferPerStream: 1 << 17,
+	}, nil, http.HandlerFunc(hello))
+	eventually(t, func() bool { return m.status().Client.Settings != nil })
+	settings := m.status().Client.Settings
+	ensure.DeepEqual(t, settings.MaxConcurrentStreams, uint32(7))
+	ensure.DeepEqual(t, settings.MaxFrameSize, uint32(1<<20))
+	ensure.DeepEqual(t, settings.InitialWindowSize, uint32(1<<17))
+	// x/net servers advertise extended CONNECT unless disabled by GODEBUG
+	ensure.True(t, settings.EnableConnectProtocol)
+}
+
+func TestClientClose(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	conn.Close()
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	res, _ = get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+}
+
+func TestClientGoAway(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Proxy: %s\r\n\r\n", secret)
+	ensure.Nil(t, err)
+	fr := readyFramer(t, conn)
+	eventually(t, func() bool { return m.handler.Load() != nil })
+	h := m.handler.Load()
+	ensure.Nil(t, fr.WriteGoAway(0, http2.ErrCodeNo, nil))
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	<-h.done
+}
+
+// readyFramer acts as a bare client on conn after registering, sending its
+// SETTINGS and answering the readiness PING.
+func readyFramer(t testing.TB, conn net.Conn) *http2.Framer {
+	_, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface)))
+	ensure.Nil(t, err)
+	fr := http2.NewFramer(conn, conn)
+	ensure.Nil(t, fr.WriteSettings())
+	for {
+		f, err := fr.ReadFrame()
+		ensure.Nil(t, err)
+		if p, ok := f.(*http2.PingFrame); ok {
+			ensure.Nil(t, fr.WritePing(true, p.Data))
+			return fr
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Proxy: %s\r\n\r\n", secret)
+	ensure.Nil(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(http2.ClientPreface)))
+	ensure.Nil(t, err)
+
+	// not selectable until the client sent its SETTINGS and answered the PING
+	fr := http2.NewFramer(conn, conn)
+	time.Sleep(50 * time.Millisecond)
+	ensure.True(t, m.handler.Load() == nil)
+	ensure.Nil(t, fr.WriteSettings())
+	var ping *http2.PingFrame
+	for ping == nil {
+		f, err := fr.ReadFrame()
+		ensure.Nil(t, err)
+		ping, _ = f.(*http2.PingFrame)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ensure.True(t, m.handler.Load() == nil)
+	ensure.Nil(t, fr.WritePing(true, ping.Data))
+	eventually(t, func() bool { return m.handler.Load() != nil })
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	m := &Middleware{Secret: secret, HandshakeTimeout: caddy.Duration(100 * time.Millisecond)}
+	provision(t, m)
+	s := newServer(t, m)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Proxy: %s\r\n\r\n", secret)
+	ensure.Nil(t, err)
+
+	// the client goes silent after the hijack, and is disconnected
+	start := time.Now()
+	_, err = io.Copy(io.Discard, conn)
+	ensure.Nil(t, err)
+	ensure.True(t, time.Since(start) >= 100*time.Millisecond)
+	ensure.True(t, m.handler.Load() == nil)
+	ensure.DeepEqual(t, m.Cleanup(), nil)
+}
+
+func TestRehandshakeInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	m := &Middleware{Secret: secret, RehandshakeInterval: caddy.Duration(interval)}
+	provision(t, m)
+	core, logs := observer.New(zapcore.InfoLevel)
+	m.logger = zap.New(core)
+	s := newServer(t, m)
+	release := make(chan struct{})
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		hello(w, r)
+	}))
+	first := m.handler.Load()
+	done := make(chan int)
+	go func() {
+		res, err := http.Get(s.URL)
+		if err != nil {
+			done <- 0
+			return
+		}
+		res.Body.Close()
+		done <- res.StatusCode
+	}()
+	eventually(t, func() bool { return first.inflight.Load() == 1 })
+
+	// the client is disconnected, letting the in-flight request finish
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	ensure.DeepEqual(t, logs.FilterMessage("rehandshake_interval elapsed, disconnecting client").Len(), 1)
+	close(release)
+	ensure.DeepEqual(t, <-done, http.StatusOK)
+
+	// and the cycle runs again for the reconnected client
+	connect(t, m, s, http.HandlerFunc(hello))
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	ensure.DeepEqual(t, logs.FilterMessage("rehandshake_interval elapsed, disconnecting client").Len(), 2)
+}
+
+func TestVars(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "vars"}
+	provision(t, m)
+	vars := make(chan map[string]any, 1)
+	s := newUnstartedServer(m)
+	h := s.Config.Handler
+	// as the vars handler of Caddy does, reading them once client_proxy is done
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := make(map[string]any)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, v)))
+		vars <- v
+	})
+	s.Start()
+	t.Cleanup(s.Close)
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Client-Proxy-Hosts": {"a.example.com"}}, http.HandlerFunc(hello))
+	<-vars // the registration
+
+	request := func(host string) map[string]any {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		ensure.Nil(t, err)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		return <-vars
+	}
+	v := request("a.example.com")
+	ensure.DeepEqual(t, v["client_proxy.selected"], "vars")
+	ensure.DeepEqual(t, v["client_proxy.client_addr"], m.handler.Load().remoteAddr)
+	ensure.True(t, v["client_proxy.subject"] == nil)
+	ensure.DeepEqual(t, len(request("b.example.com")), 0, "not served by the client")
+}
+
+func TestServerTiming(t *testing.T) {
+	m := &Middleware{Secret: secret, ServerTiming: true}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-Timing", "app;dur=1")
+	}))
+	res, _ := get(t, s, "/")
+	timings := res.Header.Values("Server-Timing")
+	ensure.DeepEqual(t, len(timings), 2)
+	ensure.DeepEqual(t, timings[0], "app;dur=1")
+	ensure.True(t, serverTimingRE.MatchString(timings[1]), timings[1])
+}
+
+func TestServerTimingDisabled(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, len(res.Header.Values("Server-Timing")), 0)
+}
+
+// hijackWriter is a ResponseWriter that hands out conn when hijacked.
+type hijackWriter struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (w *hijackWriter) EnableFullDuplex() error {
+	return nil
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// register sends a registration request to m which hijacks conn.
+func register(t testing.TB, m *Middleware, conn net.Conn) <-chan error {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", secret)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.ServeHTTP(&hijackWriter{ResponseRecorder: httptest.NewRecorder(), conn: conn}, r, nil)
+	}()
+	return errc
+}
+
+// bufferedHijackWriter hijacks conn with data left to flush.
+type bufferedHijackWriter struct {
+	hijackWriter
+}
+
+func (w *bufferedHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := w.hijackWriter.Hijack()
+	buf.WriteString("buffered")
+	return conn, buf, err
+}
+
+func TestFlushTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	m := &Middleware{Secret: secret, FlushTimeout: caddy.Duration(timeout)}
+	provision(t, m)
+	// the client never reads, so the flush blocks
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", secret)
+	start := time.Now()
+	err := m.ServeHTTP(&bufferedHijackWriter{hijackWriter{httptest.NewRecorder(), server}}, r, nil)
+	ensure.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+	ensure.True(t, time.Since(start) < defaultHandshakeTimeout)
+	ensure.True(t, m.handler.Load() == nil)
+}
+
+func TestDeadlineCleared(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	m := newMiddleware(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	ensure.Nil(t, server.SetDeadline(time.Now().Add(timeout)))
+	go new(http2.Server).ServeConn(client, &http2.ServeConnOpts{Handler: http.HandlerFunc(hello)})
+	register(t, m, server)
+	eventually(t, func() bool { return m.handler.Load() != nil })
+	time.Sleep(3 * timeout)
+	w := httptest.NewRecorder()
+	ensure.Nil(t, m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), nil))
+	ensure.DeepEqual(t, w.Code, http.StatusOK)
+	ensure.DeepEqual(t, w.Body.String(), "hello")
+}
+
+func TestBufConn(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	br := bufio.NewReader(strings.NewReader("abc"))
+	_, err := br.Peek(3)
+	ensure.Nil(t, err)
+	c := &bufConn{Conn: server, Reader: br}
+
+	// zero-length reads neither block on the connection nor drop the buffer
+	n, err := c.Read(nil)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, 0)
+	ensure.True(t, c.Reader != nil)
+
+	// reads stop at the end of the buffered data
+	b := make([]byte, 4)
+	n, err = c.Read(b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(b[:n]), "abc")
+	n, err = c.Read(b[:0])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, 0)
+
+	go client.Write([]byte("def"))
+	n, err = c.Read(b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(b[:n]), "def")
+	ensure.True(t, c.Reader == nil)
+}
+
+func TestRegistrationReturns(t *testing.T) {
+	m := newMiddleware(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	go new(http2.Server).ServeConn(client, &http2.ServeConnOpts{Handler: http.HandlerFunc(hello)})
+	select {
+	case err := <-register(t, m, server):
+		ensure.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("registration did not return")
+	}
+	w := httptest.NewRecorder()
+	ensure.Nil(t, m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), nil))
+	ensure.DeepEqual(t, w.Body.String(), "hello")
+}
+
+// failFirstWrite fails its first write, like the HTTP/2 preface failing to be
+// written.
+type failFirstWrite struct {
+	net.Conn
+	failed bool
+}
+
+func (c *failFirstWrite) Write(p []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		return 0, errors.New("write failed")
+	}
+	return c.Conn.Write(p)
+}
+
+// failPartialWrite writes part of its first write before failing it.
+type failPartialWrite struct {
+	net.Conn
+	failed bool
+}
+
+func (c *failPartialWrite) Write(p []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		n, _ := c.Conn.Write(p[:len(p)/2])
+		return n, errors.New("write failed")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	m := &Middleware{Secret: secret, HandshakeRetries: 1}
+	provision(t, m)
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go (&http2.Server{}).ServeConn(client, &http2.ServeConnOpts{Handler: http.HandlerFunc(hello)})
+	ensure.Nil(t, <-register(t, m, &failFirstWrite{Conn: server}))
+	ensure.True(t, m.handler.Load() != nil)
+
+	// the client saw part of the preface, so it cannot be retried
+	server, client = net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, client)
+	err := <-register(t, m, &failPartialWrite{Conn: server})
+	ensure.True(t, errors.Is(err, ErrUpgradeFailed), err)
+
+	// without retries, the first failure is final
+	m = newMiddleware(t)
+	server, client = net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, client)
+	err = <-register(t, m, &failFirstWrite{Conn: server})
+	ensure.True(t, errors.Is(err, ErrUpgradeFailed), err)
+}
+
+func TestRegistrationSetupError(t *testing.T) {
+	m := newMiddleware(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	errc := register(t, m, &failFirstWrite{Conn: server})
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	ensure.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusInternalServerError)
+	ensure.DeepEqual(t, string(body), "client_proxy: unable to start HTTP/2\n")
+	ensure.Err(t, <-errc, regexp.MustCompile("unable to create ClientConn"))
+	ensure.True(t, m.handler.Load() == nil)
+}
+
+func TestRegistrationHTTP2(t *testing.T) {
+	m := &Middleware{Secret: secret, RegistrationAddress: "register.example.com:8443"}
+	provision(t, m)
+	s := newUnstartedServer(m)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("X-Client-Proxy", secret)
+	res, err := s.Client().Do(req)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.ProtoMajor, 2)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusHTTPVersionNotSupported)
+	ensure.DeepEqual(t, res.Header.Get("X-Client-Proxy-Registration-Address"), "register.example.com:8443")
+	ensure.StringContains(t, string(body), "registration requires HTTP/1.1, got HTTP/2.0")
+	ensure.StringContains(t, string(body), "register at register.example.com:8443")
+	ensure.True(t, m.handler.Load() == nil)
+}
+
+func TestCleanupDrains(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	ensure.Nil(t, m.Cleanup())
+	ensure.True(t, m.handler.Load() == nil)
+	// the tunnel was shut down
+	ensure.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := io.ReadAll(conn)
+	ensure.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func TestCleanupGrace(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	m := &Middleware{Secret: secret, CleanupGrace: caddy.Duration(grace)}
+	provision(t, m)
+	s := newServer(t, m)
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	go func() {
+		if res, err := http.Get(s.URL); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	// the request never finishes, so the client is closed after the grace
+	start := time.Now()
+	ensure.Nil(t, m.Cleanup())
+	ensure.True(t, time.Since(start) >= grace)
+	ensure.True(t, time.Since(start) < 5*time.Second)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request was not canceled")
+	}
+}
+
+func TestShutdownMode(t *testing.T) {
+	for _, mode := range []string{"graceful", "immediate"} {
+		t.Run(mode, func(t *testing.T) {
+			m := &Middleware{Secret: secret, ShutdownMode: mode}
+			provision(t, m)
+			s := newServer(t, m)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-release:
+					hello(w, r)
+				case <-r.Context().Done():
+				}
+			}))
+			done := make(chan int)
+			go func() {
+				res, err := http.Get(s.URL)
+				if err != nil {
+					done <- 0
+					return
+				}
+				res.Body.Close()
+				done <- res.StatusCode
+			}()
+			<-started
+
+			// the client is replaced with a request in flight
+			connect(t, m, s, http.HandlerFunc(hello))
+			if mode == "immediate" {
+				ensure.DeepEqual(t, <-done, http.StatusBadGateway)
+				close(release)
+				return
+			}
+			select {
+			case status := <-done:
+				t.Fatalf("in-flight request finished with %d before the client responded", status)
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(release)
+			ensure.DeepEqual(t, <-done, http.StatusOK)
+		})
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	h := m.handler.Load()
+
+	// the connection breaking, Cleanup and direct closes all race to close
+	// the handler
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	closers := []func(){
+		func() { conn.Close() },
+		func() { m.Cleanup() },
+	}
+	for range 10 {
+		closers = append(closers, func() { h.close(m.metrics.evictedError) })
+	}
+	for _, f := range closers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			f()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	<-h.done
+	ensure.Nil(t, m.Cleanup())
+	ensure.True(t, m.handler.Load() == nil)
+}
+
+func TestRequireHeaders(t *testing.T) {
+	m := &Middleware{Secret: secret, RequireHeaders: http.Header{
+		"X-Present":     nil,
+		"X-Value":       {"a", "b"},
+		"Authorization": nil,
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	cases := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"all", http.Header{"X-Present": {"1"}, "X-Value": {"b"}, "Authorization": {"x"}}, http.StatusOK},
+		{"missing", http.Header{"X-Value": {"b"}, "Authorization": {"x"}}, http.StatusBadRequest},
+		{"wrong value", http.Header{"X-Present": {"1"}, "X-Value": {"c"}, "Authorization": {"x"}}, http.StatusBadRequest},
+		{"missing auth", http.Header{"X-Present": {"1"}, "X-Value": {"a"}}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+			ensure.Nil(t, err)
+			req.Header = c.header
+			res, err := http.DefaultClient.Do(req)
+			ensure.Nil(t, err)
+			res.Body.Close()
+			ensure.DeepEqual(t, res.StatusCode, c.status)
+		})
+	}
+}
+
+func TestMethods(t *testing.T) {
+	m := &Middleware{
+		Secret:         secret,
+		AllowedMethods: []string{"POST", "PUT", "DELETE"},
+		DeniedMethods:  []string{"DELETE", "GET"},
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	// registrations are exempt
+	connect(t, m, s, http.HandlerFunc(hello))
+	for _, c := range []struct {
+		method string
+		status int
+	}{
+		{http.MethodPost, http.StatusOK},
+		{http.MethodPut, http.StatusOK},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodPatch, http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(c.method, s.URL, nil)
+		ensure.Nil(t, err)
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		ensure.DeepEqual(t, res.StatusCode, c.status, c.method)
+		if c.status == http.StatusMethodNotAllowed {
+			ensure.DeepEqual(t, res.Header.Get("Allow"), "POST, PUT", c.method)
+		}
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	cases := []struct {
+		name   string
+		server int64
+		client string
+		want   int64
+	}{
+		{"server", 10, "", 10},
+		{"client", 0, "10", 10},
+		{"server smaller", 10, "20", 10},
+		{"client smaller", 20, "10", 10},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Middleware{Secret: secret, MaxRequestBody: c.server}
+			provision(t, m)
+			s := newServer(t, m)
+			header := http.Header{}
+			if c.client != "" {
+				header.Set("X-Client-Proxy-Max-Body", c.client)
+			}
+			connectWith(t, m, s, &http2.Server{}, header, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+			}))
+			ensure.DeepEqual(t, m.status().Client.MaxRequestBody, c.want)
+			post := func(body io.Reader) int {
+				res, err := http.Post(s.URL, "text/plain", body)
+				ensure.Nil(t, err)
+				res.Body.Close()
+				return res.StatusCode
+			}
+			ensure.DeepEqual(t, post(strings.NewReader("0123456789")), http.StatusOK)
+			ensure.DeepEqual(t, post(strings.NewReader("0123456789a")), http.StatusRequestEntityTooLarge)
+			// unknown length
+			ensure.DeepEqual(t, post(io.MultiReader(strings.NewReader("0123456789a"))), http.StatusRequestEntityTooLarge)
+		})
+	}
+}
+
+func TestInvalidMaxBody(t *testing.T) {
+	m := newMiddleware(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", secret)
+	r.Header.Set("X-Client-Proxy-Max-Body", "lots")
+	err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.StatusCode, http.StatusBadRequest)
+}
+
+func TestMaxInflight(t *testing.T) {
+	m := &Middleware{Secret: secret, MaxInflight: 2}
+	provision(t, m)
+	s := newServer(t, m)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	header := http.Header{"X-Client-Proxy-Max-Inflight": {"1"}}
+	connectWith(t, m, s, &http2.Server{}, header, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			started <- struct{}{}
+			<-unblock
+		}
+	}))
+	ensure.DeepEqual(t, m.status().Client.MaxInflight, int64(1))
+
+	done := make(chan int)
+	go func() {
+		res, _ := get(t, s, "/block")
+		done <- res.StatusCode
+	}()
+	<-started
+	ensure.DeepEqual(t, m.status().Client.Inflight, int64(1))
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+	close(unblock)
+	ensure.DeepEqual(t, <-done, http.StatusOK)
+	res, _ = get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	eventually(t, func() bool { return m.status().Client.Inflight == 0 })
+}
+
+func TestInvalidMaxInflight(t *testing.T) {
+	m := newMiddleware(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", secret)
+	r.Header.Set("X-Client-Proxy-Max-Inflight", "0")
+	err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.StatusCode, http.StatusBadRequest)
+}
+
+func TestHosts(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connectWith(t, m, s, &http2.Server{}, http.Header{
+		"X-Client-Proxy-Hosts": {"a.example.com, *.b.example.com"},
+	}, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, m.status().Client.Hosts, []string{"a.example.com", "*.b.example.com"})
+	for host, status := range map[string]int{
+		"a.example.com":     http.StatusOK,
+		"A.example.com:443": http.StatusOK,
+		"x.b.example.com":   http.StatusOK,
+		"c.example.com":     http.StatusNotFound,
+		"b.example.com":     http.StatusNotFound,
+	} {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		ensure.Nil(t, err)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		ensure.DeepEqual(t, res.StatusCode, status, host)
+	}
+}
+
+func TestHostMismatchStatus(t *testing.T) {
+	for _, status := range []int{http.StatusMisdirectedRequest, http.StatusBadGateway} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			m := &Middleware{Secret: secret, HostMismatchStatus: status}
+			provision(t, m)
+			s := newServer(t, m)
+			connectWith(t, m, s, &http2.Server{}, http.Header{
+				"X-Client-Proxy-Hosts": {"a.example.com"},
+			}, http.HandlerFunc(hello))
+			req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+			ensure.Nil(t, err)
+			req.Host = "c.example.com"
+			res, err := http.DefaultClient.Do(req)
+			ensure.Nil(t, err)
+			res.Body.Close()
+			ensure.DeepEqual(t, res.StatusCode, status)
+		})
+	}
+}
+
+func TestHostMismatchStatusInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, HostMismatchStatus: http.StatusNotFound}
+	ensure.NotNil(t, m.Validate())
+}
+
+func TestAllowedHosts(t *testing.T) {
+	m := &Middleware{Secret: secret, AllowedHosts: []string{"*.example.com"}}
+	provision(t, m)
+	for claim, status := range map[string]int{
+		"a.example.com":   0,
+		"*.example.com":   0,
+		"example.com":     http.StatusForbidden,
+		"a.b.example.com": http.StatusForbidden,
+		"a.example.org":   http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Client-Proxy", secret)
+		r.Header.Set("X-Client-Proxy-Hosts", claim)
+		err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var herr caddyhttp.HandlerError
+		if status == 0 {
+			// allowed, but fails later since it cannot be hijacked
+			ensure.False(t, errors.As(err, &herr), claim)
+			continue
+		}
+		ensure.True(t, errors.As(err, &herr), claim)
+		ensure.DeepEqual(t, herr.StatusCode, status, claim)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	m := &Middleware{Secret: secret, HostMismatchStatus: http.StatusMisdirectedRequest}
+	provision(t, m)
+	s := newServer(t, m)
+	connectWith(t, m, s, &http2.Server{}, http.Header{
+		"X-Client-Proxy-Paths": {"/api/, /webhooks/"},
+	}, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, m.status().Client.Paths, []string{"/api/", "/webhooks/"})
+	for path, status := range map[string]int{
+		"/api/":         http.StatusOK,
+		"/api/a":        http.StatusOK,
+		"/webhooks/a/b": http.StatusOK,
+		"/api":          http.StatusNotFound,
+		"/":             http.StatusNotFound,
+		"/other/api/":   http.StatusNotFound,
+	} {
+		res, _ := get(t, s, path)
+		ensure.DeepEqual(t, res.StatusCode, status, path)
+	}
+
+	// replaced wholesale by the next registration
+	connectWith(t, m, s, &http2.Server{}, http.Header{
+		"X-Client-Proxy-Paths": {"/other/"},
+	}, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, m.status().Client.Paths, []string{"/other/"})
+	res, _ := get(t, s, "/api/a")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+}
+
+func TestAllowedPaths(t *testing.T) {
+	m := &Middleware{Secret: secret, AllowedPaths: []string{"/api/", "/webhooks/"}}
+	provision(t, m)
+	for claim, status := range map[string]int{
+		"/api/":           0,
+		"/api/v1/,/api/":  0,
+		"/":               http.StatusForbidden,
+		"/api":            http.StatusForbidden,
+		"/api/,/other/":   http.StatusForbidden,
+		"api/":            http.StatusBadRequest,
+		"/webhooks/,*":    http.StatusBadRequest,
+		"/webhooks/a, /b": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Client-Proxy", secret)
+		r.Header.Set("X-Client-Proxy-Paths", claim)
+		err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var herr caddyhttp.HandlerError
+		if status == 0 {
+			// allowed, but fails later since it cannot be hijacked
+			ensure.False(t, errors.As(err, &herr), claim)
+			continue
+		}
+		ensure.True(t, errors.As(err, &herr), claim)
+		ensure.DeepEqual(t, herr.StatusCode, status, claim)
+	}
+}
+
+func TestMinReconnectInterval(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	m := &Middleware{Secret: secret, MinReconnectInterval: caddy.Duration(interval)}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	first := m.handler.Load()
+
+	// rapid re-registrations are rejected, keeping the connected client
+	for range 3 {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Client-Proxy", secret)
+		w := httptest.NewRecorder()
+		err := m.ServeHTTP(w, r, nil)
+		var herr caddyhttp.HandlerError
+		ensure.True(t, errors.As(err, &herr))
+		ensure.DeepEqual(t, herr.StatusCode, http.StatusTooManyRequests)
+		ensure.DeepEqual(t, w.Header().Get("Retry-After"), "1")
+	}
+	ensure.True(t, m.handler.Load() == first)
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+
+	time.Sleep(interval)
+	connect(t, m, s, http.HandlerFunc(hello))
+	ensure.True(t, m.handler.Load() != first)
+}
+
+func TestMinReconnectIntervalFailedHandshake(t *testing.T) {
+	m := &Middleware{
+		Secret:               secret,
+		MinReconnectInterval: caddy.Duration(time.Minute),
+		HandshakeTimeout:     caddy.Duration(50 * time.Millisecond),
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Proxy: %s\r\n\r\n", secret)
+	ensure.Nil(t, err)
+	_, err = io.Copy(io.Discard, conn)
+	ensure.Nil(t, err)
+
+	// the failed handshake does not count as a registration
+	connect(t, m, s, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+}
+
+func TestMaxClientsPerIP(t *testing.T) {
+	m := &Middleware{Secret: secret, MaxClientsPerIP: 1}
+	provision(t, m)
+	s := newServer(t, m)
+	other := &Middleware{Secret: secret, MaxClientsPerIP: 1}
+	provision(t, other)
+	otherServer := newServer(t, other)
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+
+	// a second client from the same address is rejected
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Client-Proxy", secret)
+	err := other.ServeHTTP(httptest.NewRecorder(), r, nil)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.StatusCode, http.StatusTooManyRequests)
+	ensure.True(t, other.handler.Load() == nil)
+
+	// replacing the connected client is allowed
+	first := m.handler.Load()
+	conn2 := connect(t, m, s, http.HandlerFunc(hello))
+	ensure.True(t, m.handler.Load() != first)
+	conn.Close()
+
+	// once it goes away, the address may register elsewhere
+	conn2.Close()
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	connect(t, other, otherServer, http.HandlerFunc(hello))
+	_, body := get(t, otherServer, "/")
+	ensure.DeepEqual(t, body, "hello")
+}
+
+func TestMaxPendingRegistrations(t *testing.T) {
+	const limit = 3
+	m := &Middleware{Secret: secret, MaxPendingRegistrations: limit}
+	provision(t, m)
+	s := newServer(t, m)
+	// registrations that never start the HTTP/2 handshake
+	var stalled []net.Conn
+	for range limit {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		ensure.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Proxy: %s\r\n\r\n", secret)
+		ensure.Nil(t, err)
+		stalled = append(stalled, conn)
+	}
+	eventually(t, func() bool { return m.pending.Load() == limit })
+
+	err := m.ServeHTTP(httptest.NewRecorder(), registration(secret), nil)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.StatusCode, http.StatusServiceUnavailable)
+	ensure.True(t, errors.Is(err, ErrRegistrationRejected))
+	ensure.DeepEqual(t, m.pending.Load(), int64(limit))
+
+	// once one gives up, a client may register
+	stalled[0].Close()
+	eventually(t, func() bool { return m.pending.Load() == limit-1 })
+	connect(t, m, s, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+	ensure.DeepEqual(t, m.pending.Load(), int64(limit-1))
+}
+
+func TestMaxClients(t *testing.T) {
+	newHandler := func(name string) (*Middleware, *httptest.Server) {
+		m := &Middleware{Secret: secret, Name: name, MaxClients: 2}
+		provision(t, m)
+		return m, newServer(t, m)
+	}
+	a, as := newHandler("max_clients_a")
+	b, bs := newHandler("max_clients_b")
+	c, cs := newHandler("max_clients_c")
+	connect(t, a, as, http.HandlerFunc(hello))
+	connect(t, b, bs, http.HandlerFunc(hello))
+	get(t, as, "/")
+
+	// b was used least recently, so it makes way for c
+	connect(t, c, cs, http.HandlerFunc(hello))
+	eventually(t, func() bool { return b.handler.Load() == nil })
+	ensure.True(t, a.handler.Load() != nil)
+	ensure.DeepEqual(t, metricValue(t, b, "caddy_client_proxy_evictions_total", "reason", "max_clients"), 1.0)
+	_, body := get(t, cs, "/")
+	ensure.DeepEqual(t, body, "hello")
+
+	// replacing a connected client evicts no one
+	connect(t, c, cs, http.HandlerFunc(hello))
+	ensure.True(t, a.handler.Load() != nil)
+
+	// or the registration is rejected
+	b.OnMaxClients = "reject"
+	err := b.ServeHTTP(httptest.NewRecorder(), registration(secret), nil)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.StatusCode, http.StatusTooManyRequests)
+	ensure.True(t, errors.Is(err, ErrRegistrationRejected))
+	ensure.True(t, a.handler.Load() != nil && c.handler.Load() != nil)
+}
+
+func TestOnAccept(t *testing.T) {
+	var seen []string
+	m := &Middleware{Secret: secret, OnAccept: func(r *http.Request) error {
+		seen = append(seen, r.Header.Get("X-Token"))
+		switch r.Header.Get("X-Token") {
+		case "good":
+			return nil
+		case "teapot":
+			return caddyhttp.Error(http.StatusTeapot, errors.New("short and stout"))
+		}
+		return errors.New("bad token")
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+
+	for token, status := range map[string]int{"bad": http.StatusForbidden, "teapot": http.StatusTeapot} {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		ensure.Nil(t, err)
+		req.Header.Set("X-Client-Proxy", secret)
+		req.Header.Set("X-Token", token)
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, res.StatusCode, status, token)
+		if token == "bad" {
+			ensure.StringContains(t, string(body), "registration rejected: bad token")
+		}
+	}
+	ensure.True(t, m.handler.Load() == nil)
+
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Token": {"good"}}, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+	ensure.DeepEqual(t, len(seen), 3)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	const base = 50 * time.Millisecond
+	cases := []struct {
+		name     string
+		max      time.Duration
+		declared string
+		want     time.Duration
+	}{
+		{"global", 0, "", base},
+		{"ignored without max", 0, "1s", base},
+		{"declared", time.Second, "200ms", 200 * time.Millisecond},
+		{"clamped", 200 * time.Millisecond, "1m", 200 * time.Millisecond},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Middleware{
+				Secret:            secret,
+				RequestTimeout:    caddy.Duration(base),
+				MaxRequestTimeout: caddy.Duration(c.max),
+			}
+			provision(t, m)
+			s := newServer(t, m)
+			header := http.Header{}
+			if c.declared != "" {
+				header.Set("X-Client-Proxy-Request-Timeout", c.declared)
+			}
+			connectWith(t, m, s, &http2.Server{}, header, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				d, _ := time.ParseDuration(r.URL.Query().Get("sleep"))
+				select {
+				case <-time.After(d):
+				case <-r.Context().Done():
+				}
+			}))
+			ensure.DeepEqual(t, time.Duration(m.status().Client.RequestTimeout), c.want)
+			res, _ := get(t, s, fmt.Sprintf("/?sleep=%s", c.want/2))
+			ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+			res, _ = get(t, s, fmt.Sprintf("/?sleep=%s", c.want*2))
+			ensure.DeepEqual(t, res.StatusCode, http.StatusGatewayTimeout)
+		})
+	}
+}
+
+func TestRejectOnShutdown(t *testing.T) {
+	for _, reject := range []bool{true, false} {
+		t.Run(strconv.FormatBool(reject), func(t *testing.T) {
+			m := &Middleware{Secret: secret, RejectOnShutdown: reject}
+			provision(t, m)
+			s := newServer(t, m)
+			connect(t, m, s, http.HandlerFunc(hello))
+			ensure.Nil(t, m.Cleanup())
+			res, _ := get(t, s, "/")
+			if !reject {
+				// the client was drained, so the request falls through
+				ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+				return
+			}
+			ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+			ensure.True(t, res.Close)
+		})
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	m := &Middleware{
+		Secret:                secret,
+		ResponseHeaderTimeout: caddy.Duration(50 * time.Millisecond),
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall" {
+			<-r.Context().Done()
+			return
+		}
+		// slow bodies are fine, once the headers were sent
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "slow")
+	}))
+	start := time.Now()
+	res, _ := get(t, s, "/stall")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusGatewayTimeout)
+	ensure.True(t, time.Since(start) < time.Second)
+
+	res, body := get(t, s, "/slow")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "slow")
+}
+
+func TestLiveHandler(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// loaded before being replaced, which closes it
+	stale := m.handler.Load()
+	connect(t, m, s, http.HandlerFunc(hello))
+	ensure.True(t, stale.closed())
+	live, err := m.liveHandler(stale, r)
+	ensure.Nil(t, err)
+	ensure.True(t, live == m.handler.Load())
+
+	// replaced by a client not serving the request
+	stale = live
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Client-Proxy-Hosts": {"other.example.com"}}, http.HandlerFunc(hello))
+	_, err = m.liveHandler(stale, r)
+	ensure.True(t, errors.Is(err, ErrNoClient), err)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.StatusCode, http.StatusServiceUnavailable)
+
+	// unusable, as once the client sent a GOAWAY, and evicted right away
+	connect(t, m, s, http.HandlerFunc(hello))
+	unusable := m.handler.Load()
+	unusable.conn.SetDoNotReuse()
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+	ensure.True(t, unusable.closed())
+	ensure.True(t, m.handler.Load() == nil)
+
+	// gone without a replacement
+	connect(t, m, s, http.HandlerFunc(hello))
+	stale = m.handler.Load()
+	m.handler.CompareAndSwap(stale, nil)
+	stale.close(m.metrics.evictedError)
+	_, err = m.liveHandler(stale, r)
+	ensure.True(t, errors.Is(err, ErrNoClient), err)
+}
+
+func TestChurn(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+
+	// requests keep being served while clients are replaced
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var served, failed atomic.Int64
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				res, err := http.Get(s.URL + "/")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode == http.StatusOK {
+					served.Add(1)
+				} else {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	for range 50 {
+		connect(t, m, s, http.HandlerFunc(hello))
+	}
+	close(stop)
+	wg.Wait()
+	ensure.DeepEqual(t, failed.Load(), int64(0))
+	ensure.True(t, served.Load() > 0)
+}
@@ -0,0 +1,157 @@
+package clientproxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const defaultDebugHeadersMaxSize = 4 << 10
+
+// DebugHeaders configures logging the headers of forwarded requests and their
+// responses.
+type DebugHeaders struct {
+	// Headers whose values are redacted. Defaults to Authorization, Cookie and
+	// Set-Cookie.
+	Redact []string `json:"redact,omitempty"`
+
+	// The maximum number of bytes of header values logged per request or
+	// response. Defaults to 4KiB.
+	MaxSize int `json:"max_size,omitempty"`
+}
+
+// redacted returns the headers to redact, which d may be nil for.
+func (d *DebugHeaders) redacted() map[string]bool {
+	var names []string
+	if d != nil {
+		names = d.Redact
+	}
+	if len(names) == 0 {
+		names = []string{"Authorization", "Cookie", "Set-Cookie"}
+	}
+	redact := make(map[string]bool, len(names))
+	for _, n := range names {
+		redact[http.CanonicalHeaderKey(n)] = true
+	}
+	return redact
+}
+
+func (d *DebugHeaders) maxSize() int {
+	if d != nil && d.MaxSize > 0 {
+		return d.MaxSize
+	}
+	return defaultDebugHeadersMaxSize
+}
+
+// logRequest logs a request as it is forwarded to the client.
+func (m *Middleware) logRequest(r *http.Request) {
+	m.logRequestAt(zapcore.DebugLevel, r)
+}
+
+func (m *Middleware) logRequestAt(level zapcore.Level, r *http.Request) {
+	if ce := m.logger.Check(level, "upstream request"); ce != nil {
+		ce.Write(
+			zap.String("method", r.Method),
+			zap.String("url", r.URL.String()),
+			zap.String("host", r.Host),
+			zap.Object("headers", m.loggableHeader(r.Header)),
+		)
+	}
+}
+
+// logResponse logs a response as it arrives from the client.
+func (m *Middleware) logResponse(res *http.Response) error {
+	return m.logResponseAt(zapcore.DebugLevel, res)
+}
+
+func (m *Middleware) logResponseAt(level zapcore.Level, res *http.Response) error {
+	if ce := m.logger.Check(level, "upstream response"); ce != nil {
+		ce.Write(
+			zap.String("method", res.Request.Method),
+			zap.String("url", res.Request.URL.String()),
+			zap.Int("status", res.StatusCode),
+			zap.Object("headers", m.loggableHeader(res.Header)),
+		)
+	}
+	return nil
+}
+
+// verboseRequested reports if the client registering with r asked for its
+// requests to be logged, presenting the debug_token. Invalid tokens are only
+// logged, rather than failing the registration.
+func (m *Middleware) verboseRequested(r *http.Request) bool {
+	v := r.Header.Get("X-Client-Proxy-Debug")
+	if v == "" {
+		return false
+	}
+	if m.DebugToken == "" || subtle.ConstantTimeCompare([]byte(v), []byte(m.DebugToken)) != 1 {
+		m.logger.Warn("ignoring invalid X-Client-Proxy-Debug",
+			zap.String("remote_addr", r.RemoteAddr))
+		return false
+	}
+	return true
+}
+
+// logVerbose makes p log the requests it forwards, and their responses, at
+// the info level, after any other changes to them.
+func (m *Middleware) logVerbose(p *httputil.ReverseProxy) {
+	director, modify := p.Director, p.ModifyResponse
+	p.Director = func(r *http.Request) {
+		director(r)
+		m.logRequestAt(zapcore.InfoLevel, r)
+	}
+	p.ModifyResponse = func(res *http.Response) error {
+		if modify != nil {
+			if err := modify(res); err != nil {
+				return err
+			}
+		}
+		return m.logResponseAt(zapcore.InfoLevel, res)
+	}
+}
+
+func (m *Middleware) loggableHeader(h http.Header) loggableHeader {
+	return loggableHeader{header: h, redact: m.redact, maxSize: m.DebugHeaders.maxSize()}
+}
+
+// loggableHeader logs the header, redacting values and truncating once maxSize
+// bytes of values have been logged.
+type loggableHeader struct {
+	header  http.Header
+	redact  map[string]bool
+	maxSize int
+}
+
+func (l loggableHeader) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	keys := make([]string, 0, len(l.header))
+	for k := range l.header {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	size := 0
+	for _, k := range keys {
+		if l.redact[k] {
+			enc.AddString(k, "REDACTED")
+			continue
+		}
+		values := l.header[k]
+		for _, v := range values {
+			size += len(v)
+		}
+		if size > l.maxSize {
+			enc.AddBool("truncated", true)
+			return nil
+		}
+		enc.AddArray(k, zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+			for _, v := range values {
+				enc.AppendString(v)
+			}
+			return nil
+		}))
+	}
+	return nil
+}
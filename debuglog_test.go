@@ -0,0 +1,111 @@
+package clientproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daaku/ensure"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/http2"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	m := &Middleware{Secret: secret, DebugHeaders: &DebugHeaders{}}
+	provision(t, m)
+	core, logs := observer.New(zapcore.DebugLevel)
+	m.logger = zap.New(core)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Res", "res")
+	}))
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/path", nil)
+	ensure.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Req", "req")
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+
+	entries := logs.FilterMessage("upstream request").All()
+	ensure.DeepEqual(t, len(entries), 1)
+	fields := entries[0].ContextMap()
+	ensure.DeepEqual(t, fields["method"], http.MethodGet)
+	ensure.DeepEqual(t, fields["url"], "https:///path")
+	headers := fields["headers"].(map[string]any)
+	ensure.DeepEqual(t, headers["Authorization"], "REDACTED")
+	ensure.DeepEqual(t, headers["X-Req"], []any{"req"})
+
+	entries = logs.FilterMessage("upstream response").All()
+	ensure.DeepEqual(t, len(entries), 1)
+	fields = entries[0].ContextMap()
+	ensure.DeepEqual(t, fields["status"], int64(http.StatusOK))
+	headers = fields["headers"].(map[string]any)
+	ensure.DeepEqual(t, headers["Set-Cookie"], "REDACTED")
+	ensure.DeepEqual(t, headers["X-Res"], []any{"res"})
+}
+
+func TestDebugHeadersTruncated(t *testing.T) {
+	m := &Middleware{DebugHeaders: &DebugHeaders{MaxSize: 10, Redact: []string{"x-secret"}}}
+	m.redact = m.DebugHeaders.redacted()
+	enc := zapcore.NewMapObjectEncoder()
+	ensure.Nil(t, m.loggableHeader(http.Header{
+		"A":        {"12345"},
+		"B":        {"12345"},
+		"C":        {"1"},
+		"X-Secret": {strings.Repeat("x", 100)},
+	}).MarshalLogObject(enc))
+	ensure.DeepEqual(t, enc.Fields, map[string]any{
+		"A":         []any{"12345"},
+		"B":         []any{"12345"},
+		"truncated": true,
+	})
+}
+
+func TestDebugHeadersDisabledAllocs(t *testing.T) {
+	m := &Middleware{DebugHeaders: &DebugHeaders{}}
+	core, _ := observer.New(zapcore.InfoLevel)
+	m.logger = zap.New(core)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Req", "req")
+	ensure.DeepEqual(t, testing.AllocsPerRun(100, func() { m.logRequest(r) }), 0.0)
+}
+
+func TestDebugToken(t *testing.T) {
+	m := &Middleware{Secret: secret, DebugToken: "trace_me"}
+	provision(t, m)
+	core, logs := observer.New(zapcore.InfoLevel)
+	m.logger = zap.New(core)
+	s := newServer(t, m)
+	send := func() {
+		req, err := http.NewRequest(http.MethodGet, s.URL+"/path", nil)
+		ensure.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		res.Body.Close()
+	}
+
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Client-Proxy-Debug": {"trace_me"}}, http.HandlerFunc(hello))
+	ensure.True(t, m.status().Client.Verbose)
+	send()
+	entries := logs.FilterMessage("upstream request").All()
+	ensure.DeepEqual(t, len(entries), 1)
+	fields := entries[0].ContextMap()
+	ensure.DeepEqual(t, fields["url"], "https:///path")
+	ensure.DeepEqual(t, fields["headers"].(map[string]any)["Authorization"], "REDACTED")
+	ensure.DeepEqual(t, logs.FilterMessage("upstream response").Len(), 1)
+
+	// other clients are not logged
+	connect(t, m, s, http.HandlerFunc(hello))
+	send()
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Client-Proxy-Debug": {"guess"}}, http.HandlerFunc(hello))
+	ensure.False(t, m.status().Client.Verbose)
+	send()
+	ensure.DeepEqual(t, logs.FilterMessage("upstream request").Len(), 1)
+	ensure.DeepEqual(t, logs.FilterMessage("ignoring invalid X-Client-Proxy-Debug").Len(), 1)
+}
@@ -0,0 +1,134 @@
+package clientproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DialAuthority is the authority of the CONNECT requests sent to the client to
+// open a stream using Dial. Clients accepting such streams should handle
+// CONNECT requests for it by responding with a 200, and then treating the
+// request and response bodies as the connection.
+const DialAuthority = "client-proxy.dial:0"
+
+// Dial opens a stream to the client connected to the named client_proxy
+// handler, and returns it as a net.Conn. This lets other Caddy apps push
+// connections through the registered client. The context only bounds opening
+// the stream.
+//
+// The returned connection does not support deadlines.
+func Dial(ctx context.Context, name string) (net.Conn, error) {
+	m := registry.get(name)
+	if m == nil {
+		return nil, fmt.Errorf("client_proxy: unknown client_proxy: %s", name)
+	}
+	h := m.handler.Load()
+	if h == nil {
+		return nil, fmt.Errorf("client_proxy: %w: %s", ErrNoClient, name)
+	}
+	c, err := h.openStream(ctx, DialAuthority, tunnelAddr(name))
+	if err != nil {
+		return nil, fmt.Errorf("client_proxy: dial %s: %w", name, err)
+	}
+	return c, nil
+}
+
+// statusError is a stream rejected by the client with a status.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", int(e))
+}
+
+// openStream sends a CONNECT request for authority to the client, returning
+// the stream once it responds with a 200. The context only bounds opening the
+// stream.
+func (h *handler) openStream(ctx context.Context, authority string, addr net.Addr) (*streamConn, error) {
+	// the stream outlives ctx
+	sctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+	pr, pw := io.Pipe()
+	req := (&http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Host: authority},
+		Host:          authority,
+		Header:        make(http.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}).WithContext(sctx)
+	res, err := h.conn.RoundTrip(req)
+	if err != nil {
+		cancel()
+		pw.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		cancel()
+		pw.Close()
+		res.Body.Close()
+		return nil, statusError(res.StatusCode)
+	}
+	return &streamConn{w: pw, r: res.Body, cancel: cancel, addr: addr}, nil
+}
+
+// DialFunc returns a function with the signature of net.Dialer.DialContext
+// that dials the named client_proxy handler using Dial, ignoring the network
+// and address.
+func DialFunc(name string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return Dial(ctx, name)
+	}
+}
+
+// streamConn is a stream opened by openStream.
+type streamConn struct {
+	w      *io.PipeWriter
+	r      io.ReadCloser
+	cancel context.CancelFunc
+	addr   net.Addr
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// CloseWrite ends the request body, leaving the response readable.
+func (c *streamConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.w.Close()
+	err := c.r.Close()
+	c.cancel()
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.addr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *streamConn) SetDeadline(time.Time) error      { return errors.ErrUnsupported }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return errors.ErrUnsupported }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return errors.ErrUnsupported }
+
+// tunnelAddr is the address of streams to the client connected to the named
+// handler.
+type tunnelAddr string
+
+func (tunnelAddr) Network() string  { return "client_proxy" }
+func (a tunnelAddr) String() string { return string(a) }
+
+// Interface guards
+var (
+	_ net.Conn = (*streamConn)(nil)
+	_ net.Addr = tunnelAddr("")
+)
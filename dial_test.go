@@ -0,0 +1,89 @@
+package clientproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+// echoStreams echoes the streams opened by Dial, responding with hello to
+// other requests.
+func echoStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect || r.Host != DialAuthority {
+		hello(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	b := make([]byte, 1024)
+	for {
+		n, err := r.Body.Read(b)
+		if n > 0 {
+			w.Write(b[:n])
+			rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "dial_app"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(echoStreams))
+
+	conn, err := DialFunc("dial_app")(context.Background(), "tcp", "ignored:1")
+	ensure.Nil(t, err)
+	defer conn.Close()
+	ensure.DeepEqual(t, conn.RemoteAddr().String(), "dial_app")
+	ensure.True(t, errors.Is(conn.SetDeadline(time.Time{}), errors.ErrUnsupported))
+	for _, msg := range []string{"ping", "pong"} {
+		_, err = io.WriteString(conn, msg)
+		ensure.Nil(t, err)
+		b := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, b)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, string(b), msg)
+	}
+
+	// the HTTP proxy keeps working alongside streams
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+}
+
+func TestDialVisitorConnect(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(echoStreams))
+	req, err := http.NewRequest(http.MethodConnect, s.URL, nil)
+	ensure.Nil(t, err)
+	req.Host = DialAuthority
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+}
+
+func TestDialErrors(t *testing.T) {
+	_, err := Dial(context.Background(), "dial_unknown")
+	ensure.Err(t, err, regexp.MustCompile("unknown client_proxy: dial_unknown"))
+
+	m := &Middleware{Secret: secret, Name: "dial_none"}
+	provision(t, m)
+	_, err = Dial(context.Background(), "dial_none")
+	ensure.Err(t, err, regexp.MustCompile("no client connected: dial_none"))
+
+	s := newServer(t, m)
+	connect(t, m, s, http.NotFoundHandler())
+	_, err = Dial(context.Background(), "dial_none")
+	ensure.Err(t, err, regexp.MustCompile("unexpected status 404"))
+}
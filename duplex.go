@@ -0,0 +1,38 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// uploadBody ends the request body early, once the client has responded.
+type uploadBody struct {
+	io.ReadCloser
+	stopped atomic.Bool
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if b.stopped.Load() {
+		return 0, io.EOF
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// Close leaves the remaining body to the server once stopped, as closing would
+// wait for the rest of it.
+func (b *uploadBody) Close() error {
+	if b.stopped.Load() {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// abortUpload ends the remaining upload once the response from the client
+// arrives. A read already waiting on the downstream completes first.
+func abortUpload(res *http.Response) error {
+	if b, ok := res.Request.Body.(*uploadBody); ok {
+		b.stopped.Store(true)
+	}
+	return nil
+}
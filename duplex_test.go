@@ -0,0 +1,101 @@
+package clientproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+// earlyResponse responds after the first read of the body, and finishes once
+// the body ends.
+func earlyResponse(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1024)
+	n, _ := r.Body.Read(buf)
+	fmt.Fprintln(w, "early")
+	w.(http.Flusher).Flush()
+	rest, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "done:%d", n+len(rest))
+}
+
+// visitors returns a HTTP/1 and a HTTP/2 visitor of m, which has a client
+// serving h connected.
+func visitors(t *testing.T, m *Middleware, h http.Handler) map[string]func(*http.Request) (*http.Response, error) {
+	connect(t, m, newServer(t, m), h)
+	h1 := newServer(t, m)
+	h2 := newUnstartedServer(m)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+	return map[string]func(*http.Request) (*http.Response, error){
+		"h1": func(r *http.Request) (*http.Response, error) {
+			r.URL.Scheme, r.URL.Host = "http", h1.Listener.Addr().String()
+			return h1.Client().Do(r)
+		},
+		"h2": func(r *http.Request) (*http.Response, error) {
+			r.URL.Scheme, r.URL.Host = "https", h2.Listener.Addr().String()
+			res, err := h2.Client().Do(r)
+			if err == nil && res.ProtoMajor != 2 {
+				t.Errorf("expected HTTP/2, got %s", res.Proto)
+			}
+			return res, err
+		},
+	}
+}
+
+func TestFullDuplex(t *testing.T) {
+	for name, do := range visitors(t, newMiddleware(t), http.HandlerFunc(earlyResponse)) {
+		t.Run(name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			go pw.Write([]byte("first"))
+			req := httptest.NewRequest(http.MethodPost, "/", pr)
+			req.RequestURI = ""
+			res, err := do(req)
+			ensure.Nil(t, err)
+			defer res.Body.Close()
+			br := bufio.NewReader(res.Body)
+			line, err := br.ReadString('\n')
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, line, "early\n")
+			// the upload continues after the response started
+			_, err = pw.Write([]byte("second"))
+			ensure.Nil(t, err)
+			pw.Close()
+			rest, err := io.ReadAll(br)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, string(rest), "done:11")
+		})
+	}
+}
+
+func TestAbortUploadOnResponse(t *testing.T) {
+	m := &Middleware{Secret: secret, AbortUploadOnResponse: true}
+	provision(t, m)
+	for name, do := range visitors(t, m, http.HandlerFunc(earlyResponse)) {
+		t.Run(name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			go pw.Write([]byte("first"))
+			req := httptest.NewRequest(http.MethodPost, "/", pr)
+			req.RequestURI = ""
+			res, err := do(req)
+			ensure.Nil(t, err)
+			defer res.Body.Close()
+			br := bufio.NewReader(res.Body)
+			line, err := br.ReadString('\n')
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, line, "early\n")
+			// the read already waiting completes, and the upload then ends
+			// even though the visitor never finishes it
+			go pw.Write([]byte("second"))
+			rest, err := io.ReadAll(br)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, string(rest), "done:11")
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package clientproxy
+
+import "errors"
+
+// The errors returned by the handler, its registrations and Dial wrap these,
+// so they can be told apart using errors.Is.
+var (
+	// ErrNoClient is wrapped when no client that would serve a request or
+	// stream is connected.
+	ErrNoClient = errors.New("no client connected")
+
+	// ErrNotHTTP1 is wrapped when a registration cannot be hijacked, as it
+	// did not use HTTP/1.1.
+	ErrNotHTTP1 = errors.New("must connect using HTTP/1.1")
+
+	// ErrUpgradeFailed is wrapped when the connection of a hijacked
+	// registration could not be turned into a tunnel, including when the
+	// client did not complete the HTTP/2 handshake.
+	ErrUpgradeFailed = errors.New("upgrade failed")
+
+	// ErrRegistrationRejected is wrapped when the configuration does not allow
+	// a registration, like a host it claims, or on_accept refusing it.
+	ErrRegistrationRejected = errors.New("registration rejected")
+
+	// ErrShuttingDown is wrapped when the handler is shutting down.
+	ErrShuttingDown = errors.New("shutting down")
+)
+
+// sentinelError makes err match sentinel, keeping the message of err.
+type sentinelError struct {
+	sentinel error
+	err      error
+}
+
+func (e *sentinelError) Error() string   { return e.err.Error() }
+func (e *sentinelError) Unwrap() []error { return []error{e.sentinel, e.err} }
+
+// withSentinel returns err, also matching sentinel with errors.Is.
+func withSentinel(sentinel, err error) error {
+	return &sentinelError{sentinel: sentinel, err: err}
+}
@@ -0,0 +1,51 @@
+package clientproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+)
+
+func TestErrors(t *testing.T) {
+	m := &Middleware{
+		Secret:           secret,
+		Name:             "errors",
+		AllowedHosts:     []string{"a.example.com"},
+		RejectOnShutdown: true,
+	}
+	provision(t, m)
+
+	// a recorder cannot be hijacked, as if HTTP/1.1 was not used
+	err := m.ServeHTTP(httptest.NewRecorder(), registration(secret), nil)
+	ensure.True(t, errors.Is(err, ErrNotHTTP1), err)
+
+	r := registration(secret)
+	r.Header.Set("X-Client-Proxy-Hosts", "b.example.com")
+	err = m.ServeHTTP(httptest.NewRecorder(), r, nil)
+	ensure.True(t, errors.Is(err, ErrRegistrationRejected), err)
+	var herr caddyhttp.HandlerError
+	ensure.True(t, errors.As(err, &herr))
+	ensure.DeepEqual(t, herr.Err.Error(), "client_proxy: host not allowed: b.example.com")
+
+	server, client := net.Pipe()
+	defer client.Close()
+	errc := register(t, m, &failFirstWrite{Conn: server})
+	_, _ = http.ReadResponse(bufio.NewReader(client), nil)
+	err = <-errc
+	ensure.True(t, errors.Is(err, ErrUpgradeFailed), err)
+
+	_, err = Dial(context.Background(), "errors")
+	ensure.True(t, errors.Is(err, ErrNoClient), err)
+	ensure.True(t, errors.Is(NoClientError{Tunnel: "errors"}, ErrNoClient))
+
+	ensure.Nil(t, m.Cleanup())
+	err = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	ensure.True(t, errors.Is(err, ErrShuttingDown), err)
+}
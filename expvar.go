@@ -0,0 +1,47 @@
+package clientproxy
+
+import (
+	"expvar"
+	"sync"
+)
+
+var publishExpvar sync.Once
+
+// expvarStats are the counters published for an instance label.
+type expvarStats struct {
+	Connected uint64 `json:"connected"`
+	Requests  uint64 `json:"requests"`
+	Failures  uint64 `json:"failures"`
+}
+
+// initExpvar publishes the client_proxy expvar. It is computed from the
+// registry when read, so handlers replaced by a config reload need no
+// bookkeeping.
+func initExpvar() {
+	publishExpvar.Do(func() {
+		expvar.Publish("client_proxy", expvar.Func(expvarValue))
+	})
+}
+
+// expvarValue sums the counters of the handlers with expvar enabled, by
+// instance label.
+func expvarValue() any {
+	stats := map[string]*expvarStats{}
+	for _, m := range registry.all() {
+		if !m.Expvar {
+			continue
+		}
+		label := m.instanceLabel()
+		s := stats[label]
+		if s == nil {
+			s = new(expvarStats)
+			stats[label] = s
+		}
+		if m.handler.Load() != nil {
+			s.Connected++
+		}
+		s.Requests += m.counters.requests.Load()
+		s.Failures += m.counters.failures.Load()
+	}
+	return stats
+}
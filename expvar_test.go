@@ -0,0 +1,42 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func readExpvar(t testing.TB) map[string]expvarStats {
+	v := expvar.Get("client_proxy")
+	ensure.NotNil(t, v)
+	var stats map[string]expvarStats
+	ensure.Nil(t, json.Unmarshal([]byte(v.String()), &stats))
+	return stats
+}
+
+func TestExpvar(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "expvar_app", Expvar: true}
+	provision(t, m)
+	provision(t, &Middleware{Secret: secret, Name: "expvar_hidden"})
+	s := newServer(t, m)
+	ensure.DeepEqual(t, readExpvar(t)["expvar_app"], expvarStats{})
+
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			panic(http.ErrAbortHandler)
+		}
+		hello(w, r)
+	}))
+	get(t, s, "/")
+	get(t, s, "/")
+	res, _ := get(t, s, "/fail")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+
+	stats := readExpvar(t)
+	ensure.DeepEqual(t, stats["expvar_app"], expvarStats{Connected: 1, Requests: 3, Failures: 1})
+	_, found := stats["expvar_hidden"]
+	ensure.False(t, found)
+}
@@ -0,0 +1,126 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// validateFallbackUpstream checks the fallback_upstream is an http or https
+// URL.
+func validateFallbackUpstream(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid fallback_upstream: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("fallback_upstream must be an http or https URL, got %s", v)
+	}
+	return nil
+}
+
+// countFallback records r being served by fallback, next, upstream or
+// redirect, as no client is connected.
+func (m *Middleware) countFallback(r *http.Request, fallback string) {
+	m.counters.fallbacks.Add(1)
+	switch fallback {
+	case "upstream":
+		m.metrics.fallbackUpstream.Inc()
+	case "redirect":
+		m.metrics.fallbackRedirect.Inc()
+	default:
+		m.metrics.fallbackNext.Inc()
+	}
+	m.logger.Debug("no client connected, using fallback",
+		zap.String("uri", r.RequestURI),
+		zap.String("fallback", fallback))
+}
+
+// newFallbackProxy returns the ReverseProxy for the fallback_upstream. Like
+// requests forwarded to the client, the Host is kept unless preserve_host is
+// false.
+func (m *Middleware) newFallbackProxy() (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(m.FallbackUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback_upstream: %w", err)
+	}
+	preserveHost := m.PreserveHost == nil || *m.PreserveHost
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			if preserveHost {
+				r.Out.Host = r.In.Host
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			m.logger.Debug("fallback_upstream error",
+				zap.String("uri", r.RequestURI),
+				zap.Error(err))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// OfflineRedirect redirects requests arriving while no client is connected.
+type OfflineRedirect struct {
+	// The absolute URL to redirect to, like a status page.
+	URL string `json:"url"`
+
+	// The status to redirect with, 302 or 307. A 307 keeps the method and
+	// body of the request. Defaults to 302.
+	Status int `json:"status,omitempty"`
+
+	// Append the path and query of the request to the URL.
+	PreservePath bool `json:"preserve_path,omitempty"`
+}
+
+func (o *OfflineRedirect) validate() error {
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return fmt.Errorf("invalid offline_redirect: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("offline_redirect must be an http or https URL, got %s", o.URL)
+	}
+	switch o.Status {
+	case 0, http.StatusFound, http.StatusTemporaryRedirect:
+	default:
+		return fmt.Errorf("offline_redirect status must be 302 or 307, got %d", o.Status)
+	}
+	return nil
+}
+
+// location returns where r is redirected to.
+func (o *OfflineRedirect) location(r *http.Request) string {
+	if !o.PreservePath {
+		return o.URL
+	}
+	// validated before
+	u, _ := url.Parse(o.URL)
+	// joined escaped, keeping encoded slashes
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + r.URL.EscapedPath()
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = r.URL.RawQuery
+	case r.URL.RawQuery != "":
+		u.RawQuery += "&" + r.URL.RawQuery
+	}
+	return u.String()
+}
+
+// serve redirects r. Responses are not cached, as the client may register
+// again at any time.
+func (o *OfflineRedirect) serve(w http.ResponseWriter, r *http.Request) {
+	status := o.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, o.location(r), status)
+}
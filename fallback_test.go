@@ -0,0 +1,148 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestFallbackUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "fallback %s %s", r.Host, r.RequestURI)
+	}))
+	t.Cleanup(upstream.Close)
+	m := &Middleware{Secret: secret, FallbackUpstream: upstream.URL}
+	provision(t, m)
+	s := newServer(t, m)
+	host := s.Listener.Addr().String()
+
+	res, body := get(t, s, "/a?b=1")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "fallback "+host+" /a?b=1")
+
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	_, body = get(t, s, "/a")
+	ensure.DeepEqual(t, body, "hello")
+
+	conn.Close()
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	_, body = get(t, s, "/a")
+	ensure.DeepEqual(t, body, "fallback "+host+" /a")
+}
+
+func TestFallbackUpstreamHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	t.Cleanup(upstream.Close)
+	m := &Middleware{Secret: secret, FallbackUpstream: upstream.URL, PreserveHost: new(bool)}
+	provision(t, m)
+	_, body := get(t, newServer(t, m), "/")
+	ensure.DeepEqual(t, body, upstream.Listener.Addr().String())
+}
+
+func TestFallbackUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	m := &Middleware{Secret: secret, FallbackUpstream: upstream.URL}
+	provision(t, m)
+	res, _ := get(t, newServer(t, m), "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+}
+
+func TestFallbackUpstreamInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, FallbackUpstream: "/relative"}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("fallback_upstream must be an http or https URL"))
+}
+
+func TestFallbackRequests(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "fallback_next"}
+	provision(t, m)
+	s := newServer(t, m)
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+	connect(t, m, s, http.HandlerFunc(hello))
+	get(t, s, "/")
+	ensure.DeepEqual(t, m.status().Counters.FallbackRequests, uint64(1))
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_fallback_requests_total", "fallback", "next"), 1.0)
+
+	upstream := httptest.NewServer(http.HandlerFunc(hello))
+	t.Cleanup(upstream.Close)
+	m = &Middleware{Secret: secret, Name: "fallback_upstream", FallbackUpstream: upstream.URL}
+	provision(t, m)
+	s = newServer(t, m)
+	get(t, s, "/")
+	get(t, s, "/")
+	connect(t, m, s, http.HandlerFunc(hello))
+	get(t, s, "/")
+	ensure.DeepEqual(t, m.status().Counters.FallbackRequests, uint64(2))
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_fallback_requests_total", "fallback", "upstream"), 2.0)
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_fallback_requests_total", "fallback", "next"), 0.0)
+}
+
+// noRedirect is a client that does not follow redirects.
+var noRedirect = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func TestOfflineRedirect(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "offline_redirect", OfflineRedirect: &OfflineRedirect{
+		URL: "https://status.example.com/down",
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	redirect := func(path string) (int, string) {
+		res, err := noRedirect.Get(s.URL + path)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		return res.StatusCode, res.Header.Get("Location")
+	}
+
+	status, location := redirect("/a?b=1")
+	ensure.DeepEqual(t, status, http.StatusFound)
+	ensure.DeepEqual(t, location, "https://status.example.com/down")
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_fallback_requests_total", "fallback", "redirect"), 1.0)
+
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	res, body := get(t, s, "/a")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+
+	conn.Close()
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	m.OfflineRedirect.Status = http.StatusTemporaryRedirect
+	m.OfflineRedirect.PreservePath = true
+	status, location = redirect("/a%2Fb/c?d=1")
+	ensure.DeepEqual(t, status, http.StatusTemporaryRedirect)
+	ensure.DeepEqual(t, location, "https://status.example.com/down/a%2Fb/c?d=1")
+	ensure.DeepEqual(t, m.status().Counters.FallbackRequests, uint64(2))
+}
+
+func TestOfflineRedirectLocation(t *testing.T) {
+	cases := []struct {
+		url, request, want string
+	}{
+		{"https://b.example.com", "/", "https://b.example.com/"},
+		{"https://b.example.com/", "/a/", "https://b.example.com/a/"},
+		{"https://b.example.com/x/", "/a?b=1", "https://b.example.com/x/a?b=1"},
+		{"https://b.example.com/?from=a", "/a?b=1", "https://b.example.com/a?from=a&b=1"},
+		{"https://b.example.com/?from=a", "/a", "https://b.example.com/a?from=a"},
+	}
+	for _, c := range cases {
+		o := &OfflineRedirect{URL: c.url, PreservePath: true}
+		ensure.DeepEqual(t, o.location(httptest.NewRequest(http.MethodGet, c.request, nil)), c.want, c.url, c.request)
+	}
+}
+
+func TestOfflineRedirectInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, OfflineRedirect: &OfflineRedirect{URL: "/relative"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("offline_redirect must be an http or https URL"))
+	m = &Middleware{Secret: secret, OfflineRedirect: &OfflineRedirect{URL: "https://b.example.com", Status: 301}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("offline_redirect status must be 302 or 307, got 301"))
+	m = &Middleware{Secret: secret, FallbackUpstream: "https://b.example.com", OfflineRedirect: &OfflineRedirect{URL: "https://b.example.com"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("only one of fallback_upstream and offline_redirect"))
+}
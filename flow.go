@@ -0,0 +1,95 @@
+package clientproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// initialWindowSize is the flow-control window of a connection before any
+// WINDOW_UPDATE, as specified in RFC 9113 section 6.9.2.
+const initialWindowSize = 65535
+
+// flowConn estimates the connection flow-control windows from the frames
+// written to and read from the client, as the ClientConn does not expose them.
+// Only frame headers and WINDOW_UPDATE payloads are looked at. Reads are only
+// made by the ClientConn read loop, and writes while holding its write lock,
+// so each scanner is used by one goroutine at a time.
+type flowConn struct {
+	net.Conn
+	out, in frameScanner
+
+	// the bytes the client may still send, and those we may still send it
+	recv, send atomic.Int64
+}
+
+func newFlowConn(conn net.Conn) *flowConn {
+	c := &flowConn{Conn: conn}
+	// the ClientConn starts with the connection preface, which is not a frame
+	c.out.skip = len(http2.ClientPreface)
+	c.recv.Store(initialWindowSize)
+	c.send.Store(initialWindowSize)
+	return c
+}
+
+func (c *flowConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.scan(p[:n], &c.recv, &c.send)
+	return n, err
+}
+
+func (c *flowConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.scan(p[:n], &c.send, &c.recv)
+	return n, err
+}
+
+// frameScanner follows the frames of one direction of a connection, across
+// reads or writes splitting them arbitrarily.
+type frameScanner struct {
+	skip      int // bytes of the current payload, or the preface, left
+	header    [9]byte
+	headerLen int
+	update    []byte // the increment of a connection WINDOW_UPDATE being read
+}
+
+// scan consumes p, taking DATA payloads from used, and adding connection
+// WINDOW_UPDATE increments to granted, the window of the other direction.
+func (s *frameScanner) scan(p []byte, used, granted *atomic.Int64) {
+	for len(p) > 0 {
+		if s.skip > 0 {
+			n := min(s.skip, len(p))
+			if s.update != nil {
+				s.update = append(s.update, p[:min(n, 4-len(s.update))]...)
+				if len(s.update) == 4 {
+					granted.Add(int64(binary.BigEndian.Uint32(s.update) & (1<<31 - 1)))
+					s.update = nil
+				}
+			}
+			s.skip -= n
+			p = p[n:]
+			continue
+		}
+		n := copy(s.header[s.headerLen:], p)
+		s.headerLen += n
+		p = p[n:]
+		if s.headerLen < len(s.header) {
+			return
+		}
+		s.headerLen = 0
+		length := int(s.header[0])<<16 | int(s.header[1])<<8 | int(s.header[2])
+		stream := binary.BigEndian.Uint32(s.header[5:]) & (1<<31 - 1)
+		switch http2.FrameType(s.header[3]) {
+		case http2.FrameData:
+			// padding counts against the window too
+			used.Add(-int64(length))
+		case http2.FrameWindowUpdate:
+			if stream == 0 && length == 4 {
+				s.update = make([]byte, 0, 4)
+			}
+		}
+		s.skip = length
+	}
+}
@@ -0,0 +1,49 @@
+package clientproxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+func TestFrameScanner(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&buf, nil)
+	ensure.Nil(t, fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20}))
+	ensure.Nil(t, fr.WriteWindowUpdate(0, 1000))
+	ensure.Nil(t, fr.WriteWindowUpdate(1, 5000)) // streams are not followed
+	ensure.Nil(t, fr.WriteData(1, false, []byte(strings.Repeat("x", 300))))
+	ensure.Nil(t, fr.WriteDataPadded(3, true, []byte("hello"), make([]byte, 10)))
+	ensure.Nil(t, fr.WriteWindowUpdate(0, 24))
+
+	// frames are split arbitrarily across writes
+	var s frameScanner
+	s.skip = len(http2.ClientPreface)
+	var used, granted atomic.Int64
+	for _, b := range buf.Bytes() {
+		s.scan([]byte{b}, &used, &granted)
+	}
+	ensure.DeepEqual(t, granted.Load(), int64(1024))
+	// the padded frame also carries its pad length
+	ensure.DeepEqual(t, used.Load(), -int64(300+1+5+10))
+}
+
+func TestFlowWindows(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 1000))
+	}))
+	get(t, s, "/")
+	h := m.handler.Load()
+	// both sides grant more than the initial window once connected
+	eventually(t, func() bool {
+		return h.flow.recv.Load() > initialWindowSize && h.flow.send.Load() > initialWindowSize
+	})
+}
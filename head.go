@@ -0,0 +1,13 @@
+package clientproxy
+
+import "net/http"
+
+// stripHeadBody drops any body the client sent in response to a HEAD request,
+// which must not have one. The headers, including Content-Length, are kept.
+func stripHeadBody(res *http.Response) error {
+	if res.Request.Method == http.MethodHead && res.Body != http.NoBody {
+		res.Body.Close()
+		res.Body = http.NoBody
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestHeadBodyStripped(t *testing.T) {
+	m := newMiddleware(t)
+	var closed bool
+	proxy := m.newProxy(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		// a misbehaving client sending a body for HEAD
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Length": {"5"}},
+			ContentLength: 5,
+			Body:          closeFunc{Reader: strings.NewReader("hello"), close: func() { closed = true }},
+			Request:       r,
+		}, nil
+	}), "example.com")
+	for method, body := range map[string]string{http.MethodHead: "", http.MethodGet: "hello"} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		ensure.DeepEqual(t, w.Code, http.StatusOK, method)
+		ensure.DeepEqual(t, w.Body.String(), body, method)
+		ensure.DeepEqual(t, w.Header().Get("Content-Length"), "5", method)
+		ensure.True(t, closed, method)
+		closed = false
+	}
+}
+
+type closeFunc struct {
+	io.Reader
+	close func()
+}
+
+func (c closeFunc) Close() error {
+	c.close()
+	return nil
+}
@@ -0,0 +1,88 @@
+package clientproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/net/http2"
+)
+
+// maxRegistrationHeaderSize bounds the size of the X-Client-Proxy headers
+// of registrations, which are kept for the lifetime of the client.
+const maxRegistrationHeaderSize = 8 << 10
+
+// headerSize returns the size of the fields of h accepted by match, as they
+// would be serialized in HTTP/1, along with their count.
+func headerSize(h http.Header, match func(name string) bool) (size, count int) {
+	for name, values := range h {
+		if !match(name) {
+			continue
+		}
+		for _, v := range values {
+			// name: value\r\n
+			size += len(name) + len(v) + 4
+			count++
+		}
+	}
+	return size, count
+}
+
+// isResponseHeaderTooLarge reports if err is the transport rejecting a
+// response whose headers exceed its MaxHeaderListSize. The transport resets
+// the stream with an unexported cause, so it is told apart from the client
+// resetting it by its message.
+func isResponseHeaderTooLarge(err error) bool {
+	var se http2.StreamError
+	return errors.As(err, &se) && se.Cause != nil &&
+		se.Cause.Error() == "http2: response header list larger than advertised limit"
+}
+
+// echoTag makes p set the X-Client-Proxy-Tag header of its responses to tag,
+// replacing any the client sent.
+func echoTag(p *httputil.ReverseProxy, tag string) {
+	modify := p.ModifyResponse
+	p.ModifyResponse = func(res *http.Response) error {
+		if modify != nil {
+			if err := modify(res); err != nil {
+				return err
+			}
+		}
+		res.Header.Set("X-Client-Proxy-Tag", tag)
+		return nil
+	}
+}
+
+// checkHeaderLimits rejects requests with more or larger header fields than
+// the client accepts, before a stream is opened for them.
+func (m *Middleware) checkHeaderLimits(r *http.Request) error {
+	if m.MaxRequestHeaderSize <= 0 && m.MaxRequestHeaderCount <= 0 {
+		return nil
+	}
+	size, count := headerSize(r.Header, func(string) bool { return true })
+	if m.MaxRequestHeaderSize > 0 && int64(size) > m.MaxRequestHeaderSize {
+		return caddyhttp.Error(http.StatusRequestHeaderFieldsTooLarge,
+			fmt.Errorf("client_proxy: request headers of %d bytes exceed limit of %d", size, m.MaxRequestHeaderSize))
+	}
+	if m.MaxRequestHeaderCount > 0 && count > m.MaxRequestHeaderCount {
+		return caddyhttp.Error(http.StatusRequestHeaderFieldsTooLarge,
+			fmt.Errorf("client_proxy: %d request header fields exceed limit of %d", count, m.MaxRequestHeaderCount))
+	}
+	return nil
+}
+
+// checkRegistrationHeaders rejects registrations with X-Client-Proxy headers
+// larger than maxRegistrationHeaderSize.
+func checkRegistrationHeaders(r *http.Request) error {
+	size, _ := headerSize(r.Header, func(name string) bool {
+		return strings.HasPrefix(name, "X-Client-Proxy")
+	})
+	if size > maxRegistrationHeaderSize {
+		return caddyhttp.Error(http.StatusRequestHeaderFieldsTooLarge,
+			fmt.Errorf("client_proxy: registration headers of %d bytes exceed limit of %d", size, maxRegistrationHeaderSize))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package clientproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	m := &Middleware{Secret: secret, MaxRequestHeaderSize: 100, MaxRequestHeaderCount: 3}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	status := func(extra http.Header) int {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		ensure.Nil(t, err)
+		// 15 and 20 bytes serialized
+		req.Header.Set("User-Agent", "t")
+		req.Header.Set("Accept-Encoding", "x")
+		for k, v := range extra {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// X-Pad takes 9 bytes and its value
+	ensure.DeepEqual(t, status(http.Header{"X-Pad": {strings.Repeat("a", 56)}}), http.StatusOK)
+	ensure.DeepEqual(t, status(http.Header{"X-Pad": {strings.Repeat("a", 57)}}),
+		http.StatusRequestHeaderFieldsTooLarge)
+	ensure.DeepEqual(t, status(http.Header{"Cookie": {strings.Repeat("a", 57)}}),
+		http.StatusRequestHeaderFieldsTooLarge)
+	ensure.DeepEqual(t, status(http.Header{"X-Pad": {"a"}}), http.StatusOK)
+	ensure.DeepEqual(t, status(http.Header{"X-Pad": {"a", "b"}}), http.StatusRequestHeaderFieldsTooLarge)
+}
+
+func TestRegistrationHeaderLimit(t *testing.T) {
+	m := newMiddleware(t)
+	register := func(hosts int) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Client-Proxy", secret)
+		// X-Client-Proxy-Hosts takes 24 bytes and its value
+		r.Header.Set("X-Client-Proxy-Hosts", strings.Repeat("a", hosts))
+		err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var herr caddyhttp.HandlerError
+		if errors.As(err, &herr) {
+			return herr.StatusCode
+		}
+		return 0
+	}
+	limit := maxRegistrationHeaderSize - len("X-Client-Proxy") - len(secret) - 4 - 24
+	// within the limit, registration fails later, as the recorder cannot be
+	// hijacked
+	ensure.True(t, register(limit) != http.StatusRequestHeaderFieldsTooLarge)
+	ensure.DeepEqual(t, register(limit+1), http.StatusRequestHeaderFieldsTooLarge)
+}
+
+func TestResponseHeaderLimit(t *testing.T) {
+	m := &Middleware{Secret: secret, MaxResponseHeaderBytes: 1 << 10, StreamResetStatus: http.StatusServiceUnavailable}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fields of 100 bytes, or a single one of size
+		n, _ := strconv.Atoi(r.URL.Query().Get("fields"))
+		for i := range n {
+			w.Header().Set("X-Pad-"+strconv.Itoa(i), strings.Repeat("a", 100))
+		}
+		if size, _ := strconv.Atoi(r.URL.Query().Get("size")); size > 0 {
+			w.Header().Set("X-Pad", strings.Repeat("a", size))
+		}
+		hello(w, r)
+	}))
+	res, body := get(t, s, "/?fields=5")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+	res, _ = get(t, s, "/?fields=20")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway, "not a stream reset by the client")
+	ensure.DeepEqual(t, m.status().Counters.StreamResets, uint64(0))
+	res, _ = get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+
+	// a single field beyond the limit cannot be decoded, which ends the
+	// connection
+	res, _ = get(t, s, "/?size=2048")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+	eventually(t, func() bool { return m.handler.Load() == nil })
+}
+
+func TestEchoTag(t *testing.T) {
+	tagged := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client-Proxy-Tag", "spoofed")
+		hello(w, r)
+	})
+	header := http.Header{"X-Client-Proxy-Tag": {"eu-1"}}
+
+	m := &Middleware{Secret: secret, EchoTag: true}
+	provision(t, m)
+	s := newServer(t, m)
+	connectWith(t, m, s, &http2.Server{}, header, tagged)
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+	ensure.DeepEqual(t, res.Header.Values("X-Client-Proxy-Tag"), []string{"eu-1"})
+	ensure.DeepEqual(t, m.status().Client.Tag, "eu-1")
+
+	// without a tag, the response of the client is kept
+	connect(t, m, s, tagged)
+	res, _ = get(t, s, "/")
+	ensure.DeepEqual(t, res.Header.Get("X-Client-Proxy-Tag"), "spoofed")
+
+	// only echoed when configured
+	other := newMiddleware(t)
+	otherServer := newServer(t, other)
+	connectWith(t, other, otherServer, &http2.Server{}, header, http.HandlerFunc(hello))
+	res, _ = get(t, otherServer, "/")
+	ensure.DeepEqual(t, res.Header.Get("X-Client-Proxy-Tag"), "")
+	ensure.DeepEqual(t, other.status().Client.Tag, "")
+}
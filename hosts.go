@@ -0,0 +1,50 @@
+package clientproxy
+
+import (
+	"net"
+	"strings"
+)
+
+// parseHosts parses a comma separated list of host names.
+func parseHosts(v string) []string {
+	var hosts []string
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// hostMatches reports if host matches the pattern, which is either an exact
+// name or a wildcard like *.example.com matching a single label.
+func hostMatches(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, ok := strings.CutSuffix(host, suffix)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// matchesAny reports if host matches any of the patterns.
+func matchesAny(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if hostMatches(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lower cased host without the port.
+func requestHost(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(host)
+}
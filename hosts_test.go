@@ -0,0 +1,37 @@
+package clientproxy
+
+import (
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestHostMatches(t *testing.T) {
+	cases := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "a.example.com", false},
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "*.example.com", true},
+		{"*example.com", "aexample.com", false},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, hostMatches(c.pattern, c.host), c.want, c.pattern, c.host)
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	ensure.DeepEqual(t, parseHosts(" A.example.com,, *.b.example.com "), []string{"a.example.com", "*.b.example.com"})
+	ensure.True(t, parseHosts("") == nil)
+}
+
+func TestRequestHost(t *testing.T) {
+	ensure.DeepEqual(t, requestHost("Example.com:443"), "example.com")
+	ensure.DeepEqual(t, requestHost("example.com"), "example.com")
+	ensure.DeepEqual(t, requestHost("[::1]:80"), "::1")
+}
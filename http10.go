@@ -0,0 +1,14 @@
+package clientproxy
+
+import "net/http"
+
+// closeHTTP10 closes the downstream connection after responses to HTTP/1.0
+// requests of unknown length. HTTP/1.0 has no chunked encoding, so such
+// responses end by closing the connection, and the visitor is told so even if
+// it asked for keep-alive. The tunnel itself is unaffected.
+func closeHTTP10(res *http.Response) error {
+	if !res.Request.ProtoAtLeast(1, 1) && res.ContentLength < 0 {
+		res.Header.Set("Connection", "close")
+	}
+	return nil
+}
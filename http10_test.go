@@ -0,0 +1,97 @@
+package clientproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+// get10 sends an HTTP/1.0 request on a new connection, returning the response
+// and whether the server closed the connection after it.
+func get10(t testing.TB, s *httptest.Server, path, header string) (*http.Response, string, bool) {
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: example.com\r\n%s\r\n", path, header)
+	ensure.Nil(t, err)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	ensure.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = br.ReadByte()
+	return res, string(body), err == io.EOF
+}
+
+func TestHTTP10(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// unknown length
+			fmt.Fprint(w, "hello")
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, " world")
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		fmt.Fprint(w, "hello")
+	}))
+
+	res, body, closed := get10(t, s, "/stream", "Connection: keep-alive\r\n")
+	ensure.DeepEqual(t, res.Proto, "HTTP/1.0")
+	ensure.DeepEqual(t, res.Header.Get("Connection"), "close")
+	ensure.DeepEqual(t, body, "hello world")
+	ensure.True(t, closed)
+
+	res, body, closed = get10(t, s, "/stream", "")
+	ensure.DeepEqual(t, res.Header.Get("Connection"), "close")
+	ensure.DeepEqual(t, body, "hello world")
+	ensure.True(t, closed)
+
+	res, body, closed = get10(t, s, "/", "Connection: keep-alive\r\n")
+	ensure.DeepEqual(t, res.Header.Get("Connection"), "keep-alive")
+	ensure.DeepEqual(t, body, "hello")
+	ensure.False(t, closed)
+}
+
+func TestMissingHost(t *testing.T) {
+	get := func(s *httptest.Server) *http.Response {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		ensure.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = fmt.Fprint(conn, "GET / HTTP/1.0\r\n\r\n")
+		ensure.Nil(t, err)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		ensure.Nil(t, err)
+		return res
+	}
+	client := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	})
+
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, client)
+	res := get(s)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadRequest)
+	ensure.DeepEqual(t, m.status().Counters.Requests, uint64(0))
+
+	m = &Middleware{Secret: secret, DefaultHost: "example.com"}
+	provision(t, m)
+	s = newServer(t, m)
+	connect(t, m, s, client)
+	res = get(s)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(body), "example.com")
+}
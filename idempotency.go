@@ -0,0 +1,179 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	defaultIdempotencyTTL        = 5 * time.Minute
+	defaultIdempotencyMaxEntries = 1000
+	defaultIdempotencyMaxSize    = 1 << 20
+)
+
+// Idempotency configures caching responses to requests carrying an
+// Idempotency-Key header, so repeating the request returns the response
+// instead of sending it to the client again.
+type Idempotency struct {
+	// How long responses are kept. Defaults to 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// The maximum number of responses kept. The oldest are dropped beyond
+	// this. Defaults to 1000.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// Responses larger than this many bytes are not kept. Defaults to 1MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Request headers that are part of the key, in addition to the
+	// Idempotency-Key, method, host and URI. Authorization and Cookie are
+	// always part of the key.
+	Headers []string `json:"headers,omitempty"`
+}
+
+func (i *Idempotency) validate() error {
+	if i.TTL < 0 {
+		return fmt.Errorf("idempotency_cache ttl must not be negative, got %s", time.Duration(i.TTL))
+	}
+	if i.MaxEntries < 0 {
+		return fmt.Errorf("idempotency_cache max_entries must not be negative, got %d", i.MaxEntries)
+	}
+	if i.MaxSize < 0 {
+		return fmt.Errorf("idempotency_cache max_size must not be negative, got %d", i.MaxSize)
+	}
+	return nil
+}
+
+// idempotencyCache holds the responses to requests with an Idempotency-Key.
+type idempotencyCache struct {
+	ttl        time.Duration
+	maxEntries int
+	maxSize    int64
+	headers    []string
+
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+	order   []*idempotentEntry // oldest first
+}
+
+// idempotentEntry is a request, whose response is available once done is
+// closed. res is nil if the response could not be kept.
+type idempotentEntry struct {
+	key     string
+	created time.Time
+	done    chan struct{}
+	res     *sharedResponse
+}
+
+func newIdempotencyCache(i *Idempotency) *idempotencyCache {
+	c := &idempotencyCache{
+		ttl:        time.Duration(i.TTL),
+		maxEntries: i.MaxEntries,
+		maxSize:    i.MaxSize,
+		headers:    append([]string{"Authorization", "Cookie"}, i.Headers...),
+		entries:    make(map[string]*idempotentEntry),
+	}
+	if c.ttl == 0 {
+		c.ttl = defaultIdempotencyTTL
+	}
+	if c.maxEntries == 0 {
+		c.maxEntries = defaultIdempotencyMaxEntries
+	}
+	if c.maxSize == 0 {
+		c.maxSize = defaultIdempotencyMaxSize
+	}
+	return c
+}
+
+func (c *idempotencyCache) key(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Header.Get("Idempotency-Key"))
+	sb.WriteByte('\n')
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.Host)
+	sb.WriteString(r.URL.RequestURI())
+	for _, h := range c.headers {
+		sb.WriteByte('\n')
+		sb.WriteString(h)
+		sb.WriteString(": ")
+		sb.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+// drop removes the entries older than ttl, and the oldest beyond maxEntries
+// including n more. It must be called with mu held.
+func (c *idempotencyCache) drop(now time.Time, n int) {
+	i := 0
+	for i < len(c.order) && (now.Sub(c.order[i].created) > c.ttl || len(c.order)-i+n > c.maxEntries) {
+		if e := c.order[i]; c.entries[e.key] == e {
+			delete(c.entries, e.key)
+		}
+		i++
+	}
+	c.order = c.order[i:]
+}
+
+// remove forgets e, unless it was already replaced. It must be called with mu
+// held.
+func (c *idempotencyCache) remove(e *idempotentEntry) {
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+}
+
+// serve sends r using next, unless a request with the same key was already
+// sent, in which case its response is returned with an Idempotent-Replayed
+// header, once it is complete. Responses that could not be kept, like those
+// with a 5xx status, are forgotten, so the request is sent again.
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := c.key(r)
+	now := time.Now()
+	c.mu.Lock()
+	c.drop(now, 0)
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return
+		}
+		if e.res == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// each replay gets its own copy, which later handlers may modify
+		for k, v := range e.res.header.Clone() {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(e.res.code)
+		w.Write(e.res.body)
+		return
+	}
+	c.drop(now, 1)
+	e := &idempotentEntry{key: key, created: now, done: make(chan struct{})}
+	c.entries[key] = e
+	c.order = append(c.order, e)
+	c.mu.Unlock()
+
+	rec := &recorder{ResponseWriter: w, max: c.maxSize}
+	defer func() {
+		if rec.complete && !rec.overflow && rec.code != 0 && rec.code < 500 {
+			e.res = &sharedResponse{code: rec.code, header: rec.header, body: rec.body.Bytes()}
+		} else {
+			c.mu.Lock()
+			c.remove(e)
+			c.mu.Unlock()
+		}
+		close(e.done)
+	}()
+	next.ServeHTTP(rec, r)
+	rec.complete = true
+}
@@ -0,0 +1,160 @@
+package clientproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+)
+
+// idempotentPost sends a POST to s with the Idempotency-Key, returning the
+// response and its body.
+func idempotentPost(t testing.TB, s *httptest.Server, url, key string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("charge"))
+	ensure.Nil(t, err)
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	res, err := s.Client().Do(req)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	return res, string(body)
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	m := &Middleware{Secret: secret, IdempotencyCache: &Idempotency{}}
+	provision(t, m)
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		status := http.StatusCreated
+		if r.URL.Path == "/fail" {
+			status = http.StatusInternalServerError
+		}
+		w.Header().Set("X-Call", fmt.Sprint(n))
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "call %d", n)
+	}))
+
+	res, body := idempotentPost(t, s, s.URL+"/charge", "k1")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusCreated)
+	ensure.DeepEqual(t, body, "call 1")
+	ensure.DeepEqual(t, res.Header.Get("Idempotent-Replayed"), "")
+
+	// the same key gets the same response, without calling the client
+	res, body = idempotentPost(t, s, s.URL+"/charge", "k1")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusCreated)
+	ensure.DeepEqual(t, body, "call 1")
+	ensure.DeepEqual(t, res.Header.Get("X-Call"), "1")
+	ensure.DeepEqual(t, res.Header.Get("Idempotent-Replayed"), "true")
+	ensure.DeepEqual(t, calls.Load(), int32(1))
+
+	// other keys, URIs, and requests without a key are sent
+	_, body = idempotentPost(t, s, s.URL+"/charge", "k2")
+	ensure.DeepEqual(t, body, "call 2")
+	_, body = idempotentPost(t, s, s.URL+"/other", "k1")
+	ensure.DeepEqual(t, body, "call 3")
+	_, body = idempotentPost(t, s, s.URL+"/charge", "")
+	ensure.DeepEqual(t, body, "call 4")
+
+	// server errors are not kept
+	_, body = idempotentPost(t, s, s.URL+"/fail", "k3")
+	ensure.DeepEqual(t, body, "call 5")
+	_, body = idempotentPost(t, s, s.URL+"/fail", "k3")
+	ensure.DeepEqual(t, body, "call 6")
+}
+
+func TestIdempotencyCacheInFlight(t *testing.T) {
+	const n = 5
+	m := &Middleware{Secret: secret, IdempotencyCache: &Idempotency{}}
+	provision(t, m)
+	s := newServer(t, m)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		fmt.Fprint(w, "done")
+	}))
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, bodies[i] = idempotentPost(t, s, s.URL, "same")
+		}()
+	}
+	eventually(t, func() bool { return calls.Load() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	ensure.DeepEqual(t, calls.Load(), int32(1))
+	for _, b := range bodies {
+		ensure.DeepEqual(t, b, "done")
+	}
+}
+
+func TestIdempotencyCacheLimits(t *testing.T) {
+	m := &Middleware{Secret: secret, IdempotencyCache: &Idempotency{
+		TTL:        caddy.Duration(50 * time.Millisecond),
+		MaxEntries: 2,
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "call %d", calls.Add(1))
+	}))
+	for _, key := range []string{"a", "b", "c"} {
+		idempotentPost(t, s, s.URL, key)
+	}
+	// a was dropped for c
+	_, body := idempotentPost(t, s, s.URL, "a")
+	ensure.DeepEqual(t, body, "call 4")
+	_, body = idempotentPost(t, s, s.URL, "c")
+	ensure.DeepEqual(t, body, "call 3")
+
+	time.Sleep(100 * time.Millisecond)
+	_, body = idempotentPost(t, s, s.URL, "c")
+	ensure.DeepEqual(t, body, "call 5")
+}
+
+func TestIdempotencyCacheInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, IdempotencyCache: &Idempotency{MaxEntries: -1}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("max_entries must not be negative"))
+}
+
+func TestIdempotencyCacheReplayHeader(t *testing.T) {
+	c := newIdempotencyCache(&Idempotency{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Value", "original")
+		w.WriteHeader(http.StatusCreated)
+	})
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Idempotency-Key", "k")
+		w := httptest.NewRecorder()
+		c.serve(w, r, next)
+		return w
+	}
+	request()
+
+	// a handler modifying a replayed response does not change the cached one
+	request().Header()["X-Value"][0] = "modified"
+	ensure.DeepEqual(t, request().Header().Get("X-Value"), "original")
+}
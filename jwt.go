@@ -0,0 +1,125 @@
+package clientproxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// JWT configures registration using signed tokens, for example short lived
+// ones issued to clients deployed by CI, instead of sharing the secret.
+// Exactly one of the keys must be set.
+type JWT struct {
+	// The key for tokens signed using HMAC.
+	HMACKey string `json:"hmac_key,omitempty"`
+
+	// The PEM encoded RSA, ECDSA or Ed25519 public key for tokens signed using
+	// it.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// A file to read the PEM encoded public key from.
+	PublicKeyFile string `json:"public_key_file,omitempty"`
+
+	// If set, tokens must include this audience.
+	Audience string `json:"audience,omitempty"`
+
+	// If set, tokens must be issued by this issuer.
+	Issuer string `json:"issuer,omitempty"`
+
+	// The allowed clock skew when checking exp and nbf. Defaults to 1m.
+	Leeway caddy.Duration `json:"leeway,omitempty"`
+
+	key any
+}
+
+// tokenClaims are the claims of a registration token.
+type tokenClaims struct {
+	jwt.Claims
+
+	// The hosts the client serves, instead of X-Client-Proxy-Hosts.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+func (j *JWT) validate() error {
+	var keys int
+	for _, v := range []string{j.HMACKey, j.PublicKey, j.PublicKeyFile} {
+		if v != "" {
+			keys++
+		}
+	}
+	if keys != 1 {
+		return fmt.Errorf("jwt requires exactly one of hmac_key, public_key and public_key_file")
+	}
+	return nil
+}
+
+// provision loads the key tokens are verified with.
+func (j *JWT) provision() error {
+	if j.HMACKey != "" {
+		j.key = []byte(j.HMACKey)
+		return nil
+	}
+	b := []byte(j.PublicKey)
+	if j.PublicKeyFile != "" {
+		var err error
+		if b, err = os.ReadFile(j.PublicKeyFile); err != nil {
+			return fmt.Errorf("client_proxy: error reading jwt public_key_file: %w", err)
+		}
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return fmt.Errorf("client_proxy: no PEM encoded jwt public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("client_proxy: invalid jwt public key: %w", err)
+	}
+	j.key = key
+	return nil
+}
+
+// authenticate reports if r presents a registration token, returning its
+// claims, or an error if the token is invalid. Tokens may be presented in the
+// X-Client-Proxy header, or as a bearer token. Since visitors may send bearer
+// tokens of their own, only those signed with the key are considered.
+func (j *JWT) authenticate(r *http.Request, now time.Time) (*tokenClaims, bool, error) {
+	token := r.Header.Get("X-Client-Proxy")
+	bearer := false
+	if token == "" {
+		token, bearer = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer {
+			return nil, false, nil
+		}
+	}
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, !bearer, fmt.Errorf("malformed token: %w", err)
+	}
+	var claims tokenClaims
+	if err := parsed.Claims(j.key, &claims); err != nil {
+		return nil, !bearer, fmt.Errorf("invalid token signature: %w", err)
+	}
+	if claims.Expiry == nil {
+		return nil, true, errors.New("token has no exp")
+	}
+	expected := jwt.Expected{Issuer: j.Issuer, Time: now}
+	if j.Audience != "" {
+		expected.Audience = jwt.Audience{j.Audience}
+	}
+	leeway := time.Duration(j.Leeway)
+	if leeway == 0 {
+		leeway = jwt.DefaultLeeway
+	}
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return nil, true, err
+	}
+	return &claims, true, nil
+}
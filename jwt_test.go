@@ -0,0 +1,156 @@
+package clientproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"golang.org/x/net/http2"
+)
+
+const hmacKey = "a_signing_key_of_at_least_32_bytes"
+
+func sign(t testing.TB, alg jose.SignatureAlgorithm, key any, claims tokenClaims) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+	ensure.Nil(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	ensure.Nil(t, err)
+	return token
+}
+
+func validClaims() tokenClaims {
+	return tokenClaims{
+		Claims: jwt.Claims{
+			Subject:  "ci-runner-42",
+			Audience: jwt.Audience{"client_proxy"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Hosts: []string{"app.example.com"},
+	}
+}
+
+// connectHeader registers a client serving h with the given header, and
+// waits until it is installed.
+func connectHeader(t testing.TB, m *Middleware, s *httptest.Server, header http.Header, h http.Handler) {
+	prev := m.handler.Load()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ensure.Nil(t, err)
+	req.Header = header
+	ensure.Nil(t, req.Write(conn))
+	go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+	eventually(t, func() bool { return m.handler.Load() != prev })
+}
+
+func TestJWT(t *testing.T) {
+	m := &Middleware{JWT: &JWT{HMACKey: hmacKey, Audience: "client_proxy"}}
+	provision(t, m)
+	s := newServer(t, m)
+	token := sign(t, jose.HS256, []byte(hmacKey), validClaims())
+	connectHeader(t, m, s, http.Header{
+		"X-Client-Proxy":       {token},
+		"X-Client-Proxy-Hosts": {"ignored.example.com"},
+	}, http.HandlerFunc(hello))
+	status := m.status()
+	ensure.DeepEqual(t, status.Client.Subject, "ci-runner-42")
+	ensure.DeepEqual(t, status.Client.Hosts, []string{"app.example.com"})
+
+	// bearer tokens work too
+	connectHeader(t, m, s, http.Header{"Authorization": {"Bearer " + token}}, http.HandlerFunc(hello))
+}
+
+func TestJWTPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ensure.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ensure.Nil(t, err)
+	m := &Middleware{JWT: &JWT{
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	connectHeader(t, m, s, http.Header{
+		"X-Client-Proxy": {sign(t, jose.ES256, key, validClaims())},
+	}, http.HandlerFunc(hello))
+
+	// the HMAC of a token is no good against a public key
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", sign(t, jose.HS256, []byte(hmacKey), validClaims()))
+	_, ok, err := m.authenticate(r)
+	ensure.True(t, ok)
+	ensure.Err(t, err, regexp.MustCompile("invalid token signature"))
+}
+
+func TestJWTRejected(t *testing.T) {
+	m := &Middleware{Secret: secret, JWT: &JWT{HMACKey: hmacKey, Audience: "client_proxy"}}
+	provision(t, m)
+	expired := validClaims()
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	notYet := validClaims()
+	notYet.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	wrongAudience := validClaims()
+	wrongAudience.Audience = jwt.Audience{"other"}
+	noExpiry := validClaims()
+	noExpiry.Expiry = nil
+	for _, c := range []struct {
+		name   string
+		header string
+		value  string
+		err    string
+	}{
+		{"expired", "X-Client-Proxy", sign(t, jose.HS256, []byte(hmacKey), expired), "expired"},
+		{"not yet valid", "X-Client-Proxy", sign(t, jose.HS256, []byte(hmacKey), notYet), "not valid yet"},
+		{"audience", "Authorization", "Bearer " + sign(t, jose.HS256, []byte(hmacKey), wrongAudience), "audience"},
+		{"no exp", "X-Client-Proxy", sign(t, jose.HS256, []byte(hmacKey), noExpiry), "no exp"},
+		{"malformed", "X-Client-Proxy", "not_the_secret", "malformed token"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(c.header, c.value)
+		err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var herr caddyhttp.HandlerError
+		ensure.True(t, errors.As(err, &herr), c.name)
+		ensure.DeepEqual(t, herr.StatusCode, http.StatusUnauthorized, c.name)
+		ensure.Err(t, err, regexp.MustCompile(c.err), c.name)
+	}
+	ensure.True(t, m.handler.Load() == nil)
+
+	// visitors' own bearer tokens are passed along
+	for _, v := range []string{
+		"Bearer " + sign(t, jose.HS256, []byte("another_signing_key_of_32_bytes!!"), validClaims()),
+		"Bearer opaque",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", v)
+		called := false
+		err := m.ServeHTTP(httptest.NewRecorder(), r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			called = true
+			return nil
+		}))
+		ensure.Nil(t, err)
+		ensure.True(t, called, v)
+	}
+}
+
+func TestJWTInvalid(t *testing.T) {
+	m := &Middleware{JWT: &JWT{HMACKey: hmacKey, PublicKeyFile: "key.pem"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("exactly one of"))
+	m = &Middleware{JWT: &JWT{PublicKey: "not pem"}}
+	ensure.Nil(t, m.Validate())
+	ensure.Err(t, m.JWT.provision(), regexp.MustCompile("no PEM encoded jwt public key"))
+}
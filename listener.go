@@ -0,0 +1,193 @@
+package clientproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+)
+
+// RegistrationListener accepts registrations on a dedicated address, instead
+// of the sites the handler is used in.
+type RegistrationListener struct {
+	// The network address to listen on, like "10.0.0.1:8443".
+	Address string `json:"address"`
+
+	// Serve TLS using this certificate and key file.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// Serve TLS using certificates managed by Caddy for these names.
+	TLSDomains []string `json:"tls_domains,omitempty"`
+
+	ln     net.Listener
+	server *http.Server
+}
+
+func (l *RegistrationListener) validate() error {
+	if l.Address == "" {
+		return fmt.Errorf("registration_listener: no address")
+	}
+	addr, err := caddy.ParseNetworkAddress(l.Address)
+	if err != nil {
+		return fmt.Errorf("registration_listener: %w", err)
+	}
+	// registrations are HTTP/1.1 requests, served on a stream listener
+	if !slices.Contains([]string{"tcp", "tcp4", "tcp6", "unix", "fd"}, addr.Network) {
+		return fmt.Errorf("registration_listener: network must be tcp, unix or fd, got %s", addr.Network)
+	}
+	if addr.PortRangeSize() > 1 {
+		return fmt.Errorf("registration_listener: address must have a single port, got %s", l.Address)
+	}
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		return fmt.Errorf("registration_listener: both cert_file and key_file are required")
+	}
+	if l.CertFile != "" && len(l.TLSDomains) > 0 {
+		return fmt.Errorf("registration_listener: only one of cert_file and tls_domains may be set")
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS config to serve with, or nil for plaintext.
+func (l *RegistrationListener) tlsConfig(ctx caddy.Context) (*tls.Config, error) {
+	// registrations hijack the connection, which requires HTTP/1.1
+	alpn := []string{"http/1.1"}
+	if l.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("registration_listener: %w", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   alpn,
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+	if len(l.TLSDomains) == 0 {
+		return nil, nil
+	}
+	app, err := ctx.App("tls")
+	if err != nil {
+		return nil, fmt.Errorf("registration_listener: getting tls app: %w", err)
+	}
+	if err := app.(*caddytls.TLS).Manage(l.TLSDomains); err != nil {
+		return nil, fmt.Errorf("registration_listener: %w", err)
+	}
+	policies := caddytls.ConnectionPolicies{{ALPN: alpn}}
+	if err := policies.Provision(ctx); err != nil {
+		return nil, fmt.Errorf("registration_listener: %w", err)
+	}
+	return policies.TLSConfig(ctx), nil
+}
+
+// listen starts serving registrations for m.
+func (l *RegistrationListener) listen(ctx caddy.Context, m *Middleware) error {
+	addr, err := caddy.ParseNetworkAddress(l.Address)
+	if err != nil {
+		return fmt.Errorf("registration_listener: %w", err)
+	}
+	tlsConfig, err := l.tlsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	lnAny, err := addr.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return fmt.Errorf("registration_listener: %w", err)
+	}
+	ln, ok := lnAny.(net.Listener)
+	if !ok {
+		return fmt.Errorf("registration_listener: %s is not a stream listener", l.Address)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	l.ln = ln
+	l.server = &http.Server{
+		Handler:           http.HandlerFunc(m.serveRegistration),
+		ReadHeaderTimeout: time.Minute,
+		ErrorLog:          zap.NewStdLog(m.logger),
+	}
+	go func() {
+		if err := l.server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			m.logger.Error("registration_listener stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// close stops accepting registrations. Established tunnels are left alone.
+func (l *RegistrationListener) close() error {
+	if l.server == nil {
+		return nil
+	}
+	return l.server.Close()
+}
+
+// serveRegistration serves the registration flow on the registration listener.
+func (m *Middleware) serveRegistration(w http.ResponseWriter, r *http.Request) {
+	r = m.scrubQueryCredential(r)
+	ht := &hijackTracker{ResponseWriter: w}
+	err := func() error {
+		id, ok, err := m.authenticate(r)
+		if !ok {
+			return caddyhttp.Error(http.StatusUnauthorized,
+				fmt.Errorf("client_proxy: not a registration"))
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.checkStopping(ht); err != nil {
+			return err
+		}
+		return m.acceptProxy(ht, r, id)
+	}()
+	if err == nil {
+		return
+	}
+	if ht.hijacked {
+		m.logger.Debug("registration failed", zap.Error(err))
+		return
+	}
+	// there is no Caddy error handling on the listener, so errors are
+	// responded to as it would
+	status := http.StatusInternalServerError
+	var handlerErr caddyhttp.HandlerError
+	switch {
+	case errors.As(err, &handlerErr):
+		status = handlerErr.StatusCode
+	case errors.Is(err, ErrNotHTTP1):
+		status = http.StatusBadRequest
+	}
+	if status >= 500 {
+		m.logger.Error("registration failed", zap.Error(err))
+	}
+	w.WriteHeader(status)
+}
+
+// hijackTracker records if the connection was hijacked, after which no
+// response may be written.
+type hijackTracker struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (w *hijackTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, buf, err
+}
+
+func (w *hijackTracker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
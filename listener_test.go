@@ -0,0 +1,143 @@
+package clientproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+func TestRegistrationListener(t *testing.T) {
+	m := &Middleware{
+		Secret:               secret,
+		RegistrationListener: &RegistrationListener{Address: "127.0.0.1:0"},
+	}
+	provision(t, m)
+	s := newServer(t, m)
+
+	// registrations on the site fall through
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("X-Client-Proxy", secret)
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+
+	addr := m.RegistrationListener.ln.Addr().String()
+	res, err = http.Get("http://" + addr)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusUnauthorized)
+
+	conn, err := net.Dial("tcp", addr)
+	ensure.Nil(t, err)
+	connectOver(t, m, conn, &http2.Server{}, nil, http.HandlerFunc(hello))
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+
+	// the secret sent to the site is not forwarded
+	conn, err = net.Dial("tcp", addr)
+	ensure.Nil(t, err)
+	connectOver(t, m, conn, &http2.Server{}, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.Header.Get("X-Client-Proxy"))
+	}))
+	res, err = http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, string(b), `""`)
+
+	// a registration that cannot be hijacked is responded to
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", secret)
+	m.serveRegistration(w, r)
+	ensure.DeepEqual(t, w.Code, http.StatusBadRequest)
+
+	// the tunnel outlives the listener
+	ensure.Nil(t, m.RegistrationListener.close())
+	_, err = net.Dial("tcp", addr)
+	ensure.NotNil(t, err)
+	_, body = get(t, s, "/")
+	ensure.DeepEqual(t, body, `""`)
+}
+
+// writeKeyPair writes a self-signed certificate and key to dir.
+func writeKeyPair(t testing.TB, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ensure.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	ensure.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	ensure.Nil(t, err)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ensure.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	ensure.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestRegistrationListenerTLS(t *testing.T) {
+	certFile, keyFile := writeKeyPair(t, t.TempDir())
+	m := &Middleware{
+		Secret: secret,
+		RegistrationListener: &RegistrationListener{
+			Address:  "127.0.0.1:0",
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	conn, err := tls.Dial("tcp", m.RegistrationListener.ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, conn.ConnectionState().NegotiatedProtocol, "http/1.1")
+	connectOver(t, m, conn, &http2.Server{}, nil, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+}
+
+func TestRegistrationListenerInvalid(t *testing.T) {
+	cases := map[string]*RegistrationListener{
+		"no address": {},
+		"no key":     {Address: ":0", CertFile: "cert.pem"},
+		"both":       {Address: ":0", CertFile: "c", KeyFile: "k", TLSDomains: []string{"a.com"}},
+		"udp":        {Address: "udp/127.0.0.1:0"},
+		"port range": {Address: "127.0.0.1:8000-8001"},
+		"invalid":    {Address: "tcp/127.0.0.1:x"},
+	}
+	for name, l := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{Secret: secret, RegistrationListener: l}
+			ensure.NotNil(t, m.Validate())
+		})
+	}
+}
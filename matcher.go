@@ -0,0 +1,108 @@
+package clientproxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(MatchClientProxy{})
+}
+
+// MatchClientProxy matches requests depending on whether a client that would
+// serve them is connected to a client_proxy handler.
+type MatchClientProxy struct {
+	// Connected matches requests when a client is connected if true, and when
+	// none is if false.
+	Connected bool `json:"connected"`
+
+	// Tunnel is the name of the client_proxy handler to consult. If empty, any
+	// handler may serve the request.
+	Tunnel string `json:"tunnel,omitempty"`
+
+	load <-chan struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchClientProxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.client_proxy",
+		New: func() caddy.Module { return new(MatchClientProxy) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *MatchClientProxy) Provision(ctx caddy.Context) error {
+	m.load = ctx.Done()
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m MatchClientProxy) Match(r *http.Request) bool {
+	return m.connected(r) == m.Connected
+}
+
+// connected reports whether a client that would serve r is connected to a
+// handler of the same config. Handlers are looked up on every request, as
+// they may be provisioned after the matcher.
+func (m MatchClientProxy) connected(r *http.Request) bool {
+	serves := func(mw *Middleware) bool {
+		h := mw.handler.Load()
+		return h != nil && h.serves(r)
+	}
+	if m.Tunnel != "" {
+		mw := registry.named(m.Tunnel, m.load)
+		return mw != nil && serves(mw)
+	}
+	for _, mw := range registry.all() {
+		if mw.load == m.load && serves(mw) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	client_proxy [connected [true|false]] [tunnel <name>]
+func (m *MatchClientProxy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	m.Connected = true
+	for d.Next() {
+		for d.NextArg() {
+			switch d.Val() {
+			case "connected":
+				if !d.NextArg() {
+					break
+				}
+				if d.Val() == "tunnel" {
+					d.Prev()
+					break
+				}
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid connected value %s", d.Val())
+				}
+				m.Connected = v
+			case "tunnel":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Tunnel = d.Val()
+			default:
+				return d.Errf("unrecognized client_proxy matcher option %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*MatchClientProxy)(nil)
+	_ caddyhttp.RequestMatcher = (*MatchClientProxy)(nil)
+	_ caddyfile.Unmarshaler    = (*MatchClientProxy)(nil)
+)
@@ -0,0 +1,142 @@
+package clientproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+// newMatch returns a MatchClientProxy provisioned as part of the config
+// loaded by ctx.
+func newMatch(t testing.TB, ctx caddy.Context, connected bool, tunnel string) caddyhttp.RequestMatcher {
+	m := &MatchClientProxy{Connected: connected, Tunnel: tunnel}
+	ensure.Nil(t, m.Provision(ctx))
+	return m
+}
+
+func TestMatchClientProxy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &Middleware{Secret: secret, Name: "match_app"}
+	provisionIn(t, ctx, m)
+	s := newServer(t, m)
+	connected := newMatch(t, ctx, true, "match_app")
+	disconnected := newMatch(t, ctx, false, "match_app")
+	other := newMatch(t, ctx, true, "match_other")
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ensure.False(t, connected.Match(r))
+	ensure.True(t, disconnected.Match(r))
+
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	ensure.True(t, connected.Match(r))
+	ensure.False(t, disconnected.Match(r))
+	ensure.False(t, other.Match(r))
+	ensure.True(t, newMatch(t, ctx, true, "").Match(r))
+
+	conn.Close()
+	eventually(t, func() bool { return !connected.Match(r) })
+	ensure.True(t, disconnected.Match(r))
+}
+
+func TestMatchClientProxyOtherConfig(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "match_reload"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+
+	// the handler of the previous config is not consulted during a reload
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ensure.False(t, newMatch(t, ctx, true, "match_reload").Match(r))
+	ensure.False(t, newMatch(t, ctx, true, "").Match(r))
+}
+
+func TestMatchClientProxyHosts(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &Middleware{Secret: secret, Name: "match_hosts"}
+	provisionIn(t, ctx, m)
+	s := newServer(t, m)
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Client-Proxy-Hosts": {"a.example.com"}}, http.HandlerFunc(hello))
+	match := newMatch(t, ctx, true, "match_hosts")
+	ensure.True(t, match.Match(httptest.NewRequest(http.MethodGet, "http://a.example.com/", nil)))
+	ensure.False(t, match.Match(httptest.NewRequest(http.MethodGet, "http://b.example.com/", nil)))
+}
+
+func TestMatchClientProxyCaddyfile(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  MatchClientProxy
+		err   string
+	}{
+		{
+			name:  "default",
+			input: `client_proxy`,
+			want:  MatchClientProxy{Connected: true},
+		},
+		{
+			name:  "connected",
+			input: `client_proxy connected`,
+			want:  MatchClientProxy{Connected: true},
+		},
+		{
+			name:  "not connected",
+			input: `client_proxy connected false`,
+			want:  MatchClientProxy{},
+		},
+		{
+			name:  "tunnel",
+			input: `client_proxy connected tunnel app`,
+			want:  MatchClientProxy{Connected: true, Tunnel: "app"},
+		},
+		{
+			name:  "invalid connected",
+			input: `client_proxy connected maybe`,
+			err:   "invalid connected value maybe",
+		},
+		{
+			name:  "missing tunnel",
+			input: `client_proxy tunnel`,
+			err:   "wrong argument count",
+		},
+		{
+			name:  "unknown",
+			input: `client_proxy foo`,
+			err:   "unrecognized client_proxy matcher option foo",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var m MatchClientProxy
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(c.input))
+			if c.err != "" {
+				ensure.Err(t, err, regexp.MustCompile(c.err))
+				return
+			}
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, m, c.want)
+		})
+	}
+}
+
+func TestMatchClientProxyAdapt(t *testing.T) {
+	b, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(`
+		example.com {
+			@down not client_proxy connected tunnel app
+			respond @down "down" 503
+		}
+	`), nil)
+	ensure.Nil(t, err)
+	ensure.StringContains(t, string(b), `"not":[{"client_proxy":{"connected":true,"tunnel":"app"}}]`)
+}
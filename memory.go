@@ -0,0 +1,90 @@
+package clientproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// unknownStreamMemory is the estimate for responses of unknown length, the
+// stream flow control window of the HTTP/2 transport, which bounds what the
+// client may send ahead.
+const unknownStreamMemory = 4 << 20
+
+// checkStreamMemory rejects forwarding a new request while the responses in
+// flight are estimated to exceed max_stream_memory.
+func (m *Middleware) checkStreamMemory() error {
+	if m.MaxStreamMemory <= 0 {
+		return nil
+	}
+	used := m.streamMemory.Load()
+	if used < m.MaxStreamMemory {
+		return nil
+	}
+	m.metrics.streamMemoryRejected.Inc()
+	m.logger.Debug("max_stream_memory exceeded", zap.Int64("used", used))
+	return caddyhttp.Error(http.StatusServiceUnavailable,
+		fmt.Errorf("client_proxy: max_stream_memory of %d bytes exceeded", m.MaxStreamMemory))
+}
+
+// trackStreamMemory accounts for the response body until it is read or
+// closed. Responses of known length count what is left of it, and others the
+// stream flow control window.
+func (m *Middleware) trackStreamMemory(res *http.Response) error {
+	estimate := res.ContentLength
+	if estimate < 0 {
+		estimate = unknownStreamMemory
+	}
+	if estimate == 0 {
+		return nil
+	}
+	m.streamMemory.Add(estimate)
+	res.Body = &memoryBody{
+		ReadCloser: res.Body,
+		m:          m,
+		known:      res.ContentLength >= 0,
+		remaining:  estimate,
+	}
+	return nil
+}
+
+type memoryBody struct {
+	io.ReadCloser
+	m     *Middleware
+	known bool
+
+	mu        sync.Mutex
+	remaining int64
+}
+
+func (b *memoryBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.known {
+		b.release(int64(n))
+	}
+	if err != nil {
+		b.release(-1)
+	}
+	return n, err
+}
+
+func (b *memoryBody) Close() error {
+	b.release(-1)
+	return b.ReadCloser.Close()
+}
+
+// release returns n bytes of the estimate to the budget, or all that remains
+// if n is negative.
+func (b *memoryBody) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n < 0 || n > b.remaining {
+		n = b.remaining
+	}
+	b.remaining -= n
+	b.m.streamMemory.Add(-n)
+}
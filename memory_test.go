@@ -0,0 +1,67 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestMaxStreamMemory(t *testing.T) {
+	const size = 1 << 20
+	m := &Middleware{Secret: secret, InstanceLabel: "stream_memory", MaxStreamMemory: size + size/2}
+	provision(t, m)
+	s := newServer(t, m)
+	release := make(chan struct{})
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		case "/stream":
+		default:
+			hello(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		<-release
+		w.Write(make([]byte, size))
+	}))
+
+	type result struct {
+		status int
+		n      int64
+	}
+	results := make(chan result, 2)
+	fetch := func(path string) {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			results <- result{}
+			return
+		}
+		defer res.Body.Close()
+		n, _ := io.Copy(io.Discard, res.Body)
+		results <- result{res.StatusCode, n}
+	}
+
+	// the first fits the budget, and the second exceeds it
+	go fetch("/large")
+	eventually(t, func() bool { return m.streamMemory.Load() == size })
+	go fetch("/stream")
+	eventually(t, func() bool { return m.streamMemory.Load() == size+unknownStreamMemory })
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_stream_memory_rejected_total"), 1.0)
+
+	// the budget is returned as the responses complete
+	close(release)
+	ensure.DeepEqual(t, <-results, result{http.StatusOK, size})
+	ensure.DeepEqual(t, <-results, result{http.StatusOK, size})
+	eventually(t, func() bool { return m.streamMemory.Load() == 0 })
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+	ensure.DeepEqual(t, m.streamMemory.Load(), int64(0))
+}
@@ -0,0 +1,149 @@
+package clientproxy
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsRegistry creates the collectors of the handlers, registered with the
+// metrics registry of their config.
+type metricsRegistry struct {
+	registry *prometheus.Registry
+	err      error
+}
+
+// registerCollector registers c, returning the collector another handler of
+// the same config already registered in its place.
+func registerCollector[T prometheus.Collector](r *metricsRegistry, c T) T {
+	if r.err != nil {
+		return c
+	}
+	if err := r.registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		r.err = err
+	}
+	return c
+}
+
+func (r *metricsRegistry) counter(name, help string, labels ...string) *prometheus.CounterVec {
+	return registerCollector(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "client_proxy",
+		Name:      name,
+		Help:      help,
+	}, append([]string{"instance"}, labels...)))
+}
+
+func (r *metricsRegistry) gauge(name, help string, labels ...string) *prometheus.GaugeVec {
+	return registerCollector(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "client_proxy",
+		Name:      name,
+		Help:      help,
+	}, append([]string{"instance"}, labels...)))
+}
+
+// instanceMetrics are the metrics of one Middleware, labelled with its
+// instance label.
+type instanceMetrics struct {
+	// the registry of the config, which the metrics are registered with
+	registry *prometheus.Registry
+
+	requests                prometheus.Counter
+	registrations           prometheus.Counter
+	connected               prometheus.Gauge
+	retries                 prometheus.Counter
+	missingTrailers         prometheus.Counter
+	streamResets            prometheus.Counter
+	downstreamAborts        prometheus.Counter
+	clientCanceled          prometheus.Counter
+	fallbackNext            prometheus.Counter
+	fallbackUpstream        prometheus.Counter
+	fallbackRedirect        prometheus.Counter
+	abortPanics             prometheus.Counter
+	unexpectedPanics        prometheus.Counter
+	spooled                 prometheus.Counter
+	spoolOverflow           prometheus.Counter
+	spoolExpired            prometheus.Counter
+	spoolReplayed           prometheus.Counter
+	streamMemoryRejected    prometheus.Counter
+	registrationInvalid     prometheus.Counter
+	registrationExpired     prometheus.Counter
+	registrationNotYetValid prometheus.Counter
+	evictedReplaced         prometheus.Counter
+	evictedLifetime         prometheus.Counter
+	evictedKeepalive        prometheus.Counter
+	evictedError            prometheus.Counter
+	evictedShutdown         prometheus.Counter
+	evictedMaxClients       prometheus.Counter
+}
+
+func newInstanceMetrics(registry *prometheus.Registry, instance string) (*instanceMetrics, error) {
+	r := &metricsRegistry{registry: registry}
+	requests := r.counter("requests_total", "Number of requests forwarded to clients.")
+	registrations := r.counter("registrations_total", "Number of clients registered.")
+	connected := r.gauge("clients_connected", "Number of clients currently connected.")
+	retries := r.counter("retries_total", "Number of attempts made to retry failed requests.")
+	missingTrailers := r.counter("missing_trailers_total", "Number of responses finalized without their declared trailers.")
+	streamResets := r.counter("stream_resets_total", "Number of requests whose stream was reset by the client.")
+	downstreamAborts := r.counter("downstream_aborts_total", "Number of responses aborted because writing them downstream failed.")
+	clientCanceled := r.counter("client_canceled_total", "Number of requests canceled by the visitor before the response was complete.")
+	fallbacks := r.counter("fallback_requests_total", "Number of requests served without a client connected, by fallback, next, upstream or redirect.", "fallback")
+	panics := r.counter("panics_total", "Number of panics while forwarding requests, by kind, abort or unexpected.", "kind")
+	spooled := r.counter("spooled_total", "Number of requests spooled while no client was connected.")
+	spoolDropped := r.counter("spool_dropped_total", "Number of spooled requests dropped before being replayed.", "reason")
+	spoolReplayed := r.counter("spool_replayed_total", "Number of spooled requests replayed to a client.")
+	streamMemory := r.counter("stream_memory_rejected_total", "Number of requests rejected because max_stream_memory was exceeded.")
+	registrationFailures := r.counter("registration_failures_total", "Number of failed registrations, by reason, invalid, expired or not_yet_valid.", "reason")
+	evictions := r.counter("evictions_total", "Number of clients disconnected, by reason, replaced, lifetime, keepalive_failure, error, shutdown or max_clients.", "reason")
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &instanceMetrics{
+		registry:                registry,
+		requests:                requests.WithLabelValues(instance),
+		registrations:           registrations.WithLabelValues(instance),
+		connected:               connected.WithLabelValues(instance),
+		retries:                 retries.WithLabelValues(instance),
+		missingTrailers:         missingTrailers.WithLabelValues(instance),
+		streamResets:            streamResets.WithLabelValues(instance),
+		downstreamAborts:        downstreamAborts.WithLabelValues(instance),
+		clientCanceled:          clientCanceled.WithLabelValues(instance),
+		fallbackNext:            fallbacks.WithLabelValues(instance, "next"),
+		fallbackUpstream:        fallbacks.WithLabelValues(instance, "upstream"),
+		fallbackRedirect:        fallbacks.WithLabelValues(instance, "redirect"),
+		abortPanics:             panics.WithLabelValues(instance, "abort"),
+		unexpectedPanics:        panics.WithLabelValues(instance, "unexpected"),
+		spooled:                 spooled.WithLabelValues(instance),
+		spoolOverflow:           spoolDropped.WithLabelValues(instance, "overflow"),
+		spoolExpired:            spoolDropped.WithLabelValues(instance, "expired"),
+		spoolReplayed:           spoolReplayed.WithLabelValues(instance),
+		streamMemoryRejected:    streamMemory.WithLabelValues(instance),
+		registrationInvalid:     registrationFailures.WithLabelValues(instance, "invalid"),
+		registrationExpired:     registrationFailures.WithLabelValues(instance, "expired"),
+		registrationNotYetValid: registrationFailures.WithLabelValues(instance, "not_yet_valid"),
+		evictedReplaced:         evictions.WithLabelValues(instance, "replaced"),
+		evictedLifetime:         evictions.WithLabelValues(instance, "lifetime"),
+		evictedKeepalive:        evictions.WithLabelValues(instance, "keepalive_failure"),
+		evictedError:            evictions.WithLabelValues(instance, "error"),
+		evictedShutdown:         evictions.WithLabelValues(instance, "shutdown"),
+		evictedMaxClients:       evictions.WithLabelValues(instance, "max_clients"),
+	}, nil
+}
+
+// instanceLabel returns the label identifying m in metrics and logs.
+func (m *Middleware) instanceLabel() string {
+	switch {
+	case m.InstanceLabel != "":
+		return m.InstanceLabel
+	case m.Name != "":
+		return m.Name
+	}
+	return "client_proxy"
+}
@@ -0,0 +1,139 @@
+package clientproxy
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+// metricValue returns the value of the metric of m, with the additional label
+// name and value pairs.
+func metricValue(t testing.TB, m *Middleware, name string, labels ...string) float64 {
+	t.Helper()
+	instance := m.instanceLabel()
+	want := map[string]string{"instance": instance}
+	for i := 0; i+1 < len(labels); i += 2 {
+		want[labels[i]] = labels[i+1]
+	}
+	families, err := m.metrics.registry.Gather()
+	ensure.Nil(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range f.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if v, ok := want[label.GetName()]; ok {
+					if label.GetValue() != v {
+						continue metrics
+					}
+					matched++
+				}
+			}
+			if matched != len(want) {
+				continue
+			}
+			if g := metric.GetGauge(); g != nil {
+				return g.GetValue()
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("metric %s with instance %s not found", name, instance)
+	return 0
+}
+
+func TestMetricsInstanceLabel(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "metrics_name", InstanceLabel: "metrics_label"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	get(t, s, "/")
+	get(t, s, "/")
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_requests_total"), 2.0)
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_registrations_total"), 1.0)
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_clients_connected"), 1.0)
+	ensure.Nil(t, m.Cleanup())
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_clients_connected"), 0.0)
+}
+
+func TestMetricsDefaultLabel(t *testing.T) {
+	ensure.DeepEqual(t, (&Middleware{}).instanceLabel(), "client_proxy")
+	m := &Middleware{Secret: secret, Name: "metrics_default"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	get(t, s, "/")
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_requests_total"), 1.0)
+}
+
+// blackholeConn drops its writes once dropping is set, like a client whose
+// network went away without closing the connection.
+type blackholeConn struct {
+	net.Conn
+	dropping atomic.Bool
+}
+
+func (c *blackholeConn) Write(p []byte) (int, error) {
+	if c.dropping.Load() {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func TestMetricsEvictions(t *testing.T) {
+	evictions := func(m *Middleware, reason string) float64 {
+		return metricValue(t, m, "caddy_client_proxy_evictions_total", "reason", reason)
+	}
+
+	m := &Middleware{Secret: secret, Name: "evictions"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	connect(t, m, s, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, evictions(m, "replaced"), 1.0)
+	conn := connect(t, m, s, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, evictions(m, "replaced"), 2.0)
+	conn.Close()
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	ensure.DeepEqual(t, evictions(m, "error"), 1.0)
+	connect(t, m, s, http.HandlerFunc(hello))
+	ensure.Nil(t, m.Cleanup())
+	ensure.DeepEqual(t, evictions(m, "shutdown"), 1.0)
+	ensure.DeepEqual(t, evictions(m, "keepalive_failure"), 0.0)
+
+	m = &Middleware{Secret: secret, Name: "evictions_lifetime", RehandshakeInterval: caddy.Duration(50 * time.Millisecond)}
+	provision(t, m)
+	connect(t, m, newServer(t, m), http.HandlerFunc(hello))
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	ensure.DeepEqual(t, evictions(m, "lifetime"), 1.0)
+
+	m = &Middleware{Secret: secret, Name: "evictions_keepalive", Performance: &Performance{
+		ReadIdleTimeout: caddy.Duration(50 * time.Millisecond),
+		PingTimeout:     caddy.Duration(50 * time.Millisecond),
+	}}
+	provision(t, m)
+	s = newServer(t, m)
+	tcp, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	t.Cleanup(func() { tcp.Close() })
+	bh := &blackholeConn{Conn: tcp}
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ensure.Nil(t, err)
+	req.Header.Set("X-Client-Proxy", secret)
+	ensure.Nil(t, req.Write(bh))
+	go (&http2.Server{}).ServeConn(bh, &http2.ServeConnOpts{Handler: http.HandlerFunc(hello)})
+	eventually(t, func() bool { return m.handler.Load() != nil })
+	bh.dropping.Store(true)
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	ensure.DeepEqual(t, evictions(m, "keepalive_failure"), 1.0)
+	ensure.DeepEqual(t, evictions(m, "error"), 0.0)
+}
@@ -0,0 +1,214 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parsePaths parses a comma separated list of path prefixes.
+func parsePaths(v string) []string {
+	var paths []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// hasAnyPrefix reports if path starts with any of the prefixes.
+func hasAnyPrefix(prefixes []string, path string) bool {
+	return slices.ContainsFunc(prefixes, func(p string) bool {
+		return strings.HasPrefix(path, p)
+	})
+}
+
+// cutPrefix returns the escaped path raw without prefix, if raw starts with
+// prefix followed by a / or nothing. The prefix is matched by segment against
+// the decoded path, so it matches however the visitor encoded it. The rest
+// keeps its encoding, and is / if nothing is left.
+func cutPrefix(raw, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return raw, true
+	}
+	i := 0
+	for range strings.Count(prefix, "/") {
+		if j := strings.IndexByte(raw[i:], '/'); j >= 0 {
+			i += j + 1
+		} else {
+			return raw, false
+		}
+	}
+	end := len(raw)
+	if j := strings.IndexByte(raw[i:], '/'); j >= 0 {
+		end = i + j
+	}
+	if p, err := url.PathUnescape(raw[:end]); err != nil || p != prefix {
+		return raw, false
+	}
+	if end == len(raw) {
+		return "/", true
+	}
+	return raw[end:], true
+}
+
+// hasStripPrefix reports if the path of u starts with StripPathPrefix.
+func (m *Middleware) hasStripPrefix(u *url.URL) bool {
+	_, ok := cutPrefix(escapedPath(u), m.StripPathPrefix)
+	return ok
+}
+
+// checkStripPrefix rejects requests without the strip_path_prefix with a 404,
+// if configured to.
+func (m *Middleware) checkStripPrefix(r *http.Request) error {
+	if m.StripPathPrefix == "" || !m.StripPathPrefixRequired || m.hasStripPrefix(r.URL) {
+		return nil
+	}
+	return caddyhttp.Error(http.StatusNotFound,
+		fmt.Errorf("client_proxy: path does not start with %s", m.StripPathPrefix))
+}
+
+// stripPrefix removes StripPathPrefix from the path of u, keeping its encoding.
+// Paths without it are left alone.
+func (m *Middleware) stripPrefix(u *url.URL) {
+	if m.StripPathPrefix == "" {
+		return
+	}
+	if u.Opaque != "" {
+		if rest, ok := cutPrefix(u.Opaque, m.StripPathPrefix); ok {
+			u.Opaque = rest
+		}
+		return
+	}
+	rest, ok := cutPrefix(escapedPath(u), m.StripPathPrefix)
+	if !ok {
+		return
+	}
+	path, err := url.PathUnescape(rest)
+	if err != nil {
+		return
+	}
+	u.Path, u.RawPath = path, rest
+}
+
+// publicPath maps the path of u as used by the client, like in the Location
+// of a redirect, back to the one the visitor would use if StripPathPrefix is
+// set, undoing add_path_prefix and adding back the strip_path_prefix. Paths
+// outside of add_path_prefix are not for the visitor, and are left alone. It
+// reports if u was changed.
+func (m *Middleware) publicPath(u *url.URL) bool {
+	if m.StripPathPrefix == "" || u.Opaque != "" {
+		return false
+	}
+	rest, ok := cutPrefix(escapedPath(u), m.AddPathPrefix)
+	if !ok {
+		return false
+	}
+	raw := (&url.URL{Path: strings.TrimSuffix(m.StripPathPrefix, "/")}).EscapedPath() + rest
+	path, err := url.PathUnescape(raw)
+	if err != nil {
+		return false
+	}
+	u.Path, u.RawPath = path, raw
+	return true
+}
+
+// addPrefix prepends AddPathPrefix to the path of u, keeping its encoding.
+func (m *Middleware) addPrefix(u *url.URL) {
+	prefix := strings.TrimSuffix(m.AddPathPrefix, "/")
+	if prefix == "" {
+		return
+	}
+	if u.Opaque != "" {
+		u.Opaque = (&url.URL{Path: prefix}).EscapedPath() + u.Opaque
+		return
+	}
+	path, raw := u.Path, escapedPath(u)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+		raw = "/" + raw
+	}
+	u.Path = prefix + path
+	u.RawPath = (&url.URL{Path: prefix}).EscapedPath() + raw
+}
+
+// escapedPath returns the path of u as it was received, escaping only the
+// characters that should have been. url.URL instead discards the received
+// encoding, like %2F for a / within a segment, if any character should have
+// been escaped.
+func escapedPath(u *url.URL) string {
+	if u.RawPath == "" {
+		return u.EscapedPath()
+	}
+	if p, err := url.PathUnescape(u.RawPath); err != nil || p != u.Path {
+		// the path was changed since it was received
+		return u.EscapedPath()
+	}
+	var b strings.Builder
+	for i := 0; i < len(u.RawPath); i++ {
+		c := u.RawPath[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("-._~!$&'()*+,;=:@[]/%", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// preserveRequestURI forwards the path of r exactly as it was received. The
+// query is always forwarded as received.
+func preserveRequestURI(r *http.Request) {
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	// the authority form of CONNECT, the absolute form of proxy requests, and
+	// paths starting with // which would be taken for an authority
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return
+	}
+	r.URL.Opaque = path
+}
+
+// dotReplacer decodes percent-encoded dots, which are equivalent to plain ones.
+var dotReplacer = strings.NewReplacer("%2E", ".", "%2e", ".")
+
+// sanitizePath rejects requests whose path has .. segments or NUL bytes, and
+// otherwise cleans it of duplicate slashes and . segments in place, keeping
+// its encoding and any trailing slash.
+func (m *Middleware) sanitizePath(r *http.Request) error {
+	if !m.SanitizePath {
+		return nil
+	}
+	if strings.ContainsRune(r.URL.Path, 0) {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: path contains a NUL byte"))
+	}
+	if slices.Contains(strings.Split(r.URL.Path, "/"), "..") {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: path contains a .. segment"))
+	}
+	escaped := dotReplacer.Replace(escapedPath(r.URL))
+	if !strings.HasPrefix(escaped, "/") {
+		// like the * of OPTIONS requests
+		return nil
+	}
+	clean := path.Clean(escaped)
+	if strings.HasSuffix(escaped, "/") && clean != "/" {
+		clean += "/"
+	}
+	decoded, err := url.PathUnescape(clean)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: invalid path: %w", err))
+	}
+	r.URL.Path, r.URL.RawPath = decoded, ""
+	if r.URL.EscapedPath() != clean {
+		r.URL.RawPath = clean
+	}
+	r.RequestURI = r.URL.RequestURI()
+	return nil
+}
@@ -0,0 +1,250 @@
+package clientproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestAddPrefix(t *testing.T) {
+	for _, prefix := range []string{"/app", "/app/"} {
+		m := &Middleware{Secret: secret, AddPathPrefix: prefix}
+		provision(t, m)
+		s := newServer(t, m)
+		connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RequestURI))
+		}))
+		for _, c := range []struct {
+			path, want string
+		}{
+			{"/", "/app/"},
+			{"/a/b?q=1", "/app/a/b?q=1"},
+			{"/a%2Fb", "/app/a%2Fb"},
+			{"/a%20b", "/app/a%20b"},
+			{"//a", "/app//a"},
+		} {
+			_, body := get(t, s, c.path)
+			ensure.DeepEqual(t, body, c.want, prefix, c.path)
+		}
+	}
+}
+
+func TestAddPrefixInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, AddPathPrefix: "app"}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("add_path_prefix must start with /"))
+}
+
+func TestSanitizePath(t *testing.T) {
+	m := &Middleware{Secret: secret, SanitizePath: true, AddPathPrefix: "/app"}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	for _, c := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/a/b", http.StatusOK, "/app/a/b"},
+		{"//a///b/", http.StatusOK, "/app/a/b/"},
+		{"/a/./b/.", http.StatusOK, "/app/a/b"},
+		{"/a/%2E/b", http.StatusOK, "/app/a/b"},
+		{"/a%2Fb/", http.StatusOK, "/app/a%2Fb/"},
+		{"/a%20b?q=/../", http.StatusOK, "/app/a%20b?q=/../"},
+		{"/a/...", http.StatusOK, "/app/a/..."},
+		{"/a/../b", http.StatusBadRequest, ""},
+		{"/..", http.StatusBadRequest, ""},
+		{"/a/%2e%2E/b", http.StatusBadRequest, ""},
+		{"/..%2Fetc", http.StatusBadRequest, ""},
+		{"/a%2F..%2Fb", http.StatusBadRequest, ""},
+		{"/a%00b", http.StatusBadRequest, ""},
+	} {
+		res, body := get(t, s, c.path)
+		ensure.DeepEqual(t, res.StatusCode, c.status, c.path)
+		if c.status == http.StatusOK {
+			ensure.DeepEqual(t, body, c.want, c.path)
+		}
+	}
+}
+
+// uriServers serves m over HTTP/1 and HTTP/2, parsing the form first as
+// matchers may, and returns clients sending the request URI as is.
+func uriServers(t *testing.T, m *Middleware) map[string]func(uri string) string {
+	inner := newUnstartedServer(m).Config.Handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		inner.ServeHTTP(w, r)
+	})
+	h1 := httptest.NewServer(handler)
+	t.Cleanup(h1.Close)
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+	connect(t, m, h1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	get := func(s *httptest.Server, uri string) string {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		ensure.Nil(t, err)
+		path, query, ok := strings.Cut(uri, "?")
+		req.URL.Opaque = path
+		req.URL.RawQuery = query
+		req.URL.ForceQuery = ok
+		res, err := s.Client().Do(req)
+		ensure.Nil(t, err)
+		defer res.Body.Close()
+		ensure.DeepEqual(t, res.StatusCode, http.StatusOK, uri)
+		body, err := io.ReadAll(res.Body)
+		ensure.Nil(t, err)
+		return string(body)
+	}
+	return map[string]func(string) string{
+		"h1": func(uri string) string { return get(h1, uri) },
+		"h2": func(uri string) string { return get(h2, uri) },
+	}
+}
+
+func TestRequestURIEncoding(t *testing.T) {
+	m := &Middleware{Secret: secret}
+	provision(t, m)
+	for proto, get := range uriServers(t, m) {
+		for _, c := range []struct {
+			uri, want string
+		}{
+			{"/a%2Fb%2fc", "/a%2Fb%2fc"},
+			{"/a%41", "/a%41"},
+			{"/a+b%20c?x=a+b&y=a%20b", "/a+b%20c?x=a+b&y=a%20b"},
+			{"/?=v&&a=&b", "/?=v&&a=&b"},
+			{"/?b=2&a=1;c=3&d=%zz", "/?b=2&a=1;c=3&d=%zz"},
+			{"/a?", "/a?"},
+			{`/a"b`, "/a%22b"},
+			{`/a"b%2f`, "/a%22b%2f"},
+		} {
+			ensure.DeepEqual(t, get(c.uri), c.want, proto, c.uri)
+		}
+	}
+
+	// fragments are never sent
+	s := newServer(t, m)
+	_, body := get(t, s, "/a%2Fb?q#fragment")
+	ensure.DeepEqual(t, body, "/a%2Fb?q")
+}
+
+func TestPreserveRequestURI(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		m         *Middleware
+		uri, want string
+	}{
+		{"untouched", &Middleware{}, `/a"b%2f?x=a+b;c`, `/a"b%2f?x=a+b;c`},
+		{"add_path_prefix", &Middleware{AddPathPrefix: "/app"}, `/a"b`, `/app/a"b`},
+		// the cleaned path is forwarded
+		{"sanitize_path", &Middleware{SanitizePath: true}, `/a//./"b%2f?q`, "/a/%22b%2f?q"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.m.Secret = secret
+			c.m.PreserveRequestURI = true
+			provision(t, c.m)
+			for proto, get := range uriServers(t, c.m) {
+				ensure.DeepEqual(t, get(c.uri), c.want, proto)
+			}
+		})
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	for _, prefix := range []string{"/app", "/app/"} {
+		m := &Middleware{Secret: secret, StripPathPrefix: prefix, AddPathPrefix: "/v2"}
+		provision(t, m)
+		s := newServer(t, m)
+		connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RequestURI))
+		}))
+		for _, c := range []struct {
+			path, want string
+		}{
+			{"/app", "/v2/"},
+			{"/app/", "/v2/"},
+			{"/app/a/b?q=1", "/v2/a/b?q=1"},
+			{"/app/a%2Fb", "/v2/a%2Fb"},
+			{"/%61pp/a%20b", "/v2/a%20b"},
+			{"/app//a", "/v2//a"},
+			{"/apple", "/v2/apple"},
+			{"/app%2Fa", "/v2/app%2Fa"},
+			{"/other", "/v2/other"},
+		} {
+			_, body := get(t, s, c.path)
+			ensure.DeepEqual(t, body, c.want, prefix, c.path)
+		}
+	}
+}
+
+func TestStripPrefixRequired(t *testing.T) {
+	m := &Middleware{Secret: secret, StripPathPrefix: "/app/api", StripPathPrefixRequired: true}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	res, body := get(t, s, "/app/api/a")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "/a")
+	for _, path := range []string{"/app", "/app/apis", "/app/api%2Fa", "/other"} {
+		res, _ := get(t, s, path)
+		ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound, path)
+	}
+}
+
+func TestStripPrefixPreserveRequestURI(t *testing.T) {
+	m := &Middleware{Secret: secret, StripPathPrefix: "/app", PreserveRequestURI: true}
+	provision(t, m)
+	for proto, get := range uriServers(t, m) {
+		ensure.DeepEqual(t, get(`/app/a%2fb/"c"?q=1`), `/a%2fb/"c"?q=1`, proto)
+		ensure.DeepEqual(t, get("/app"), "/", proto)
+		ensure.DeepEqual(t, get("/apple"), "/apple", proto)
+	}
+}
+
+func TestStripPrefixInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, StripPathPrefix: "app"}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("strip_path_prefix must start with /"))
+	m = &Middleware{Secret: secret, StripPathPrefixRequired: true}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("strip_path_prefix_required requires strip_path_prefix"))
+}
+
+func TestPreserveHost(t *testing.T) {
+	for _, c := range []struct {
+		preserve *bool
+		want     string
+	}{
+		{nil, "app.example.com spoofed.example.com"},
+		{func() *bool { v := true; return &v }(), "app.example.com spoofed.example.com"},
+		// the host the client registered at, and the original forwarded
+		{new(bool), "example.com app.example.com"},
+	} {
+		m := &Middleware{Secret: secret, PreserveHost: c.preserve}
+		provision(t, m)
+		s := newServer(t, m)
+		connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Host, r.Header.Get("X-Forwarded-Host"))
+		}))
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		ensure.Nil(t, err)
+		req.Host = "app.example.com"
+		req.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, string(body), c.want)
+	}
+}
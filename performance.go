@@ -0,0 +1,219 @@
+package clientproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/net/http2"
+)
+
+const (
+	minFrameSize = 16 << 10
+	maxFrameSize = 1<<24 - 1
+
+	defaultFlushInterval = time.Millisecond
+)
+
+// Performance tunes the HTTP/2 connection to the client.
+type Performance struct {
+	// The largest frame the client may send, between 16KiB and 16MiB. Larger
+	// frames mean less framing overhead for large responses. Defaults to
+	// 16KiB.
+	MaxReadFrameSize uint32 `json:"max_read_frame_size,omitempty"`
+
+	// Buffer writes to the client up to this many bytes. The HTTP/2 transport
+	// writes every frame as soon as it is ready, which for uploads arriving
+	// in small reads means many small writes on the connection. Defaults to
+	// no buffering.
+	WriteBufferSize int `json:"write_buffer_size,omitempty"`
+
+	// How long buffered writes may wait before being written. Defaults to 1ms.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// Ping the client when nothing was read from it for this long, closing the
+	// connection if it does not reply within ping_timeout. Defaults to no
+	// pings, leaving broken connections to be noticed by failed writes.
+	ReadIdleTimeout caddy.Duration `json:"read_idle_timeout,omitempty"`
+
+	// How long to wait for the reply to a ping. Defaults to 15s.
+	PingTimeout caddy.Duration `json:"ping_timeout,omitempty"`
+
+	// The size of the operating system receive and send buffers of the TCP
+	// connection to the client. Larger buffers allow more throughput on
+	// connections with a high latency. Defaults to the system default.
+	SocketReadBuffer  int `json:"socket_read_buffer,omitempty"`
+	SocketWriteBuffer int `json:"socket_write_buffer,omitempty"`
+
+	// Send small writes to the client, like the events of SSE or gRPC
+	// messages, without waiting to combine them, disabling Nagle's algorithm
+	// on the TCP connection. Defaults to true, as for all TCP connections in
+	// Go.
+	TCPNoDelay *bool `json:"tcp_nodelay,omitempty"`
+}
+
+func (p *Performance) validate() error {
+	if p.MaxReadFrameSize != 0 && (p.MaxReadFrameSize < minFrameSize || p.MaxReadFrameSize > maxFrameSize) {
+		return fmt.Errorf("performance max_read_frame_size must be between 16KiB and 16MiB, got %d", p.MaxReadFrameSize)
+	}
+	if p.WriteBufferSize < 0 {
+		return fmt.Errorf("performance write_buffer_size must not be negative, got %d", p.WriteBufferSize)
+	}
+	if p.SocketReadBuffer < 0 || p.SocketWriteBuffer < 0 {
+		return fmt.Errorf("performance socket buffers must not be negative, got %d and %d", p.SocketReadBuffer, p.SocketWriteBuffer)
+	}
+	return nil
+}
+
+// tcpConn returns the TCP connection underlying conn, unwrapping the
+// connections of listener wrappers like tls, which have a NetConn method, or
+// proxy_protocol, which have a Raw method. Otherwise the error starts with
+// requirer, like "socket buffers require".
+func tcpConn(conn net.Conn, requirer string) (*net.TCPConn, error) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		case interface{ Raw() net.Conn }:
+			conn = c.Raw()
+		default:
+			return nil, fmt.Errorf("%s a TCP connection, got %T", requirer, conn)
+		}
+	}
+}
+
+// setSocketBuffers sets the socket buffer sizes of conn, if configured. It
+// fails for connections other than TCP, which have no such buffers.
+func (p *Performance) setSocketBuffers(conn net.Conn) error {
+	if p == nil || p.SocketReadBuffer == 0 && p.SocketWriteBuffer == 0 {
+		return nil
+	}
+	tc, err := tcpConn(conn, "socket buffers require")
+	if err != nil {
+		return err
+	}
+	if p.SocketReadBuffer > 0 {
+		if err := tc.SetReadBuffer(p.SocketReadBuffer); err != nil {
+			return err
+		}
+	}
+	if p.SocketWriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(p.SocketWriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setNoDelay sets TCP_NODELAY on conn, if configured. It fails for connections
+// other than TCP.
+func (p *Performance) setNoDelay(conn net.Conn) error {
+	if p == nil || p.TCPNoDelay == nil {
+		return nil
+	}
+	tc, err := tcpConn(conn, "tcp_nodelay requires")
+	if err != nil {
+		return err
+	}
+	return tc.SetNoDelay(*p.TCPNoDelay)
+}
+
+// transport returns the HTTP/2 transport to create connections to clients
+// with, accepting response headers of up to maxHeaderListSize, or the default
+// if 0.
+func (p *Performance) transport(maxHeaderListSize uint32) *http2.Transport {
+	if p == nil {
+		if maxHeaderListSize == 0 {
+			return &h2t
+		}
+		return &http2.Transport{MaxHeaderListSize: maxHeaderListSize}
+	}
+	return &http2.Transport{
+		MaxReadFrameSize:  p.MaxReadFrameSize,
+		ReadIdleTimeout:   time.Duration(p.ReadIdleTimeout),
+		PingTimeout:       time.Duration(p.PingTimeout),
+		MaxHeaderListSize: maxHeaderListSize,
+	}
+}
+
+// wrap returns conn with writes buffered, if configured.
+func (p *Performance) wrap(conn net.Conn) net.Conn {
+	if p == nil || p.WriteBufferSize == 0 {
+		return conn
+	}
+	interval := time.Duration(p.FlushInterval)
+	if interval == 0 {
+		interval = defaultFlushInterval
+	}
+	return &writeBufferConn{
+		Conn:     conn,
+		interval: interval,
+		bw:       bufio.NewWriterSize(conn, p.WriteBufferSize),
+	}
+}
+
+// writeBufferConn buffers writes, writing them once the buffer is full or
+// interval after the first buffered write. A failed write is returned by the
+// next Write, and closes the connection so the reader notices too.
+type writeBufferConn struct {
+	net.Conn
+	interval time.Duration
+
+	mu    sync.Mutex
+	bw    *bufio.Writer
+	timer *time.Timer
+	err   error
+}
+
+func (c *writeBufferConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.bw.Write(p)
+	if err != nil {
+		c.fail(err)
+		return n, err
+	}
+	if c.bw.Buffered() > 0 && c.timer == nil {
+		c.timer = time.AfterFunc(c.interval, c.flush)
+	}
+	return n, nil
+}
+
+func (c *writeBufferConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if c.err != nil {
+		return
+	}
+	if err := c.bw.Flush(); err != nil {
+		c.fail(err)
+	}
+}
+
+// fail records err and closes the connection. It must be called with mu held.
+func (c *writeBufferConn) fail(err error) {
+	c.err = err
+	c.Conn.Close()
+}
+
+// Close closes the connection, dropping buffered writes. It does not wait for
+// mu, which a write blocked on the connection may be holding.
+func (c *writeBufferConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package clientproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+// socketBuffer returns the size of the opt buffer of conn.
+func socketBuffer(t testing.TB, conn *net.TCPConn, opt int) int {
+	raw, err := conn.SyscallConn()
+	ensure.Nil(t, err)
+	var size int
+	var serr error
+	ensure.Nil(t, raw.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}))
+	ensure.Nil(t, serr)
+	return size
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	ensure.Nil(t, err)
+	defer conn.Close()
+
+	tc := conn.(*net.TCPConn)
+	read, write := socketBuffer(t, tc, syscall.SO_RCVBUF), socketBuffer(t, tc, syscall.SO_SNDBUF)
+	p := &Performance{SocketReadBuffer: 2*read + 4096, SocketWriteBuffer: 2*write + 4096}
+	ensure.Nil(t, p.setSocketBuffers(conn))
+	// the kernel doubles the requested sizes for its bookkeeping
+	ensure.True(t, socketBuffer(t, tc, syscall.SO_RCVBUF) >= p.SocketReadBuffer)
+	ensure.True(t, socketBuffer(t, tc, syscall.SO_SNDBUF) >= p.SocketWriteBuffer)
+
+	// through listener wrappers
+	p = &Performance{SocketReadBuffer: 2 * p.SocketReadBuffer}
+	ensure.Nil(t, p.setSocketBuffers(tls.Server(rawConn{conn}, &tls.Config{})))
+	ensure.True(t, socketBuffer(t, tc, syscall.SO_RCVBUF) >= p.SocketReadBuffer)
+}
+
+func TestSetNoDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	ensure.Nil(t, err)
+	defer conn.Close()
+
+	tc := conn.(*net.TCPConn)
+	noDelay := func() int {
+		raw, err := tc.SyscallConn()
+		ensure.Nil(t, err)
+		var v int
+		var serr error
+		ensure.Nil(t, raw.Control(func(fd uintptr) {
+			v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		}))
+		ensure.Nil(t, serr)
+		return v
+	}
+	// Go enables it on all TCP connections
+	ensure.True(t, noDelay() != 0)
+	off, on := false, true
+	ensure.Nil(t, (&Performance{TCPNoDelay: &off}).setNoDelay(conn))
+	ensure.DeepEqual(t, noDelay(), 0)
+
+	// through listener wrappers
+	ensure.Nil(t, (&Performance{TCPNoDelay: &on}).setNoDelay(tls.Server(rawConn{conn}, &tls.Config{})))
+	ensure.True(t, noDelay() != 0)
+}
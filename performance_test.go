@@ -0,0 +1,205 @@
+package clientproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/http2"
+)
+
+// latencyConn delays every write, standing in for the per-write cost of a
+// real network connection.
+type latencyConn struct {
+	net.Conn
+	latency time.Duration
+	writes  atomic.Int64
+}
+
+func (c *latencyConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	time.Sleep(c.latency)
+	return c.Conn.Write(p)
+}
+
+// chunkReader returns at most chunk bytes per Read, like an upload arriving
+// in small reads.
+type chunkReader struct {
+	r     io.Reader
+	chunk int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	return c.r.Read(p)
+}
+
+func TestPerformance(t *testing.T) {
+	m := &Middleware{Secret: secret, Performance: &Performance{
+		MaxReadFrameSize: 1 << 20,
+		WriteBufferSize:  64 << 10,
+		FlushInterval:    caddy.Duration(5 * time.Millisecond),
+	}}
+	provision(t, m)
+	ensure.DeepEqual(t, m.h2t.MaxReadFrameSize, uint32(1<<20))
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+}
+
+func TestWriteBufferConn(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	lc := &latencyConn{Conn: client}
+	conn := (&Performance{
+		WriteBufferSize: 16,
+		FlushInterval:   caddy.Duration(10 * time.Millisecond),
+	}).wrap(lc)
+
+	// small writes wait for the flush interval
+	start := time.Now()
+	for _, s := range []string{"a", "b", "c"} {
+		_, err := io.WriteString(conn, s)
+		ensure.Nil(t, err)
+	}
+	b := make([]byte, 3)
+	_, err := io.ReadFull(server, b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(b), "abc")
+	ensure.True(t, time.Since(start) >= 10*time.Millisecond)
+	ensure.DeepEqual(t, lc.writes.Load(), int64(1))
+
+	// a failed flush fails the next write
+	server.Close()
+	_, err = io.WriteString(conn, "d")
+	ensure.Nil(t, err)
+	eventually(t, func() bool {
+		_, err := io.WriteString(conn, "e")
+		return err != nil
+	})
+	ensure.Nil(t, conn.Close())
+}
+
+func TestSetSocketBuffersNotTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	p := &Performance{SocketReadBuffer: 1 << 20}
+	ensure.Err(t, p.setSocketBuffers(server), regexp.MustCompile("socket buffers require a TCP connection"))
+	ensure.Nil(t, (&Performance{}).setSocketBuffers(server))
+	// wrappers are unwrapped to the connection they wrap
+	ensure.Err(t, p.setSocketBuffers(tls.Server(rawConn{server}, &tls.Config{})),
+		regexp.MustCompile(`socket buffers require a TCP connection, got \*net.pipe`))
+	off := false
+	ensure.Err(t, (&Performance{TCPNoDelay: &off}).setNoDelay(server),
+		regexp.MustCompile(`tcp_nodelay requires a TCP connection, got \*net.pipe`))
+	ensure.Nil(t, (&Performance{}).setNoDelay(server))
+
+	// registrations over TCP get them
+	m := &Middleware{Secret: secret, Performance: p}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+}
+
+// rawConn wraps a connection like proxy_protocol does.
+type rawConn struct {
+	net.Conn
+}
+
+func (c rawConn) Raw() net.Conn { return c.Conn }
+
+func TestPerformanceInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, Performance: &Performance{MaxReadFrameSize: 1024}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("max_read_frame_size must be between"))
+}
+
+// benchmarkTransfer measures sending size bytes through a ClientConn to an
+// HTTP/2 server over net.Pipe, with every write delayed by latency. The body
+// is sent as an upload in chunks of 1KiB, or if download is set, as the
+// response. The writes/op metric counts the writes by the sending side.
+func benchmarkTransfer(b *testing.B, p *Performance, download bool) {
+	const (
+		size    = 1 << 20
+		latency = 20 * time.Microsecond
+	)
+	payload := bytes.Repeat([]byte("x"), size)
+	client, server := net.Pipe()
+	b.Cleanup(func() { client.Close() })
+	sc := &latencyConn{Conn: server, latency: latency}
+	go (&http2.Server{}).ServeConn(sc, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if download {
+				w.Write(payload)
+				return
+			}
+			io.Copy(io.Discard, r.Body)
+		}),
+	})
+	lc := &latencyConn{Conn: client, latency: latency}
+	cc, err := p.transport(0).NewClientConn(p.wrap(lc))
+	ensure.Nil(b, err)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for range b.N {
+		var body io.Reader
+		method := http.MethodGet
+		if !download {
+			method = http.MethodPost
+			body = &chunkReader{r: bytes.NewReader(payload), chunk: 1 << 10}
+		}
+		req, err := http.NewRequest(method, "https://client", body)
+		ensure.Nil(b, err)
+		res, err := cc.RoundTrip(req)
+		ensure.Nil(b, err)
+		_, err = io.Copy(io.Discard, res.Body)
+		ensure.Nil(b, err)
+		res.Body.Close()
+	}
+	sender := lc
+	if download {
+		sender = sc
+	}
+	b.ReportMetric(float64(sender.writes.Load())/float64(b.N), "writes/op")
+}
+
+func BenchmarkUpload(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkTransfer(b, nil, false)
+	})
+	for _, size := range []int{16 << 10, 64 << 10, 256 << 10} {
+		b.Run("write_buffer_size="+humanSize(size), func(b *testing.B) {
+			benchmarkTransfer(b, &Performance{WriteBufferSize: size}, false)
+		})
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkTransfer(b, nil, true)
+	})
+	for _, size := range []uint32{64 << 10, 1 << 20} {
+		b.Run("max_read_frame_size="+humanSize(int(size)), func(b *testing.B) {
+			benchmarkTransfer(b, &Performance{MaxReadFrameSize: size}, true)
+		})
+	}
+}
+
+func humanSize(n int) string {
+	return humanize.IBytes(uint64(n))
+}
@@ -0,0 +1,61 @@
+package clientproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteRedirects replaces the internal authorities of the client in the
+// Location header of redirects with the authority the request was made to.
+// Relative locations are left alone, as they already resolve against it,
+// except for adding back the strip_path_prefix to absolute paths.
+func (m *Middleware) rewriteRedirects(res *http.Response) error {
+	if res.StatusCode < 300 || res.StatusCode > 399 {
+		return nil
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil
+	}
+	if u.Host == "" {
+		if u.Scheme == "" && strings.HasPrefix(u.Path, "/") && m.publicPath(u) {
+			res.Header.Set("Location", u.String())
+		}
+		return nil
+	}
+	if !m.isInternalAuthority(u.Host) {
+		return nil
+	}
+	m.publicPath(u)
+	if u.Scheme != "" {
+		u.Scheme = "http"
+		if res.Request.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	u.Host = res.Request.Host
+	res.Header.Set("Location", u.String())
+	return nil
+}
+
+// isInternalAuthority reports if authority matches rewrite_redirects. Entries
+// with a port must match exactly, and others match the host with any port.
+func (m *Middleware) isInternalAuthority(authority string) bool {
+	authority = strings.ToLower(authority)
+	for _, a := range m.RewriteRedirects {
+		a = strings.ToLower(a)
+		if strings.Contains(a, ":") {
+			if a == authority {
+				return true
+			}
+		} else if hostMatches(a, requestHost(authority)) {
+			return true
+		}
+	}
+	return false
+}
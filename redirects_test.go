@@ -0,0 +1,96 @@
+package clientproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestRewriteRedirects(t *testing.T) {
+	m := &Middleware{Secret: secret, RewriteRedirects: []string{"localhost:8080", "*.internal"}}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusFound
+		if r.URL.Query().Has("created") {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		w.WriteHeader(status)
+	}))
+	tlsServer := newUnstartedServer(m)
+	tlsServer.StartTLS()
+	t.Cleanup(tlsServer.Close)
+
+	location := func(s *httptest.Server, query string) string {
+		client := s.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		res, err := client.Get(s.URL + "/?" + query)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		return res.Header.Get("Location")
+	}
+	host := s.Listener.Addr().String()
+	for _, c := range []struct {
+		to, want string
+	}{
+		{"http://localhost:8080/login?next=%2F", "http://" + host + "/login?next=%2F"},
+		{"http://app.internal:9000/a", "http://" + host + "/a"},
+		{"//localhost:8080/a", "//" + host + "/a"},
+		{"/relative", "/relative"},
+		{"relative", "relative"},
+		{"http://localhost:9090/other-port", "http://localhost:9090/other-port"},
+		{"https://example.com/external", "https://example.com/external"},
+	} {
+		ensure.DeepEqual(t, location(s, "to="+url.QueryEscape(c.to)), c.want, c.to)
+	}
+
+	// the scheme follows the request
+	ensure.DeepEqual(t, location(tlsServer, "to=http://localhost:8080/a"),
+		"https://"+tlsServer.Listener.Addr().String()+"/a")
+
+	// only redirects are rewritten
+	ensure.DeepEqual(t, location(s, "created&to=http://localhost:8080/a"), "http://localhost:8080/a")
+}
+
+func TestRewriteRedirectsStripPrefix(t *testing.T) {
+	m := &Middleware{
+		Secret:           secret,
+		RewriteRedirects: []string{"localhost:8080"},
+		StripPathPrefix:  "/app",
+		AddPathPrefix:    "/v2",
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		w.WriteHeader(http.StatusFound)
+	}))
+	client := s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	host := s.Listener.Addr().String()
+	for _, c := range []struct {
+		to, want string
+	}{
+		{"/v2/login?next=%2F", "/app/login?next=%2F"},
+		{"/v2", "/app/"},
+		{"/v2/a%2Fb", "/app/a%2Fb"},
+		{"http://localhost:8080/v2/login", "http://" + host + "/app/login"},
+		{"//localhost:8080/v2/a", "//" + host + "/app/a"},
+		{"/other", "/other"},
+		{"relative", "relative"},
+		{"https://example.com/v2/external", "https://example.com/v2/external"},
+	} {
+		res, err := client.Get(s.URL + "/app/?to=" + url.QueryEscape(c.to))
+		ensure.Nil(t, err)
+		res.Body.Close()
+		ensure.DeepEqual(t, res.Header.Get("Location"), c.want, c.to)
+	}
+}
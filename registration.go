@@ -0,0 +1,64 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxRegistrationBodySize is the largest JSON body a registration may carry.
+const maxRegistrationBodySize = 64 << 10
+
+// RegistrationBody is the JSON body a registration may carry with
+// registration_body, describing the client without many headers.
+type RegistrationBody struct {
+	// The hosts the client claims, as with the X-Client-Proxy-Hosts header,
+	// which takes precedence.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// The path prefixes the client claims, as with the X-Client-Proxy-Paths
+	// header, which takes precedence.
+	Paths []string `json:"paths,omitempty"`
+
+	// Describes the client, like its region or capabilities. It is reported
+	// in the status of the admin API.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// readRegistrationBody reads the JSON body of r, if registration_body is set
+// and r has one. It must be read before the connection is hijacked, as the
+// HTTP/2 connection follows it.
+func (m *Middleware) readRegistrationBody(w http.ResponseWriter, r *http.Request) (*RegistrationBody, error) {
+	if !m.RegistrationBody || r.ContentLength == 0 {
+		return &RegistrationBody{}, nil
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "application/json" {
+		return nil, caddyhttp.Error(http.StatusUnsupportedMediaType,
+			fmt.Errorf("client_proxy: registration body must be application/json, got %q", mt))
+	}
+	if r.ContentLength > maxRegistrationBodySize {
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("client_proxy: registration body of %d bytes exceeds limit of %d", r.ContentLength, maxRegistrationBodySize))
+	}
+	// read entirely, leaving nothing before the HTTP/2 connection
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRegistrationBodySize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge,
+				fmt.Errorf("client_proxy: registration body exceeds limit of %d", maxRegistrationBodySize))
+		}
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: reading registration body: %w", err))
+	}
+	var body RegistrationBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: invalid registration body: %w", err))
+	}
+	return &body, nil
+}
@@ -0,0 +1,71 @@
+package clientproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+func TestRegistrationBody(t *testing.T) {
+	m := &Middleware{Secret: secret, RegistrationBody: true, AllowedHosts: []string{"*.example.com"}}
+	provision(t, m)
+	s := newServer(t, m)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	ensure.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/",
+		strings.NewReader(`{"hosts": ["A.example.com"], "paths": ["/api/"], "metadata": {"region": "eu"}}`))
+	ensure.Nil(t, err)
+	req.Header.Set("X-Client-Proxy", secret)
+	req.Header.Set("Content-Type", "application/json")
+	ensure.Nil(t, req.Write(conn))
+	go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(hello)})
+	eventually(t, func() bool { return m.handler.Load() != nil })
+
+	client := m.status().Client
+	ensure.DeepEqual(t, client.Hosts, []string{"a.example.com"})
+	ensure.DeepEqual(t, client.Paths, []string{"/api/"})
+	ensure.DeepEqual(t, client.Metadata, map[string]string{"region": "eu"})
+	for host, status := range map[string]int{"a.example.com": http.StatusOK, "b.example.com": http.StatusNotFound} {
+		req, err := http.NewRequest(http.MethodGet, s.URL+"/api/x", nil)
+		ensure.Nil(t, err)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		ensure.DeepEqual(t, res.StatusCode, status, host)
+	}
+}
+
+func TestRegistrationBodyInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, RegistrationBody: true, AllowedHosts: []string{"*.example.com"}}
+	provision(t, m)
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"not json", "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{"invalid", "application/json", `{"hosts": "a"}`, http.StatusBadRequest},
+		{"too large", "application/json", `{"x": "` + strings.Repeat("x", maxRegistrationBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"host not allowed", "application/json", `{"hosts": ["a.example.org"]}`, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", strings.NewReader(c.body))
+		r.Header.Set("X-Client-Proxy", secret)
+		r.Header.Set("Content-Type", c.contentType)
+		err := m.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var herr caddyhttp.HandlerError
+		ensure.True(t, errors.As(err, &herr), c.name, err)
+		ensure.DeepEqual(t, herr.StatusCode, c.status, c.name)
+	}
+	ensure.True(t, m.handler.Load() == nil)
+}
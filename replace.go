@@ -0,0 +1,175 @@
+package clientproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultReplaceMaxSize = 1 << 20
+	replaceChunkSize      = 32 << 10
+)
+
+// ReplaceResponse configures simple substitutions in the body of text
+// responses from the client. Responses the client compressed are not
+// rewritten.
+type ReplaceResponse struct {
+	// The substitutions to make, leftmost first.
+	Replace []*Replacement `json:"replace,omitempty"`
+
+	// The maximum size in bytes of responses to rewrite. Larger responses are
+	// forwarded as is, and those of unknown length are only rewritten up to
+	// this size. Defaults to 1MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// Replacement replaces Search with Replace.
+type Replacement struct {
+	Search  string `json:"search"`
+	Replace string `json:"replace"`
+}
+
+func (rr *ReplaceResponse) validate() error {
+	if len(rr.Replace) == 0 {
+		return fmt.Errorf("replace_response requires a replacement")
+	}
+	for _, r := range rr.Replace {
+		if r.Search == "" {
+			return fmt.Errorf("replace_response search must not be empty")
+		}
+	}
+	return nil
+}
+
+// rewrites reports if the body of res should be rewritten.
+func (rr *ReplaceResponse) rewrites(res *http.Response) bool {
+	// the byte ranges of a 206 would no longer match the rewritten length
+	switch {
+	case res.Request.Method == http.MethodHead, res.StatusCode < 200,
+		res.StatusCode == http.StatusNoContent, res.StatusCode == http.StatusPartialContent,
+		res.StatusCode == http.StatusNotModified:
+		return false
+	}
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "text/") {
+		return false
+	}
+	return res.ContentLength <= rr.maxSize()
+}
+
+func (rr *ReplaceResponse) maxSize() int64 {
+	if rr.MaxSize > 0 {
+		return rr.MaxSize
+	}
+	return defaultReplaceMaxSize
+}
+
+// replaceResponse makes the substitutions in the body of res as it streams.
+func (m *Middleware) replaceResponse(res *http.Response) error {
+	rr := m.ReplaceResponse
+	if !rr.rewrites(res) {
+		return nil
+	}
+	keep := 0
+	for _, r := range rr.Replace {
+		keep = max(keep, len(r.Search)-1)
+	}
+	res.Body = &replaceBody{
+		ReadCloser: res.Body,
+		replace:    rr.Replace,
+		keep:       keep,
+		remaining:  rr.maxSize(),
+	}
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	// the body is no longer byte for byte the one they describe
+	res.Header.Del("Content-MD5")
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// replaceBody makes substitutions in the body it reads from, holding back
+// enough of what it read for a match across reads.
+type replaceBody struct {
+	io.ReadCloser
+	replace   []*Replacement
+	keep      int
+	remaining int64 // bytes left to rewrite
+
+	buf []byte
+	in  []byte // read and not yet rewritten
+	out []byte // rewritten and not yet returned
+	err error
+}
+
+func (b *replaceBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 && (b.err == nil || len(b.in) > 0) {
+		if b.err == nil {
+			b.fill()
+		}
+		b.rewrite()
+	}
+	if len(b.out) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+// fill reads the next chunk into in, or passes it through once past the
+// rewritten size.
+func (b *replaceBody) fill() {
+	if b.buf == nil {
+		b.buf = make([]byte, replaceChunkSize)
+	}
+	n, err := b.ReadCloser.Read(b.buf)
+	if err != nil {
+		b.err = err
+	}
+	if b.remaining <= 0 {
+		b.out = append(b.out, b.buf[:n]...)
+		return
+	}
+	b.remaining -= int64(n)
+	b.in = append(b.in, b.buf[:n]...)
+}
+
+// rewrite moves what can be rewritten from in to out, holding back what may
+// be the start of a match unless the body ended or is past the rewritten
+// size.
+func (b *replaceBody) rewrite() {
+	final := b.err != nil || b.remaining <= 0
+	for {
+		at, match := -1, (*Replacement)(nil)
+		for _, r := range b.replace {
+			if i := bytes.Index(b.in, []byte(r.Search)); i >= 0 && (at < 0 || i < at) {
+				at, match = i, r
+			}
+		}
+		// a longer match starting before it may not have been read yet
+		if match == nil || !final && at+b.keep >= len(b.in) {
+			break
+		}
+		b.out = append(b.out, b.in[:at]...)
+		b.out = append(b.out, match.Replace...)
+		b.in = b.in[at+len(match.Search):]
+	}
+	n := len(b.in) - b.keep
+	if final {
+		n = len(b.in)
+	}
+	if n > 0 {
+		b.out = append(b.out, b.in[:n]...)
+		b.in = b.in[n:]
+	}
+}
@@ -0,0 +1,98 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/daaku/ensure"
+)
+
+func TestReplaceResponse(t *testing.T) {
+	m := &Middleware{Secret: secret, ReplaceResponse: &ReplaceResponse{
+		Replace: []*Replacement{{Search: "localhost:8080", Replace: "example.com"}},
+		MaxSize: 100,
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		w.Header().Set("Content-Type", q.Get("type"))
+		if ce := q.Get("encoding"); ce != "" {
+			w.Header().Set("Content-Encoding", ce)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-MD5", "Q2hlY2sgSW50ZWdyaXR5IQ==")
+		if q.Has("partial") {
+			w.Header().Set("Content-Range", "bytes 0-26/100")
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		body := "see http://localhost:8080/a"
+		if q.Has("large") {
+			body += strings.Repeat(".", 100)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body)
+	}))
+	for _, c := range []struct {
+		query, want string
+	}{
+		{"type=text/html%3B+charset=utf-8", "see http://example.com/a"},
+		{"type=text/plain", "see http://example.com/a"},
+		{"type=application/json", "see http://localhost:8080/a"},
+		{"type=", "see http://localhost:8080/a"},
+		{"type=text/plain&encoding=br", "see http://localhost:8080/a"},
+	} {
+		_, body := get(t, s, "/?"+c.query)
+		ensure.DeepEqual(t, body, c.want, c.query)
+	}
+	res, body := get(t, s, "/?type=text/plain&large")
+	ensure.DeepEqual(t, res.ContentLength, int64(127))
+	ensure.True(t, strings.HasPrefix(body, "see http://localhost:8080/a"))
+	ensure.DeepEqual(t, res.Header.Get("ETag"), `"v1"`)
+
+	// the validators no longer describe a rewritten body
+	res, _ = get(t, s, "/?type=text/plain")
+	ensure.DeepEqual(t, res.Header.Get("ETag"), `W/"v1"`)
+	ensure.DeepEqual(t, res.Header.Get("Content-MD5"), "")
+
+	// nor would the byte range of a partial response
+	res, body = get(t, s, "/?type=text/plain&partial")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusPartialContent)
+	ensure.DeepEqual(t, body, "see http://localhost:8080/a")
+}
+
+func TestReplaceBody(t *testing.T) {
+	replace := []*Replacement{
+		{Search: "abc", Replace: "X"},
+		{Search: "b", Replace: "Y"},
+	}
+	read := func(in string, remaining int64) string {
+		b := &replaceBody{
+			ReadCloser: io.NopCloser(iotest.OneByteReader(strings.NewReader(in))),
+			replace:    replace,
+			keep:       2,
+			remaining:  remaining,
+		}
+		out, err := io.ReadAll(iotest.OneByteReader(b))
+		ensure.Nil(t, err)
+		return string(out)
+	}
+	// matches across reads, leftmost first
+	ensure.DeepEqual(t, read("1abc2b3ab", 100), "1X2Y3aY")
+	ensure.DeepEqual(t, read("ab", 100), "aY")
+	ensure.DeepEqual(t, read("", 100), "")
+	// only rewritten up to the limit
+	ensure.DeepEqual(t, read("abcabcabc", 4), "Xabcabc")
+}
+
+func TestReplaceResponseInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, ReplaceResponse: &ReplaceResponse{}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("requires a replacement"))
+	m.ReplaceResponse.Replace = []*Replacement{{Replace: "a"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("search must not be empty"))
+}
@@ -0,0 +1,47 @@
+package clientproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// isStreamReset reports if err is the client resetting the stream.
+func isStreamReset(err error) bool {
+	var se http2.StreamError
+	return errors.As(err, &se)
+}
+
+// countStreamResets counts the client resetting the stream while the
+// response body is being forwarded. The downstream response is aborted, as its
+// status was already sent.
+func (m *Middleware) countStreamResets(res *http.Response) error {
+	res.Body = &resetBody{ReadCloser: res.Body, m: m, res: res}
+	return nil
+}
+
+type resetBody struct {
+	io.ReadCloser
+	m   *Middleware
+	res *http.Response
+}
+
+func (b *resetBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && isStreamReset(err) {
+		b.m.streamReset(b.res.Request, err)
+	}
+	return n, err
+}
+
+// streamReset records the client resetting the stream of r.
+func (m *Middleware) streamReset(r *http.Request, err error) {
+	m.counters.streamResets.Add(1)
+	m.metrics.streamResets.Inc()
+	m.logger.Debug("client reset stream",
+		zap.String("uri", r.RequestURI),
+		zap.Error(err))
+}
@@ -0,0 +1,47 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestStreamResetBeforeResponse(t *testing.T) {
+	for _, status := range []int{0, http.StatusServiceUnavailable} {
+		m := &Middleware{Secret: secret, StreamResetStatus: status}
+		provision(t, m)
+		s := newServer(t, m)
+		connect(t, m, s, http.HandlerFunc(abort))
+		res, _ := get(t, s, "/")
+		want := status
+		if want == 0 {
+			want = http.StatusBadGateway
+		}
+		ensure.DeepEqual(t, res.StatusCode, want)
+		ensure.DeepEqual(t, m.status().Counters.StreamResets, uint64(1))
+	}
+}
+
+func TestStreamResetMidResponse(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	res, err := http.Get(s.URL)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	_, err = io.ReadAll(res.Body)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, m.status().Counters.StreamResets, uint64(1))
+}
+
+func TestStreamResetStatusInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, StreamResetStatus: http.StatusOK}
+	ensure.NotNil(t, m.Validate())
+}
@@ -0,0 +1,217 @@
+package clientproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// defaultTryInterval is used when try_duration is set without try_interval.
+	defaultTryInterval = 250 * time.Millisecond
+
+	// maxRetryBody is the largest request body buffered so it can be retried.
+	maxRetryBody = 1 << 20
+)
+
+// retryTransport retries failed requests for up to the configured try
+// duration, picking up the newest registered client on each attempt, or
+// waiting for one to register while none is.
+type retryTransport struct {
+	m         *Middleware
+	transport http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.m.retryable(r) {
+		return t.transport.RoundTrip(r)
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		// only bodies of a known and small size are buffered to be resent
+		if r.ContentLength <= 0 || r.ContentLength > maxRetryBody {
+			return t.transport.RoundTrip(r)
+		}
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	interval := time.Duration(t.m.TryInterval)
+	if interval <= 0 {
+		interval = defaultTryInterval
+	}
+	deadline := time.Now().Add(time.Duration(t.m.TryDuration))
+	origin, _ := r.Context().Value(handlerKey{}).(*handler)
+	var h *handler // the client attempted, if not the one r was forwarded to
+	for attempt := 1; ; attempt++ {
+		req := r
+		if body != nil {
+			req = r.Clone(r.Context())
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		var res *http.Response
+		var err error
+		if h == nil {
+			res, err = t.transport.RoundTrip(req)
+		} else {
+			res, err = t.m.retryOn(h, req)
+		}
+		if err == nil || r.Context().Err() != nil || time.Now().Add(interval).After(deadline) {
+			if attempt > 1 {
+				t.m.logger.Debug("retried request",
+					zap.String("uri", r.RequestURI),
+					zap.Int("attempts", attempt),
+					zap.Error(err))
+			}
+			return res, err
+		}
+		t.m.counters.retries.Add(1)
+		t.m.metrics.retries.Inc()
+		timer := time.NewTimer(interval)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+		next := t.m.handler.Load()
+		if next == nil {
+			// rather than attempting again to no avail, wait for a client
+			if next = t.m.waitForClient(r.Context(), time.Until(deadline)); next == nil {
+				if r.Context().Err() != nil {
+					return nil, r.Context().Err()
+				}
+				return res, err
+			}
+		}
+		if next == origin {
+			h = nil
+		} else if next.serves(r) {
+			h = next
+		}
+	}
+}
+
+// handlerKey is the context key of the handler a request was forwarded to,
+// set when retrying is enabled.
+type handlerKey struct{}
+
+// retryOn sends a retry of r to the client of h, as forward does for the first
+// attempt: to the client that replaced h if it was closed, within its
+// max_inflight, and counted as one of its requests. The slot is released once
+// the response body is closed.
+func (m *Middleware) retryOn(h *handler, r *http.Request) (*http.Response, error) {
+	h, err := m.liveHandler(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if limit := m.inflightLimit(h); !h.acquire(limit) {
+		return nil, fmt.Errorf("client_proxy: client has its max_inflight of %d requests", limit)
+	}
+	h.requests.Add(1)
+	h.lastUsed.Store(time.Now().UnixNano())
+	res, err := h.transport.RoundTrip(r)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	res.Body = &releaseBody{ReadCloser: res.Body, release: h.release}
+	return res, nil
+}
+
+// releaseBody calls release once closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// replacedTransport sends requests over conn, or over the client that
+// replaced it if conn was shutting down before the request was sent, which
+// happens when a request loaded the client just before it was replaced.
+type replacedTransport struct {
+	m    *Middleware
+	conn *http2.ClientConn
+}
+
+func (t replacedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	conn := t.conn
+	if isClosing(conn) {
+		if h := t.replacement(r); h != nil {
+			conn = h.conn
+		}
+	}
+	// the headers may reach the client even if writing them failed
+	var sent atomic.Bool
+	trace := &httptrace.ClientTrace{WroteHeaders: func() { sent.Store(true) }}
+	res, err := conn.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	if err == nil || conn != t.conn {
+		return res, err
+	}
+	// the transport closes the body, so only retryable requests without one,
+	// which never reached the client, are resent
+	if sent.Load() || r.Body != nil && r.Body != http.NoBody ||
+		!t.m.retryable(r) {
+		return res, err
+	}
+	if h := t.replacement(r); h != nil {
+		return h.conn.RoundTrip(r)
+	}
+	return res, err
+}
+
+// isClosing reports if conn was shut down or closed. Unlike
+// CanTakeNewRequest, it also reports connections closed before serving any
+// requests.
+func isClosing(conn *http2.ClientConn) bool {
+	state := conn.State()
+	return state.Closing || state.Closed
+}
+
+// replacement returns the client that replaced conn, if it serves r.
+func (t replacedTransport) replacement(r *http.Request) *handler {
+	h := t.m.handler.Load()
+	if h == nil || h.conn == t.conn || !h.serves(r) {
+		return nil
+	}
+	return h
+}
+
+// retryable reports if r may be sent again after failing: if it is Retryable,
+// or whatever its method if retry_idempotent is false.
+func (m *Middleware) retryable(r *http.Request) bool {
+	if m.RetryIdempotent != nil && !*m.RetryIdempotent {
+		return true
+	}
+	return Retryable(r, m.RetryMethods, m.RetryIdempotencyKey)
+}
+
+// Retryable reports if r may safely be sent again after failing. GET, HEAD,
+// OPTIONS and TRACE requests are, along with requests using one of the extra
+// methods, and requests carrying an Idempotency-Key header if idempotencyKey
+// is true. All retries share this check.
+func Retryable(r *http.Request, extra []string, idempotencyKey bool) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	if slices.Contains(extra, r.Method) {
+		return true
+	}
+	return idempotencyKey && r.Header.Get("Idempotency-Key") != ""
+}
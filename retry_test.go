@@ -0,0 +1,262 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+)
+
+func abort(w http.ResponseWriter, r *http.Request) {
+	panic(http.ErrAbortHandler)
+}
+
+func newRetryMiddleware(t testing.TB) *Middleware {
+	m := &Middleware{
+		Secret:      secret,
+		TryDuration: caddy.Duration(5 * time.Second),
+		TryInterval: caddy.Duration(10 * time.Millisecond),
+	}
+	provision(t, m)
+	return m
+}
+
+func TestRetrySameClient(t *testing.T) {
+	m := newRetryMiddleware(t)
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			abort(w, r)
+		}
+		hello(w, r)
+	}))
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+	ensure.DeepEqual(t, m.status().Counters.Retries, uint64(2))
+}
+
+func TestRetryNewClient(t *testing.T) {
+	m := newRetryMiddleware(t)
+	s := newServer(t, m)
+	failed := make(chan struct{})
+	var once atomic.Bool
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if once.CompareAndSwap(false, true) {
+			close(failed)
+		}
+		abort(w, r)
+	}))
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(s.URL)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-failed
+	connect(t, m, s, http.HandlerFunc(hello))
+	r := <-results
+	ensure.Nil(t, r.err)
+	ensure.DeepEqual(t, r.body, "hello")
+
+	// the retry counts as a request of the new client, until it is done
+	h := m.handler.Load()
+	ensure.DeepEqual(t, h.requests.Load(), uint64(1))
+	ensure.DeepEqual(t, h.inflight.Load(), int64(0))
+}
+
+func TestRetryNewClientMaxInflight(t *testing.T) {
+	m := newRetryMiddleware(t)
+	m.TryDuration = caddy.Duration(100 * time.Millisecond)
+	s := newServer(t, m)
+	arrived := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-proceed
+		abort(w, r)
+	}))
+	results := make(chan int, 1)
+	go func() {
+		res, _ := get(t, s, "/")
+		results <- res.StatusCode
+	}()
+	<-arrived
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	// the new client has no slot left for the retries
+	m.maxInflight.Store(1)
+	m.handler.Load().acquire(1)
+	close(proceed)
+	ensure.DeepEqual(t, <-results, http.StatusBadGateway)
+	ensure.DeepEqual(t, calls.Load(), int32(0))
+}
+
+func TestRetryWaitsForClient(t *testing.T) {
+	m := newRetryMiddleware(t)
+	s := newServer(t, m)
+	failed := make(chan struct{})
+	var once atomic.Bool
+	conn := connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if once.CompareAndSwap(false, true) {
+			close(failed)
+		}
+		abort(w, r)
+	}))
+	results := make(chan string, 1)
+	go func() {
+		_, body := get(t, s, "/")
+		results <- body
+	}()
+	<-failed
+	conn.Close()
+	eventually(t, func() bool { return m.handler.Load() == nil })
+	retries := m.status().Counters.Retries
+	time.Sleep(20 * time.Duration(m.TryInterval))
+	// at most the attempt in flight as the client went away
+	ensure.True(t, m.status().Counters.Retries <= retries+1)
+	connect(t, m, s, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, <-results, "hello")
+}
+
+func TestReplacedTransport(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, namedClient("a"))
+	a := m.handler.Load()
+	connect(t, m, s, namedClient("b"))
+	eventually(t, func() bool { return isClosing(a.conn) })
+
+	// requests that loaded the replaced client go to its replacement
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := httptest.NewRecorder()
+		a.proxy.ServeHTTP(w, httptest.NewRequest(method, "/", strings.NewReader("body")))
+		ensure.DeepEqual(t, w.Code, http.StatusOK)
+		ensure.DeepEqual(t, w.Body.String(), "b")
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	m := &Middleware{
+		Secret:      secret,
+		TryDuration: caddy.Duration(50 * time.Millisecond),
+		TryInterval: caddy.Duration(10 * time.Millisecond),
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(abort))
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+	ensure.True(t, m.status().Counters.Retries > 0)
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	m := newRetryMiddleware(t)
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		abort(w, r)
+	}))
+	res, err := http.Post(s.URL, "text/plain", strings.NewReader("body"))
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+	ensure.DeepEqual(t, calls.Load(), int32(1))
+	ensure.DeepEqual(t, m.status().Counters.Retries, uint64(0))
+}
+
+func TestRetryNotIdempotentAllowed(t *testing.T) {
+	m := &Middleware{
+		Secret:          secret,
+		TryDuration:     caddy.Duration(5 * time.Second),
+		TryInterval:     caddy.Duration(10 * time.Millisecond),
+		RetryIdempotent: ptr(false),
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 2 {
+			abort(w, r)
+		}
+		io.Copy(w, r.Body)
+	}))
+	res, err := http.Post(s.URL, "text/plain", strings.NewReader("body"))
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(body), "body")
+	ensure.DeepEqual(t, m.status().Counters.Retries, uint64(1))
+}
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		method         string
+		key            string
+		extra          []string
+		idempotencyKey bool
+		want           bool
+	}{
+		{method: http.MethodGet, want: true},
+		{method: http.MethodHead, want: true},
+		{method: http.MethodOptions, want: true},
+		{method: http.MethodTrace, want: true},
+		{method: http.MethodPost},
+		{method: http.MethodPut},
+		{method: http.MethodPut, extra: []string{http.MethodPut}, want: true},
+		{method: http.MethodPost, key: "abc"},
+		{method: http.MethodPost, key: "abc", idempotencyKey: true, want: true},
+		{method: http.MethodPost, idempotencyKey: true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/", nil)
+		if c.key != "" {
+			r.Header.Set("Idempotency-Key", c.key)
+		}
+		ensure.DeepEqual(t, Retryable(r, c.extra, c.idempotencyKey), c.want, c)
+	}
+}
+
+func TestRetryIdempotencyKey(t *testing.T) {
+	m := newRetryMiddleware(t)
+	m.RetryIdempotencyKey = true
+	s := newServer(t, m)
+	var calls atomic.Int32
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 2 {
+			abort(w, r)
+		}
+		io.Copy(w, r.Body)
+	}))
+	req, err := http.NewRequest(http.MethodPost, s.URL, strings.NewReader("body"))
+	ensure.Nil(t, err)
+	req.Header.Set("Idempotency-Key", "abc")
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, string(body), "body")
+	ensure.DeepEqual(t, calls.Load(), int32(2))
+}
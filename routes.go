@@ -0,0 +1,98 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TunnelRoute sends the requests matching any of its matcher sets to the
+// client connected to another client_proxy handler.
+type TunnelRoute struct {
+	// The matcher sets, any of which must match.
+	MatcherSetsRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+
+	// The name of the client_proxy handler, in the same config, whose client
+	// serves the matching requests.
+	Tunnel string `json:"tunnel"`
+
+	matcherSets caddyhttp.MatcherSets
+}
+
+func (tr *TunnelRoute) validate() error {
+	if tr.Tunnel == "" {
+		return fmt.Errorf("route requires a tunnel")
+	}
+	if len(tr.MatcherSetsRaw) == 0 {
+		return fmt.Errorf("route to %s requires a matcher", tr.Tunnel)
+	}
+	return nil
+}
+
+func (tr *TunnelRoute) provision(ctx caddy.Context) error {
+	// loaded by ID, which leaves the raw matchers to be marshaled with the
+	// config, rather than with LoadModule, which clears them
+	for _, raw := range tr.MatcherSetsRaw {
+		var set caddyhttp.MatcherSet
+		for name, msg := range raw {
+			mod, err := ctx.LoadModuleByID("http.matchers."+name, msg)
+			if err != nil {
+				return fmt.Errorf("loading route matcher %s: %w", name, err)
+			}
+			rm, ok := mod.(caddyhttp.RequestMatcher)
+			if !ok {
+				return fmt.Errorf("route matcher %s is not a request matcher", name)
+			}
+			set = append(set, rm)
+		}
+		tr.matcherSets = append(tr.matcherSets, set)
+	}
+	return nil
+}
+
+// route returns the Middleware whose client serves r, which is m unless one
+// of its routes matches. Routes are only followed from the handler r reached,
+// so they cannot loop.
+func (m *Middleware) route(r *http.Request) (*Middleware, error) {
+	for _, tr := range m.Routes {
+		if !tr.matcherSets.AnyMatch(r) {
+			continue
+		}
+		// looked up on every request, as the handler may be provisioned after
+		// this one
+		if target := registry.named(tr.Tunnel, m.load); target != nil {
+			return target, nil
+		}
+		return nil, caddyhttp.Error(http.StatusBadGateway,
+			fmt.Errorf("client_proxy: no client_proxy handler named %s", tr.Tunnel))
+	}
+	return m, nil
+}
+
+// unmarshalRoute parses a route block, with the tunnel as its argument, and
+// matchers in the same form as a named matcher:
+//
+//	route <tunnel> {
+//		<matchers...>
+//	}
+func unmarshalRoute(d *caddyfile.Dispenser) (*TunnelRoute, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	tr := &TunnelRoute{Tunnel: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	set, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(set) == 0 {
+		return nil, d.Errf("route to %s requires a matcher", tr.Tunnel)
+	}
+	tr.MatcherSetsRaw = caddyhttp.RawMatcherSets{set}
+	return tr, nil
+}
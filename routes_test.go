@@ -0,0 +1,90 @@
+package clientproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/daaku/ensure"
+	"go.uber.org/zap"
+)
+
+// namedClient responds with name.
+func namedClient(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	load := func(m *Middleware) *Middleware {
+		ensure.Nil(t, m.Validate())
+		t.Cleanup(func() { m.Cleanup() })
+		ensure.Nil(t, m.Provision(ctx))
+		m.logger = zap.NewNop()
+		return m
+	}
+	router := load(&Middleware{Secret: secret, Routes: []*TunnelRoute{
+		{
+			Tunnel:         "a",
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{{"path": json.RawMessage(`["/a/*"]`)}},
+		},
+		{
+			Tunnel:         "b",
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{{"header": json.RawMessage(`{"X-Tenant":["b"]}`)}},
+		},
+		{
+			Tunnel:         "missing",
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{{"path": json.RawMessage(`["/missing"]`)}},
+		},
+	}})
+	a := load(&Middleware{Secret: secret, Name: "a"})
+	b := load(&Middleware{Secret: secret, Name: "b"})
+	connect(t, a, newServer(t, a), namedClient("a"))
+	connect(t, b, newServer(t, b), namedClient("b"))
+
+	// matchers consult the replacer of the request, as set up by Caddy
+	s := newUnstartedServer(router)
+	h := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())))
+	})
+	s.Start()
+	t.Cleanup(s.Close)
+	request := func(path, tenant string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+		ensure.Nil(t, err)
+		req.Header.Set("X-Tenant", tenant)
+		res, err := http.DefaultClient.Do(req)
+		ensure.Nil(t, err)
+		defer res.Body.Close()
+		var body [16]byte
+		n, _ := res.Body.Read(body[:])
+		return res.StatusCode, string(body[:n])
+	}
+
+	status, body := request("/a/x", "b")
+	ensure.DeepEqual(t, status, http.StatusOK)
+	ensure.DeepEqual(t, body, "a", "the first matching route")
+	status, body = request("/x", "b")
+	ensure.DeepEqual(t, status, http.StatusOK)
+	ensure.DeepEqual(t, body, "b")
+	status, _ = request("/x", "c")
+	ensure.DeepEqual(t, status, http.StatusNotFound, "served by the router, which has no client")
+	status, _ = request("/missing", "")
+	ensure.DeepEqual(t, status, http.StatusBadGateway)
+	ensure.DeepEqual(t, a.status().Counters.Requests, uint64(1))
+	ensure.DeepEqual(t, b.status().Counters.Requests, uint64(1))
+}
+
+func TestRoutesInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, Routes: []*TunnelRoute{{Tunnel: "a"}}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("route to a requires a matcher"))
+}
@@ -0,0 +1,493 @@
+package clientproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// secretHash verifies a presented secret against an encoded hash.
+type secretHash interface {
+	matches(secret string) bool
+}
+
+// parseSecretHash detects the algorithm from the prefix of the encoded hash.
+func parseSecretHash(encoded string) (secretHash, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"),
+		strings.HasPrefix(encoded, "$2b$"),
+		strings.HasPrefix(encoded, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt secret_hash: %w", err)
+		}
+		return bcryptHash(encoded), nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return parseArgon2id(encoded)
+	}
+	return nil, fmt.Errorf("unsupported secret_hash, expected bcrypt or argon2id")
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) matches(secret string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(secret)) == nil
+}
+
+// argon2idHash is parsed from the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+func parseArgon2id(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid argon2id secret_hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("invalid argon2id secret_hash version: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id secret_hash version %d", version)
+	}
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id secret_hash parameters: %w", err)
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id secret_hash salt: %w", err)
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id secret_hash: %w", err)
+	}
+	return &h, nil
+}
+
+func (h *argon2idHash) matches(secret string) bool {
+	key := argon2.IDKey([]byte(secret), h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	return subtle.ConstantTimeCompare(key, h.hash) == 1
+}
+
+const (
+	// maxHashedSecretLength bounds the credentials checked against a hash,
+	// well above the 72 bytes bcrypt considers.
+	maxHashedSecretLength = 128
+
+	// maxConcurrentHashes bounds the hash checks running at once, and with it
+	// the memory argon2id takes for each.
+	maxConcurrentHashes = 4
+
+	// maxHashFailures bounds the recently failed credentials remembered, for
+	// failureTTL each.
+	maxHashFailures = 4096
+	failureTTL      = 10 * time.Minute
+)
+
+// hashGuard bounds the work anonymous requests cause by presenting junk
+// credentials, which are otherwise hashed on every request.
+type hashGuard struct {
+	slots chan struct{}
+
+	mu     sync.Mutex
+	failed map[[sha256.Size]byte]time.Time // until when each is remembered
+}
+
+func newHashGuard() *hashGuard {
+	return &hashGuard{
+		slots:  make(chan struct{}, maxConcurrentHashes),
+		failed: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// plausibleSecret reports if v could be a secret, being printable ASCII of a
+// bounded length, so junk is rejected without hashing it.
+func plausibleSecret(v string) bool {
+	if v == "" || len(v) > maxHashedSecretLength {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < ' ' || v[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns the index of the first of hashes v matches, or -1. Values
+// that matched none of them recently are not hashed again, and callers wait
+// for one of the slots, giving up once ctx is done.
+func (g *hashGuard) matches(ctx context.Context, v string, hashes []secretHash) int {
+	if len(hashes) == 0 || !plausibleSecret(v) {
+		return -1
+	}
+	key := sha256.Sum256([]byte(v))
+	if g.failedRecently(key) {
+		return -1
+	}
+	select {
+	case g.slots <- struct{}{}:
+	case <-ctx.Done():
+		return -1
+	}
+	defer func() { <-g.slots }()
+	for i, h := range hashes {
+		if h.matches(v) {
+			return i
+		}
+	}
+	g.remember(key)
+	return -1
+}
+
+func (g *hashGuard) failedRecently(key [sha256.Size]byte) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.failed[key]
+	return ok && time.Now().Before(until)
+}
+
+// remember records key as failed, dropping expired failures, or all of them,
+// once maxHashFailures are remembered.
+func (g *hashGuard) remember(key [sha256.Size]byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if len(g.failed) >= maxHashFailures {
+		for k, until := range g.failed {
+			if !now.Before(until) {
+				delete(g.failed, k)
+			}
+		}
+		if len(g.failed) >= maxHashFailures {
+			clear(g.failed)
+		}
+	}
+	g.failed[key] = now.Add(failureTTL)
+}
+
+// credentialQueryParam is the query parameter of the query credential source.
+const credentialQueryParam = "cp_token"
+
+type queryCredentialKey struct{}
+
+// credential returns the secret presented by r, from the first of the
+// credential_sources it is found in, and if it may be hashed. Visitors send
+// bearer tokens of their own, meant for the client, so those are only
+// compared against the values of secrets.
+func (m *Middleware) credential(r *http.Request) (string, bool) {
+	sources := m.CredentialSources
+	if len(sources) == 0 {
+		sources = []string{"header"}
+	}
+	for _, s := range sources {
+		var v string
+		switch s {
+		case "header":
+			v = r.Header.Get("X-Client-Proxy")
+		case "bearer":
+			v, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		case "query":
+			v, _ = r.Context().Value(queryCredentialKey{}).(string)
+		}
+		if v != "" {
+			return v, s != "bearer"
+		}
+	}
+	return "", false
+}
+
+// scrubQueryCredential removes the query credential from r, so it is neither
+// logged nor forwarded, returning r with the credential in its context. The
+// rest of the query is kept as is.
+func (m *Middleware) scrubQueryCredential(r *http.Request) *http.Request {
+	if !slices.Contains(m.CredentialSources, "query") || !strings.Contains(r.URL.RawQuery, credentialQueryParam) {
+		return r
+	}
+	var v string
+	found := false
+	params := strings.Split(r.URL.RawQuery, "&")
+	params = slices.DeleteFunc(params, func(p string) bool {
+		key, value, _ := strings.Cut(p, "=")
+		if key, err := url.QueryUnescape(key); err != nil || key != credentialQueryParam {
+			return false
+		}
+		if !found {
+			v, _ = url.QueryUnescape(value)
+			found = true
+		}
+		return true
+	})
+	if !found {
+		return r
+	}
+	r.URL.RawQuery = strings.Join(params, "&")
+	r.RequestURI = r.URL.RequestURI()
+	return r.WithContext(context.WithValue(r.Context(), queryCredentialKey{}, v))
+}
+
+// isRegistration reports if r presents the secret. Requests without a
+// credential are rejected first, so only registration attempts pay for
+// hashing.
+func (m *Middleware) isRegistration(r *http.Request) bool {
+	v, hash := m.credential(r)
+	if v == "" {
+		return false
+	}
+	c, ok := m.matchSecrets(r.Context(), v, hash)
+	return ok && c == nil
+}
+
+// secretMatches reports if v is the secret, rather than one of the secrets.
+func (m *Middleware) secretMatches(ctx context.Context, v string) bool {
+	c, ok := m.matchSecrets(ctx, v, true)
+	return ok && c == nil
+}
+
+// matchSecrets reports if v is the secret, returning a nil Credential, or one
+// of the secrets. Values are compared first, and unless hash is false the
+// hashes are checked together within the bounds of the hashGuard, so a wrong
+// credential is hashed once against each of them at most.
+func (m *Middleware) matchSecrets(ctx context.Context, v string, hash bool) (*Credential, bool) {
+	if m.hash == nil {
+		expected := m.Secret
+		if p := m.fileSecret.Load(); p != nil {
+			expected = *p
+		}
+		if expected != "" && subtle.ConstantTimeCompare([]byte(v), []byte(expected)) == 1 {
+			return nil, true
+		}
+	}
+	var hashes []secretHash
+	var hashed []*Credential
+	if m.hash != nil {
+		hashes = append(hashes, m.hash)
+		hashed = append(hashed, nil)
+	}
+	for _, c := range m.Secrets {
+		if c.hash != nil {
+			hashes = append(hashes, c.hash)
+			hashed = append(hashed, c)
+		} else if c.matches(v) {
+			return c, true
+		}
+	}
+	if !hash {
+		return nil, false
+	}
+	if i := m.hashes.matches(ctx, v, hashes); i >= 0 {
+		return hashed[i], true
+	}
+	return nil, false
+}
+
+// loadSecretFile reads the secret from SecretFile. The last good secret is
+// kept when it fails.
+func (m *Middleware) loadSecretFile() error {
+	b, err := os.ReadFile(m.SecretFile)
+	if err != nil {
+		return fmt.Errorf("client_proxy: error reading secret_file: %w", err)
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return fmt.Errorf("client_proxy: empty secret_file %s", m.SecretFile)
+	}
+	m.fileSecret.Store(&secret)
+	return nil
+}
+
+// pollSecretFile reloads the secret from SecretFile every interval, until ctx
+// is done.
+func (m *Middleware) pollSecretFile(ctx caddy.Context, logger *zap.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.loadSecretFile(); err != nil {
+				logger.Warn("keeping previous secret", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Credential is an additional secret accepted for registration, optionally
+// only within a validity window, for example to hand out to a contractor.
+type Credential struct {
+	// The secret.
+	Value string `json:"value,omitempty"`
+
+	// A bcrypt or argon2id hash of the secret, instead of the value.
+	Hash string `json:"hash,omitempty"`
+
+	// If set, the credential is not accepted before this time.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+
+	// If set, the credential is not accepted after this time.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	hash secretHash
+}
+
+func (c *Credential) validate(now time.Time) error {
+	if (c.Value == "") == (c.Hash == "") {
+		return fmt.Errorf("secrets entries require exactly one of value and hash")
+	}
+	if c.Hash != "" {
+		if _, err := parseSecretHash(c.Hash); err != nil {
+			return err
+		}
+	}
+	if c.NotBefore != nil && c.Expires != nil && !c.NotBefore.Before(*c.Expires) {
+		return fmt.Errorf("secrets entry not_before %s must be before expires %s",
+			c.NotBefore.Format(time.RFC3339), c.Expires.Format(time.RFC3339))
+	}
+	if c.Expires != nil && c.Expires.Before(now) {
+		return fmt.Errorf("secrets entry already expired at %s", c.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (c *Credential) provision() error {
+	if c.Hash == "" {
+		return nil
+	}
+	hash, err := parseSecretHash(c.Hash)
+	if err != nil {
+		return err
+	}
+	c.hash = hash
+	return nil
+}
+
+func (c *Credential) matches(v string) bool {
+	if c.hash != nil {
+		return c.hash.matches(v)
+	}
+	return subtle.ConstantTimeCompare([]byte(v), []byte(c.Value)) == 1
+}
+
+var (
+	errCredentialExpired     = errors.New("credential expired")
+	errCredentialNotYetValid = errors.New("credential not yet valid")
+)
+
+// check returns an error if the credential is not valid at now.
+func (c *Credential) check(now time.Time) error {
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		return errCredentialNotYetValid
+	}
+	if c.Expires != nil && now.After(*c.Expires) {
+		return errCredentialExpired
+	}
+	return nil
+}
+
+// identity is what a registration was authenticated with, beyond the secret.
+type identity struct {
+	subject string
+	// hosts from a token, replacing X-Client-Proxy-Hosts if set
+	hosts   []string
+	token   bool
+	expires time.Time
+}
+
+// hasSecretHashes reports if secret_hash or a hashed secrets entry is set.
+func (m *Middleware) hasSecretHashes() bool {
+	return m.hash != nil || slices.ContainsFunc(m.Secrets, func(c *Credential) bool { return c.hash != nil })
+}
+
+// authenticate reports if r is a registration attempt, presenting the secret,
+// one of the secrets, or a registration token, using the credential_sources.
+// Registrations presenting an expired credential or an invalid token are
+// rejected with a 401, while those presenting a wrong secret are left to
+// continue as visitor requests.
+func (m *Middleware) authenticate(r *http.Request) (*identity, bool, error) {
+	now := time.Now()
+	if v, hash := m.credential(r); v != "" {
+		c, ok := m.matchSecrets(r.Context(), v, hash)
+		if ok && c == nil {
+			return nil, true, nil
+		}
+		if ok {
+			if err := c.check(now); err != nil {
+				return nil, true, m.rejectRegistration(r, err)
+			}
+			id := &identity{}
+			if c.Expires != nil {
+				id.expires = *c.Expires
+			}
+			return id, true, nil
+		}
+	}
+	if m.JWT != nil {
+		claims, ok, err := m.JWT.authenticate(r, now)
+		if err != nil && ok {
+			return nil, true, m.rejectRegistration(r, fmt.Errorf("invalid registration token: %w", err))
+		}
+		if ok {
+			return &identity{
+				subject: claims.Subject,
+				hosts:   claims.Hosts,
+				token:   true,
+				expires: claims.Expiry.Time(),
+			}, true, nil
+		}
+	}
+	// visitors may send bearer tokens of their own
+	if r.Header.Get("X-Client-Proxy") != "" || r.Context().Value(queryCredentialKey{}) != nil {
+		m.metrics.registrationInvalid.Inc()
+		m.logger.Debug("registration with wrong secret", zap.String("remote_addr", r.RemoteAddr))
+	}
+	return nil, false, nil
+}
+
+// rejectRegistration records the registration failing because of err, which
+// is returned as a 401.
+func (m *Middleware) rejectRegistration(r *http.Request, err error) error {
+	switch {
+	case errors.Is(err, errCredentialExpired), errors.Is(err, jwt.ErrExpired):
+		m.metrics.registrationExpired.Inc()
+	case errors.Is(err, errCredentialNotYetValid), errors.Is(err, jwt.ErrNotValidYet):
+		m.metrics.registrationNotYetValid.Inc()
+	default:
+		m.metrics.registrationInvalid.Inc()
+	}
+	m.logger.Info("registration rejected",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.Error(err))
+	return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("client_proxy: %w", err))
+}
+
+// parseTime parses an RFC 3339 time, or a date taken as midnight UTC.
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,445 @@
+package clientproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2idEncode(secret string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(secret), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s",
+		argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestSecretHash(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	ensure.Nil(t, err)
+	cases := map[string]string{
+		"bcrypt":   string(bcrypted),
+		"argon2id": argon2idEncode(secret),
+	}
+	for name, hash := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{SecretHash: hash}
+			provision(t, m)
+			ensure.True(t, m.hash.matches(secret))
+			ensure.False(t, m.hash.matches("wrong"))
+			s := newServer(t, m)
+			connect(t, m, s, http.HandlerFunc(hello))
+			res, body := get(t, s, "/")
+			ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+			ensure.DeepEqual(t, body, "hello")
+		})
+	}
+}
+
+// countingHash counts its checks, and the most running at once.
+type countingHash struct {
+	secret string
+
+	mu      sync.Mutex
+	running int
+	peak    int
+	checks  int
+}
+
+func (h *countingHash) matches(v string) bool {
+	h.mu.Lock()
+	h.checks++
+	h.running++
+	h.peak = max(h.peak, h.running)
+	h.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	h.mu.Lock()
+	h.running--
+	h.mu.Unlock()
+	return v == h.secret
+}
+
+func (h *countingHash) counts() (checks, peak int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.checks, h.peak
+}
+
+func TestSecretHashGuard(t *testing.T) {
+	m := &Middleware{SecretHash: argon2idEncode(secret)}
+	provision(t, m)
+	h := &countingHash{secret: secret}
+	m.hash = h
+	ensure.True(t, m.isRegistration(registration(secret)))
+
+	// junk is never hashed
+	ensure.False(t, m.isRegistration(registration(strings.Repeat("a", maxHashedSecretLength+1))))
+	r := registration("")
+	r.Header["X-Client-Proxy"] = []string{"bad\x00secret"}
+	ensure.False(t, m.isRegistration(r))
+	checks, _ := h.counts()
+	ensure.DeepEqual(t, checks, 1)
+
+	// failures are remembered
+	ensure.False(t, m.isRegistration(registration("wrong")))
+	ensure.False(t, m.isRegistration(registration("wrong")))
+	checks, _ = h.counts()
+	ensure.DeepEqual(t, checks, 2)
+
+	// concurrent checks are bounded
+	var wg sync.WaitGroup
+	for i := range 5 * maxConcurrentHashes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.isRegistration(registration(fmt.Sprintf("wrong-%d", i)))
+		}()
+	}
+	wg.Wait()
+	checks, peak := h.counts()
+	ensure.DeepEqual(t, checks, 2+5*maxConcurrentHashes)
+	ensure.True(t, peak <= maxConcurrentHashes, peak)
+
+	// waiting for a slot gives up with the request
+	for range maxConcurrentHashes {
+		m.hashes.slots <- struct{}{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ensure.False(t, m.isRegistration(registration(secret).WithContext(ctx)))
+	for range maxConcurrentHashes {
+		<-m.hashes.slots
+	}
+	ensure.True(t, m.isRegistration(registration(secret)))
+}
+
+func TestSecretsHashGuard(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	m := &Middleware{Secrets: []*Credential{
+		{Hash: argon2idEncode("a"), Expires: &future},
+		{Hash: argon2idEncode("b"), Expires: &future},
+		{Value: "plain"},
+	}}
+	provision(t, m)
+	a, b := &countingHash{secret: "a"}, &countingHash{secret: "b"}
+	m.Secrets[0].hash, m.Secrets[1].hash = a, b
+	checks := func() int {
+		ac, _ := a.counts()
+		bc, _ := b.counts()
+		return ac + bc
+	}
+
+	// values are compared before hashing
+	_, ok, err := m.authenticate(registration("plain"))
+	ensure.True(t, ok)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, checks(), 0)
+	_, ok, _ = m.authenticate(registration("b"))
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, checks(), 2)
+
+	// a wrong credential is hashed against each once
+	_, ok, _ = m.authenticate(registration("wrong"))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, checks(), 4)
+	_, ok, _ = m.authenticate(registration("wrong"))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, checks(), 4)
+	_, ok, _ = m.authenticate(registration(strings.Repeat("a", maxHashedSecretLength+1)))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, checks(), 4)
+}
+
+func TestHashGuardRemember(t *testing.T) {
+	g := newHashGuard()
+	for i := range maxHashFailures {
+		g.remember(sha256.Sum256([]byte(fmt.Sprint(i))))
+	}
+	ensure.DeepEqual(t, len(g.failed), maxHashFailures)
+	// full of unexpired failures, which are all dropped
+	key := sha256.Sum256([]byte("new"))
+	g.remember(key)
+	ensure.DeepEqual(t, len(g.failed), 1)
+	ensure.True(t, g.failedRecently(key))
+}
+
+func TestSecretHashInvalid(t *testing.T) {
+	cases := map[string]string{
+		"unsupported": "$1$abc",
+		"bcrypt":      "$2a$xx",
+		"argon2id":    "$argon2id$v=19$m=64",
+		"version":     "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA",
+	}
+	for name, hash := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{SecretHash: hash}
+			ensure.NotNil(t, m.Validate())
+		})
+	}
+}
+
+func TestSecretAndSecretHash(t *testing.T) {
+	m := &Middleware{Secret: secret, SecretHash: argon2idEncode(secret)}
+	ensure.StringContains(t, m.Validate().Error(), "only one of")
+}
+
+func TestWrongSecret(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("X-Client-Proxy", "wrong")
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+	ensure.True(t, m.handler.Load() == nil)
+}
+
+func registration(secret string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Client-Proxy", secret)
+	return r
+}
+
+func writeSecret(t testing.TB, path, secret string) {
+	ensure.Nil(t, os.WriteFile(path, []byte(secret+"\n"), 0o600))
+}
+
+func TestSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	writeSecret(t, path, secret)
+	m := &Middleware{Name: "file", SecretFile: path}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(hello))
+	_, body := get(t, s, "/")
+	ensure.DeepEqual(t, body, "hello")
+
+	writeSecret(t, path, "rotated")
+	ensure.True(t, m.isRegistration(registration(secret)))
+	ensure.Nil(t, admin(t, http.MethodPost, "/client_proxy/file/reload_secret", nil))
+	ensure.False(t, m.isRegistration(registration(secret)))
+	ensure.True(t, m.isRegistration(registration("rotated")))
+
+	// the last good secret is kept
+	ensure.Nil(t, os.Remove(path))
+	err := admin(t, http.MethodPost, "/client_proxy/file/reload_secret", nil)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusInternalServerError)
+	ensure.True(t, m.isRegistration(registration("rotated")))
+}
+
+func TestSecretFileInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	writeSecret(t, path, secret)
+	m := &Middleware{
+		SecretFile:         path,
+		SecretFileInterval: caddy.Duration(10 * time.Millisecond),
+	}
+	provision(t, m)
+	ensure.True(t, m.isRegistration(registration(secret)))
+	writeSecret(t, path, "rotated")
+	eventually(t, func() bool { return m.isRegistration(registration("rotated")) })
+	ensure.False(t, m.isRegistration(registration(secret)))
+}
+
+func TestSecretFileMissing(t *testing.T) {
+	m := &Middleware{SecretFile: filepath.Join(t.TempDir(), "missing")}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	ensure.Nil(t, m.Validate())
+	ensure.NotNil(t, m.Provision(ctx))
+	registry.remove(m)
+}
+
+func TestReloadSecretWithoutFile(t *testing.T) {
+	m := &Middleware{Name: "nofile", Secret: secret}
+	provision(t, m)
+	err := admin(t, http.MethodPost, "/client_proxy/nofile/reload_secret", nil)
+	ensure.DeepEqual(t, apiStatus(t, err), http.StatusBadRequest)
+}
+
+func TestSecrets(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	ensure.Nil(t, err)
+	now := time.Now()
+	later := now.Add(time.Hour)
+	soon := now.Add(50 * time.Millisecond)
+	m := &Middleware{InstanceLabel: "secrets", Secrets: []*Credential{
+		{Value: "current", Expires: &later},
+		{Hash: string(hash)},
+		{Value: "future", NotBefore: &later},
+		{Value: "expiring", Expires: &soon},
+	}}
+	provision(t, m)
+	time.Sleep(time.Until(soon))
+
+	authenticate := func(v string) (bool, error) {
+		_, ok, err := m.authenticate(registration(v))
+		return ok, err
+	}
+	ok, err := authenticate("current")
+	ensure.True(t, ok)
+	ensure.Nil(t, err)
+	ok, err = authenticate("hashed")
+	ensure.True(t, ok)
+	ensure.Nil(t, err)
+
+	ok, err = authenticate("expiring")
+	ensure.True(t, ok)
+	ensure.Err(t, err, regexp.MustCompile("credential expired"))
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_registration_failures_total", "reason", "expired"), 1.0)
+
+	ok, err = authenticate("future")
+	ensure.True(t, ok)
+	ensure.Err(t, err, regexp.MustCompile("credential not yet valid"))
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_registration_failures_total", "reason", "not_yet_valid"), 1.0)
+
+	// wrong secrets continue as visitor requests
+	ok, err = authenticate("wrong")
+	ensure.False(t, ok)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_registration_failures_total", "reason", "invalid"), 1.0)
+}
+
+func TestSecretsInvalid(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	for _, c := range []struct {
+		credential *Credential
+		err        string
+	}{
+		{&Credential{}, "exactly one of value and hash"},
+		{&Credential{Value: "a", Hash: "$2a$10$abc"}, "exactly one of value and hash"},
+		{&Credential{Hash: "plain"}, "unsupported secret_hash"},
+		{&Credential{Value: "a", Expires: &past}, "already expired"},
+		{&Credential{Value: "a", NotBefore: &future, Expires: &future}, "must be before expires"},
+	} {
+		m := &Middleware{Secrets: []*Credential{c.credential}}
+		ensure.Err(t, m.Validate(), regexp.MustCompile(c.err))
+	}
+}
+
+func TestEnforceExpiryOnActive(t *testing.T) {
+	for _, enforce := range []bool{false, true} {
+		expires := time.Now().Add(100 * time.Millisecond)
+		m := &Middleware{
+			Secrets:               []*Credential{{Value: "contractor", Expires: &expires}},
+			EnforceExpiryOnActive: enforce,
+		}
+		provision(t, m)
+		s := newServer(t, m)
+		connectHeader(t, m, s, http.Header{"X-Client-Proxy": {"contractor"}}, http.HandlerFunc(hello))
+		time.Sleep(time.Until(expires) + 50*time.Millisecond)
+		if enforce {
+			eventually(t, func() bool { return m.handler.Load() == nil })
+			continue
+		}
+		_, body := get(t, s, "/")
+		ensure.DeepEqual(t, body, "hello")
+	}
+}
+
+func TestCredentialSources(t *testing.T) {
+	request := func(header, bearer, query string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/path?a=1", nil)
+		if header != "" {
+			r.Header.Set("X-Client-Proxy", header)
+		}
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		if query != "" {
+			r = httptest.NewRequest(http.MethodGet, "/path?a=1&cp_token="+url.QueryEscape(query)+"&b=2", nil)
+		}
+		return r
+	}
+
+	m := &Middleware{Secret: secret}
+	provision(t, m)
+	ensure.True(t, m.isRegistration(request(secret, "", "")))
+	ensure.False(t, m.isRegistration(request("", secret, "")))
+	ensure.False(t, m.isRegistration(m.scrubQueryCredential(request("", "", secret))))
+
+	m = &Middleware{Secret: secret, CredentialSources: []string{"header", "bearer", "query"}}
+	provision(t, m)
+	for _, c := range []struct {
+		name                  string
+		header, bearer, query string
+		want                  bool
+	}{
+		{"header", secret, "", "", true},
+		{"bearer", "", secret, "", true},
+		{"query", "", "", secret, true},
+		{"header first", "wrong", secret, "", false},
+		{"bearer before query", "", "wrong", secret, false},
+		{"none", "", "", "", false},
+	} {
+		r := request(c.header, c.bearer, c.query)
+		if c.query != "" && c.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+c.bearer)
+		}
+		ensure.DeepEqual(t, m.isRegistration(m.scrubQueryCredential(r)), c.want, c.name)
+	}
+
+	// the query credential is removed from the request
+	r := m.scrubQueryCredential(request("", "", secret))
+	ensure.DeepEqual(t, r.URL.RawQuery, "a=1&b=2")
+	ensure.DeepEqual(t, r.RequestURI, "/path?a=1&b=2")
+}
+
+func TestBearerNotHashed(t *testing.T) {
+	m := &Middleware{
+		SecretHash:        argon2idEncode(secret),
+		Secrets:           []*Credential{{Value: "plain"}},
+		CredentialSources: []string{"header", "bearer"},
+	}
+	provision(t, m)
+	h := &countingHash{secret: secret}
+	m.hash = h
+	bearer := func(v string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+v)
+		return r
+	}
+	_, ok, _ := m.authenticate(bearer(secret))
+	ensure.False(t, ok)
+	_, ok, _ = m.authenticate(bearer("plain"))
+	ensure.True(t, ok, "values are still compared")
+	checks, _ := h.counts()
+	ensure.DeepEqual(t, checks, 0)
+	ensure.True(t, m.isRegistration(registration(secret)), "headers are hashed")
+}
+
+func TestCredentialQueryScrubbed(t *testing.T) {
+	m := &Middleware{Secret: secret, CredentialSources: []string{"header", "query"}}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	_, body := get(t, s, "/path?cp_token=visitor&a=1")
+	ensure.DeepEqual(t, body, "/path?a=1")
+}
+
+func TestCredentialSourcesInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, CredentialSources: []string{"cookie"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("credential_sources must be header, bearer or query"))
+}
@@ -0,0 +1,93 @@
+package clientproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signatureHeader carries the signature of forwarded requests.
+const signatureHeader = "X-CP-Signature"
+
+// SignRequests configures signing forwarded requests, so the client can
+// verify they came through the handler.
+type SignRequests struct {
+	// The HMAC key. Defaults to the secret, which must then be set using
+	// secret or secret_file.
+	Key string `json:"key,omitempty"`
+
+	// The request headers covered by the signature, in addition to the
+	// method and request target.
+	Headers []string `json:"headers,omitempty"`
+}
+
+// unsignableHeaders are changed by ReverseProxy after the request is signed:
+// X-Forwarded-For is appended to, and hop-by-hop headers are removed.
+var unsignableHeaders = []string{
+	"X-Forwarded-For",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func (s *SignRequests) validate() error {
+	for _, h := range s.Headers {
+		if slices.Contains(unsignableHeaders, http.CanonicalHeaderKey(h)) {
+			return fmt.Errorf("sign_requests cannot cover %s, which is changed after signing", h)
+		}
+	}
+	return nil
+}
+
+// signingKey returns the key to sign requests with.
+func (m *Middleware) signingKey() string {
+	if m.SignRequests.Key != "" {
+		return m.SignRequests.Key
+	}
+	if p := m.fileSecret.Load(); p != nil {
+		return *p
+	}
+	return m.Secret
+}
+
+// signRequest sets the X-CP-Signature header of r, replacing any sent by the
+// visitor, to t=<unix time>,h=<covered headers>,sig=<hex HMAC-SHA256> over
+// the canonical form of r returned by canonicalRequest.
+func (m *Middleware) signRequest(r *http.Request, now time.Time) {
+	headers := make([]string, len(m.SignRequests.Headers))
+	for i, h := range m.SignRequests.Headers {
+		headers[i] = strings.ToLower(h)
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(m.signingKey()))
+	mac.Write([]byte(canonicalRequest(r, ts, headers)))
+	r.Header.Set(signatureHeader, fmt.Sprintf("t=%s,h=%s,sig=%s",
+		ts, strings.Join(headers, ";"), hex.EncodeToString(mac.Sum(nil))))
+}
+
+// canonicalRequest returns the lines signed for r: the timestamp, method and
+// request target as sent, then a name:value line for each covered header,
+// with the name lower cased and multiple values joined by commas, each line
+// ending with a newline.
+func canonicalRequest(r *http.Request, ts string, headers []string) string {
+	var b strings.Builder
+	b.WriteString(ts + "\n")
+	b.WriteString(r.Method + "\n")
+	b.WriteString(r.URL.RequestURI() + "\n")
+	for _, h := range headers {
+		b.WriteString(h + ":" + strings.Join(r.Header.Values(h), ",") + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package clientproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+// signatureSkew is the clock skew clients allow for, as documented.
+const signatureSkew = 5 * time.Minute
+
+// verifySignature checks the X-CP-Signature of r as a client would, following
+// the documented format.
+func verifySignature(r *http.Request, key string) bool {
+	fields := map[string]string{}
+	for _, f := range strings.Split(r.Header.Get("X-CP-Signature"), ",") {
+		k, v, _ := strings.Cut(f, "=")
+		fields[k] = v
+	}
+	ts, err := strconv.ParseInt(fields["t"], 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > signatureSkew || skew < -signatureSkew {
+		return false
+	}
+	lines := []string{fields["t"], r.Method, r.RequestURI}
+	if fields["h"] != "" {
+		for _, h := range strings.Split(fields["h"], ";") {
+			lines = append(lines, h+":"+strings.Join(r.Header.Values(h), ","))
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	sig, err := hex.DecodeString(fields["sig"])
+	return err == nil && hmac.Equal(sig, mac.Sum(nil))
+}
+
+func TestSignRequests(t *testing.T) {
+	m := &Middleware{Secret: secret, AddPathPrefix: "/app", SignRequests: &SignRequests{
+		Headers: []string{"X-Request-Id", "X-Missing"},
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	requests := make(chan *http.Request, 1)
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/a%2Fb?q=1&q=2", nil)
+	ensure.Nil(t, err)
+	req.Header.Add("X-Request-Id", "a")
+	req.Header.Add("X-Request-Id", "b")
+	req.Header.Set("X-CP-Signature", "spoofed")
+	start := time.Now().Unix()
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	r := <-requests
+	ensure.True(t, verifySignature(r, secret))
+	ensure.True(t, regexp.MustCompile(`^t=\d+,h=x-request-id;x-missing,sig=[0-9a-f]{64}$`).
+		MatchString(r.Header.Get("X-CP-Signature")))
+
+	// the covered parts of the request
+	ensure.DeepEqual(t, canonicalRequest(r, "1", []string{"x-request-id", "x-missing"}),
+		"1\nPOST\n/app/a%2Fb?q=1&q=2\nx-request-id:a,b\nx-missing:\n")
+	ts, _, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("X-CP-Signature"), "t="), ",")
+	signedAt, err := strconv.ParseInt(ts, 10, 64)
+	ensure.Nil(t, err)
+	ensure.True(t, signedAt >= start && signedAt <= time.Now().Unix())
+
+	// tampering is detected
+	ensure.False(t, verifySignature(r, "other"))
+	r.Header.Set("X-Request-Id", "c")
+	ensure.False(t, verifySignature(r, secret))
+}
+
+func TestSignRequestsSkew(t *testing.T) {
+	m := &Middleware{Secret: secret, SignRequests: &SignRequests{}}
+	provision(t, m)
+	now := time.Now()
+	for offset, valid := range map[time.Duration]bool{
+		0:                            true,
+		signatureSkew - time.Minute:  true,
+		-signatureSkew + time.Minute: true,
+		signatureSkew + time.Minute:  false,
+		-signatureSkew - time.Minute: false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		m.signRequest(r, now.Add(offset))
+		ensure.DeepEqual(t, verifySignature(r, secret), valid, offset)
+	}
+}
+
+func TestSignRequestsInvalid(t *testing.T) {
+	m := &Middleware{SecretHash: "$2a$10$abc", SignRequests: &SignRequests{}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("sign_requests requires a key"))
+	for _, h := range []string{"x-forwarded-for", "Connection", "TE"} {
+		m = &Middleware{Secret: secret, SignRequests: &SignRequests{Headers: []string{"X-Request-Id", h}}}
+		ensure.Err(t, m.Validate(), regexp.MustCompile("sign_requests cannot cover "+h))
+	}
+}
@@ -0,0 +1,323 @@
+package clientproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSpoolMaxRequests = 100
+	defaultSpoolMaxBodySize = 1 << 20
+	defaultSpoolMaxAge      = time.Hour
+
+	// how long a replay waits for the client to have room for a request
+	spoolReplayBackoff = 50 * time.Millisecond
+)
+
+// Spool configures queueing requests while no client is connected, to replay
+// them once one registers. Since the requests are acknowledged before the
+// client sees them, only requests explicitly matched are spooled.
+type Spool struct {
+	// The methods of requests to spool.
+	Methods []string `json:"methods,omitempty"`
+
+	// The paths of requests to spool, either exact or a prefix ending in *.
+	// If empty, requests with any path are spooled.
+	Paths []string `json:"paths,omitempty"`
+
+	// The maximum number of spooled requests. The oldest are dropped beyond
+	// this. Defaults to 100.
+	MaxRequests int `json:"max_requests,omitempty"`
+
+	// The maximum body size in bytes of spooled requests. Larger requests are
+	// rejected with a 413. Defaults to 1MiB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// Spooled requests older than this are dropped. Defaults to 1h.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// The status to respond to spooled requests with. Defaults to 202.
+	Status int `json:"status,omitempty"`
+}
+
+func (s *Spool) validate() error {
+	if len(s.Methods) == 0 {
+		return fmt.Errorf("spool requires methods")
+	}
+	if s.Status != 0 && (s.Status < 200 || s.Status > 299) {
+		return fmt.Errorf("spool status must be a success status, got %d", s.Status)
+	}
+	return nil
+}
+
+// matches reports if r should be spooled.
+func (s *Spool) matches(r *http.Request) bool {
+	if !slices.Contains(s.Methods, r.Method) {
+		return false
+	}
+	if len(s.Paths) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(s.Paths, func(p string) bool {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			return strings.HasPrefix(r.URL.Path, prefix)
+		}
+		return p == r.URL.Path
+	})
+}
+
+// spooledRequest is a request waiting to be replayed.
+type spooledRequest struct {
+	method     string
+	host       string
+	uri        string
+	remoteAddr string
+	header     http.Header
+	body       []byte
+	at         time.Time
+}
+
+// spooler holds the spooled requests of a Middleware.
+type spooler struct {
+	maxRequests int
+	maxBodySize int64
+	maxAge      time.Duration
+	status      int
+	replaying   atomic.Bool
+
+	mu    sync.Mutex
+	queue []*spooledRequest
+}
+
+func newSpooler(s *Spool) *spooler {
+	sp := &spooler{
+		maxRequests: s.MaxRequests,
+		maxBodySize: s.MaxBodySize,
+		maxAge:      time.Duration(s.MaxAge),
+		status:      s.Status,
+	}
+	if sp.maxRequests == 0 {
+		sp.maxRequests = defaultSpoolMaxRequests
+	}
+	if sp.maxBodySize == 0 {
+		sp.maxBodySize = defaultSpoolMaxBodySize
+	}
+	if sp.maxAge == 0 {
+		sp.maxAge = defaultSpoolMaxAge
+	}
+	if sp.status == 0 {
+		sp.status = http.StatusAccepted
+	}
+	return sp
+}
+
+// expire drops the requests older than maxAge, returning how many. It must
+// be called with mu held.
+func (sp *spooler) expire(now time.Time) int {
+	i := 0
+	for i < len(sp.queue) && now.Sub(sp.queue[i].at) > sp.maxAge {
+		i++
+	}
+	sp.queue = sp.queue[i:]
+	return i
+}
+
+// spool queues r and acknowledges it.
+func (m *Middleware) spool(w http.ResponseWriter, r *http.Request) error {
+	sp := m.spooler
+	if err := m.sanitizePath(r); err != nil {
+		return err
+	}
+	if err := m.checkStripPrefix(r); err != nil {
+		return err
+	}
+	if r.ContentLength > sp.maxBodySize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("client_proxy: request body of %d bytes exceeds spool limit of %d", r.ContentLength, sp.maxBodySize))
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, sp.maxBodySize+1))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("client_proxy: reading spooled body: %w", err))
+	}
+	if int64(len(body)) > sp.maxBodySize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("client_proxy: request body exceeds spool limit of %d", sp.maxBodySize))
+	}
+	header := r.Header.Clone()
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		header.Del(h)
+	}
+	now := time.Now()
+	req := &spooledRequest{
+		method:     r.Method,
+		host:       r.Host,
+		uri:        r.RequestURI,
+		remoteAddr: r.RemoteAddr,
+		header:     header,
+		body:       body,
+		at:         now,
+	}
+
+	sp.mu.Lock()
+	expired := sp.expire(now)
+	overflow := max(len(sp.queue)+1-sp.maxRequests, 0)
+	sp.queue = append(sp.queue[overflow:], req)
+	sp.mu.Unlock()
+
+	m.metrics.spoolExpired.Add(float64(expired))
+	m.metrics.spoolOverflow.Add(float64(overflow))
+	m.metrics.spooled.Inc()
+	if overflow > 0 {
+		m.logger.Warn("spool full, dropped oldest requests", zap.Int("dropped", overflow))
+	}
+	w.WriteHeader(sp.status)
+	return nil
+}
+
+// replaySpool sends the spooled requests to h in order. Requests the client
+// could not be reached for are kept for the next client. A client replacing h
+// meanwhile does not start a replay of its own, so the requests are then sent
+// to it once h fails.
+func (m *Middleware) replaySpool(h *handler) {
+	sp := m.spooler
+	for h != nil && sp.replaying.CompareAndSwap(false, true) {
+		m.replayTo(h)
+		sp.replaying.Store(false)
+		next := m.handler.Load()
+		if next == h {
+			return
+		}
+		h = next
+	}
+}
+
+// replayTo sends the spooled requests to h, until none it serves are left or
+// one fails. Requests for hosts or paths h did not claim are kept.
+func (m *Middleware) replayTo(h *handler) {
+	sp := m.spooler
+	skipped := make(map[*spooledRequest]bool)
+	for {
+		sp.mu.Lock()
+		m.metrics.spoolExpired.Add(float64(sp.expire(time.Now())))
+		i := slices.IndexFunc(sp.queue, func(req *spooledRequest) bool { return !skipped[req] })
+		if i < 0 {
+			sp.mu.Unlock()
+			return
+		}
+		req := sp.queue[i]
+		sp.mu.Unlock()
+
+		if err := m.replay(h, req); errors.Is(err, errNotServed) {
+			skipped[req] = true
+			continue
+		} else if err != nil {
+			m.logger.Debug("spool replay failed, keeping request",
+				zap.String("uri", req.uri), zap.Error(err))
+			return
+		}
+		sp.mu.Lock()
+		// expired or dropped while it was being replayed otherwise
+		if i := slices.Index(sp.queue, req); i >= 0 {
+			sp.queue = slices.Delete(sp.queue, i, i+1)
+		}
+		sp.mu.Unlock()
+		m.metrics.spoolReplayed.Inc()
+	}
+}
+
+// errNotServed is returned by replay for requests the client did not claim.
+var errNotServed = errors.New("client_proxy: request not served by client")
+
+// replay sends req to the client of h through its proxy, as live requests are
+// sent, once the client has room for it under its max_inflight and the
+// max_stream_memory.
+func (m *Middleware) replay(h *handler, req *spooledRequest) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if h.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	r, err := http.NewRequestWithContext(ctx, req.method, req.uri, bytes.NewReader(req.body))
+	if err != nil {
+		return err
+	}
+	r.Host = req.host
+	r.RequestURI = req.uri
+	r.RemoteAddr = req.remoteAddr
+	r.Header = req.header.Clone()
+	r.Header.Set("X-CP-Replayed-At", time.Now().UTC().Format(time.RFC3339))
+	if !h.serves(r) {
+		return errNotServed
+	}
+
+	limit := m.inflightLimit(h)
+	for m.streamMemoryFull() || !h.acquire(limit) {
+		select {
+		case <-h.done:
+			return fmt.Errorf("client_proxy: %w", ErrNoClient)
+		case <-time.After(spoolReplayBackoff):
+		}
+	}
+	defer h.release()
+	h.requests.Add(1)
+	h.lastUsed.Store(time.Now().UnixNano())
+	m.counters.requests.Add(1)
+	m.metrics.requests.Inc()
+
+	// the response goes nowhere, so only failures to get one matter
+	var proxyErr error
+	proxy := *h.proxy
+	proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) { proxyErr = err }
+	w := &discardWriter{header: make(http.Header)}
+	proxy.ServeHTTP(w, r)
+	if proxyErr != nil {
+		return proxyErr
+	}
+	m.logger.Debug("replayed spooled request",
+		zap.String("uri", req.uri),
+		zap.Time("spooled_at", req.at),
+		zap.Int("status", w.code))
+	return nil
+}
+
+// streamMemoryFull reports if the max_stream_memory is used up.
+func (m *Middleware) streamMemoryFull() bool {
+	return m.MaxStreamMemory > 0 && m.streamMemory.Load() >= m.MaxStreamMemory
+}
+
+// discardWriter is a ResponseWriter recording only the status.
+type discardWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.code == 0 && code >= 200 {
+		w.code = code
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(p), nil
+}
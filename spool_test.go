@@ -0,0 +1,161 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+type replayed struct {
+	method, uri, body, tag string
+	replayedAt             bool
+}
+
+// recordReplays returns a client handler sending the requests it receives.
+func recordReplays(c chan<- replayed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		_, err := time.Parse(time.RFC3339, r.Header.Get("X-CP-Replayed-At"))
+		c <- replayed{r.Method, r.RequestURI, string(b), r.Header.Get("X-Tag"), err == nil}
+	}
+}
+
+func post(t testing.TB, url, body, tag string) int {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	ensure.Nil(t, err)
+	req.Header.Set("X-Tag", tag)
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestSpool(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "spool_app", Spool: &Spool{
+		Methods:     []string{http.MethodPost},
+		Paths:       []string{"/hooks/*"},
+		MaxBodySize: 10,
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+
+	ensure.DeepEqual(t, post(t, s.URL+"/hooks/a", "one", "1"), http.StatusAccepted)
+	ensure.DeepEqual(t, post(t, s.URL+"/hooks/b?x=y", "two", "2"), http.StatusAccepted)
+	ensure.DeepEqual(t, post(t, s.URL+"/other", "three", "3"), http.StatusNotFound)
+	ensure.DeepEqual(t, post(t, s.URL+"/hooks/c", "far too large", "4"), http.StatusRequestEntityTooLarge)
+	res, _ := get(t, s, "/hooks/a")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+
+	c := make(chan replayed, 10)
+	connect(t, m, s, recordReplays(c))
+	ensure.DeepEqual(t, <-c, replayed{http.MethodPost, "/hooks/a", "one", "1", true})
+	ensure.DeepEqual(t, <-c, replayed{http.MethodPost, "/hooks/b?x=y", "two", "2", true})
+	eventually(t, func() bool { return metricValue(t, m, "caddy_client_proxy_spool_replayed_total") == 2 })
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_spooled_total"), 2.0)
+
+	// forwarded directly once connected
+	ensure.DeepEqual(t, post(t, s.URL+"/hooks/d", "live", "5"), http.StatusOK)
+	ensure.DeepEqual(t, <-c, replayed{http.MethodPost, "/hooks/d", "live", "5", false})
+}
+
+func TestSpoolOverflow(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "spool_overflow", Spool: &Spool{
+		Methods:     []string{http.MethodPost},
+		MaxRequests: 2,
+		Status:      http.StatusNoContent,
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	for _, tag := range []string{"1", "2", "3"} {
+		ensure.DeepEqual(t, post(t, s.URL+"/", tag, tag), http.StatusNoContent)
+	}
+	ensure.DeepEqual(t, metricValue(t, m, "caddy_client_proxy_spool_dropped_total", "reason", "overflow"), 1.0)
+
+	c := make(chan replayed, 10)
+	connect(t, m, s, recordReplays(c))
+	ensure.DeepEqual(t, (<-c).tag, "2")
+	ensure.DeepEqual(t, (<-c).tag, "3")
+}
+
+func TestSpoolExpired(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "spool_expired", Spool: &Spool{
+		Methods: []string{http.MethodPost},
+		MaxAge:  caddy.Duration(20 * time.Millisecond),
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	ensure.DeepEqual(t, post(t, s.URL+"/", "old", "1"), http.StatusAccepted)
+	time.Sleep(30 * time.Millisecond)
+
+	c := make(chan replayed, 10)
+	connect(t, m, s, recordReplays(c))
+	eventually(t, func() bool {
+		return metricValue(t, m, "caddy_client_proxy_spool_dropped_total", "reason", "expired") == 1
+	})
+	ensure.DeepEqual(t, len(c), 0)
+}
+
+func TestSpoolInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, Spool: &Spool{}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("spool requires methods"))
+	m.Spool = &Spool{Methods: []string{http.MethodPost}, Status: http.StatusNotFound}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("spool status must be a success status"))
+}
+
+func TestSpoolReplaced(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "spool_replaced", Spool: &Spool{
+		Methods: []string{http.MethodPost},
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	ensure.DeepEqual(t, post(t, s.URL+"/", "one", "1"), http.StatusAccepted)
+
+	// the first client never answers the replay
+	started := make(chan struct{})
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	first := connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	<-started
+
+	// the replay continues with the client replacing it
+	c := make(chan replayed, 10)
+	connect(t, m, s, recordReplays(c))
+	first.Close()
+	ensure.DeepEqual(t, (<-c).tag, "1")
+}
+
+func TestSpoolReplayDirected(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "spool_directed", AddPathPrefix: "/app",
+		SignRequests: &SignRequests{},
+		Spool:        &Spool{Methods: []string{http.MethodPost}},
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	ensure.DeepEqual(t, post(t, s.URL+"/other", "other", "1"), http.StatusAccepted)
+	ensure.DeepEqual(t, post(t, s.URL+"/hooks/a", "one", "2"), http.StatusAccepted)
+
+	// replayed as live requests are, and only if the client claims them
+	requests := make(chan *http.Request, 10)
+	connectWith(t, m, s, &http2.Server{}, http.Header{"X-Client-Proxy-Paths": {"/hooks"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+		}))
+	r := <-requests
+	ensure.DeepEqual(t, r.RequestURI, "/app/hooks/a")
+	ensure.True(t, verifySignature(r, secret))
+	eventually(t, func() bool { return metricValue(t, m, "caddy_client_proxy_spool_replayed_total") == 1 })
+	m.spooler.mu.Lock()
+	defer m.spooler.mu.Unlock()
+	ensure.DeepEqual(t, len(m.spooler.queue), 1)
+	ensure.DeepEqual(t, m.spooler.queue[0].uri, "/other")
+}
@@ -0,0 +1,104 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// StatusDocument is served at the status_path, summarizing the handler
+// without the admin API.
+type StatusDocument struct {
+	Status
+
+	// The clients connected to all the handlers, as counted by max_clients.
+	ConnectedClients int `json:"connected_clients"`
+
+	// The registrations not yet ready, as counted by
+	// max_pending_registrations.
+	PendingRegistrations int64 `json:"pending_registrations"`
+
+	Limits StatusLimits `json:"limits"`
+}
+
+// StatusLimits are the limits of the handler, omitting those not set.
+type StatusLimits struct {
+	MaxInflight             int64 `json:"max_inflight,omitempty"`
+	MaxRequestBody          int64 `json:"max_request_body,omitempty"`
+	MaxClients              int   `json:"max_clients,omitempty"`
+	MaxClientsPerIP         int   `json:"max_clients_per_ip,omitempty"`
+	MaxPendingRegistrations int   `json:"max_pending_registrations,omitempty"`
+}
+
+// parseStatusAllowedIPs parses the addresses and CIDR ranges allowed to read
+// the status document.
+func parseStatusAllowedIPs(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status_allowed_ips entry %q: %w", v, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status_allowed_ips entry %q: %w", v, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// statusAllowed reports if r may read the status document, coming from an
+// allowed address or presenting the secret.
+func (m *Middleware) statusAllowed(r *http.Request) bool {
+	if a, err := netip.ParseAddr(requestHost(r.RemoteAddr)); err == nil {
+		a = a.Unmap()
+		for _, p := range m.statusIPs {
+			if p.Contains(a) {
+				return true
+			}
+		}
+	}
+	return m.isRegistration(r)
+}
+
+// serveStatus responds with the StatusDocument. Requests for the status_path
+// are never registrations, nor forwarded to the client.
+func (m *Middleware) serveStatus(w http.ResponseWriter, r *http.Request) error {
+	if !m.statusAllowed(r) {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("client_proxy: status not allowed"))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("client_proxy: status method not allowed: %s", r.Method))
+	}
+	doc := StatusDocument{
+		Status:               m.status(),
+		ConnectedClients:     len(m.connectedClients()),
+		PendingRegistrations: m.pending.Load(),
+		Limits: StatusLimits{
+			MaxInflight:             m.maxInflight.Load(),
+			MaxRequestBody:          m.MaxRequestBody,
+			MaxClients:              m.MaxClients,
+			MaxClientsPerIP:         m.MaxClientsPerIP,
+			MaxPendingRegistrations: m.MaxPendingRegistrations,
+		},
+	}
+	if doc.Client != nil {
+		doc.ConnectedClients++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,109 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+// getStatus requests the status document at path, with the secret if set.
+func getStatus(t testing.TB, url, secret string) (int, *StatusDocument) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	ensure.Nil(t, err)
+	if secret != "" {
+		req.Header.Set("X-Client-Proxy", secret)
+	}
+	res, err := http.DefaultClient.Do(req)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+	ensure.DeepEqual(t, res.Header.Get("Content-Type"), "application/json")
+	var doc StatusDocument
+	ensure.Nil(t, json.NewDecoder(res.Body).Decode(&doc))
+	return res.StatusCode, &doc
+}
+
+func TestStatusPath(t *testing.T) {
+	m := &Middleware{
+		Secret:      secret,
+		Name:        "status_path",
+		StatusPath:  "/_status",
+		MaxInflight: 3,
+		MaxClients:  5,
+	}
+	provision(t, m)
+	s := newServer(t, m)
+
+	status, _ := getStatus(t, s.URL+"/_status", "")
+	ensure.DeepEqual(t, status, http.StatusForbidden)
+	status, _ = getStatus(t, s.URL+"/_status", "wrong")
+	ensure.DeepEqual(t, status, http.StatusForbidden)
+
+	status, doc := getStatus(t, s.URL+"/_status", secret)
+	ensure.DeepEqual(t, status, http.StatusOK)
+	ensure.DeepEqual(t, doc.Name, "status_path")
+	ensure.True(t, doc.Client == nil)
+	ensure.DeepEqual(t, doc.ConnectedClients, 0)
+	ensure.DeepEqual(t, doc.Limits, StatusLimits{MaxInflight: 3, MaxClients: 5})
+
+	connect(t, m, s, http.HandlerFunc(hello))
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+
+	// the secret makes it a status request, rather than a registration
+	status, doc = getStatus(t, s.URL+"/_status", secret)
+	ensure.DeepEqual(t, status, http.StatusOK)
+	ensure.NotNil(t, doc.Client)
+	ensure.DeepEqual(t, doc.Client.RemoteAddr, m.handler.Load().remoteAddr)
+	ensure.DeepEqual(t, doc.ConnectedClients, 1)
+	ensure.DeepEqual(t, doc.Counters.Requests, uint64(1))
+	ensure.DeepEqual(t, m.status().Counters.Requests, uint64(1), "not forwarded")
+
+	res, err := http.Post(s.URL+"/_status", "text/plain", nil)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusForbidden)
+}
+
+func TestStatusAllowedIPs(t *testing.T) {
+	m := &Middleware{
+		Secret:           secret,
+		StatusPath:       "/_status",
+		StatusAllowedIPs: []string{"10.0.0.1", "127.0.0.0/8"},
+	}
+	provision(t, m)
+	s := newServer(t, m)
+	status, doc := getStatus(t, s.URL+"/_status", "")
+	ensure.DeepEqual(t, status, http.StatusOK)
+	ensure.DeepEqual(t, doc.Limits, StatusLimits{})
+
+	res, err := http.Post(s.URL+"/_status", "text/plain", nil)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, res.StatusCode, http.StatusMethodNotAllowed)
+	ensure.DeepEqual(t, res.Header.Get("Allow"), "GET, HEAD")
+
+	other := &Middleware{
+		Secret:           secret,
+		StatusPath:       "/_status",
+		StatusAllowedIPs: []string{"10.0.0.0/8"},
+	}
+	provision(t, other)
+	status, _ = getStatus(t, newServer(t, other).URL+"/_status", "")
+	ensure.DeepEqual(t, status, http.StatusForbidden)
+}
+
+func TestStatusInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, StatusPath: "_status"}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("status_path must start with /"))
+	m = &Middleware{Secret: secret, StatusAllowedIPs: []string{"10.0.0.0/33"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile(`invalid status_allowed_ips entry "10.0.0.0/33"`))
+	m = &Middleware{Secret: secret, StatusAllowedIPs: []string{"localhost"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile(`invalid status_allowed_ips entry "localhost"`))
+}
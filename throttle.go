@@ -0,0 +1,85 @@
+package clientproxy
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBurst bounds the burst, and thus the size of individual reads and
+// writes, on a throttled connection.
+const maxBurst = 64 << 10
+
+// throttleConn limits the bandwidth in each direction. A nil limiter means the
+// direction is not limited. Limits apply to all bytes on the connection, which
+// includes the HTTP/2 framing.
+type throttleConn struct {
+	net.Conn
+	read   *rate.Limiter
+	write  *rate.Limiter
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxBurst)))
+}
+
+// newThrottleConn returns conn limited to read and write bytes per second.
+func newThrottleConn(conn net.Conn, read, write int64) *throttleConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &throttleConn{
+		Conn:   conn,
+		read:   newLimiter(read),
+		write:  newLimiter(write),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (c *throttleConn) Read(p []byte) (int, error) {
+	if c.read == nil {
+		return c.Conn.Read(p)
+	}
+	if len(p) > c.read.Burst() {
+		p = p[:c.read.Burst()]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// account for the bytes after the fact, since we can't know how
+		// many will be available
+		if werr := c.read.WaitN(c.ctx, n); werr != nil && err == nil {
+			err = net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+func (c *throttleConn) Write(p []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), c.write.Burst())]
+		if err := c.write.WaitN(c.ctx, len(chunk)); err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *throttleConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
@@ -0,0 +1,66 @@
+package clientproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+const (
+	throttleRate = 32 << 10
+	throttleSize = 48 << 10
+	// the first burst is free
+	throttleExpected = time.Duration(float64(throttleSize-throttleRate) / throttleRate * float64(time.Second))
+)
+
+func ensureThrottled(t *testing.T, elapsed time.Duration) {
+	t.Helper()
+	ensure.True(t, elapsed >= throttleExpected*8/10, elapsed)
+	ensure.True(t, elapsed < throttleExpected*4, elapsed)
+}
+
+func TestThrottleWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newThrottleConn(a, 0, throttleRate)
+	defer c.Close()
+	go io.Copy(io.Discard, b)
+	start := time.Now()
+	n, err := c.Write(make([]byte, throttleSize))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, throttleSize)
+	ensureThrottled(t, time.Since(start))
+}
+
+func TestThrottleRead(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newThrottleConn(a, throttleRate, 0)
+	defer c.Close()
+	go b.Write(make([]byte, throttleSize))
+	start := time.Now()
+	n, err := io.ReadFull(c, make([]byte, throttleSize))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, throttleSize)
+	ensureThrottled(t, time.Since(start))
+}
+
+func TestThrottleClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newThrottleConn(a, 0, 1)
+	go io.Copy(io.Discard, b)
+	_, err := c.Write([]byte{1}) // consumes the burst
+	ensure.Nil(t, err)
+	errc := make(chan error)
+	go func() {
+		_, err := c.Write([]byte{1})
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	ensure.DeepEqual(t, <-errc, net.ErrClosed)
+}
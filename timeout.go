@@ -0,0 +1,58 @@
+package clientproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// headerTimeoutTransport fails requests the client does not start responding
+// to within the timeout.
+type headerTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t headerTimeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+	res, err := t.transport.RoundTrip(r.WithContext(ctx))
+	// once the timer fired the request is canceled, even if the headers
+	// arrived just before
+	if !timer.Stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		return nil, fmt.Errorf("client_proxy: no response headers within %v: %w",
+			t.timeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelBody cancels the context of the request once the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// attemptTransport applies the options for each attempt of a request to
+// transport.
+func (m *Middleware) attemptTransport(transport http.RoundTripper) http.RoundTripper {
+	if m.ResponseHeaderTimeout > 0 {
+		return headerTimeoutTransport{transport: transport, timeout: time.Duration(m.ResponseHeaderTimeout)}
+	}
+	return transport
+}
@@ -0,0 +1,48 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type timingKey struct{}
+
+// timing tracks where the time is spent for a single proxied request.
+type timing struct {
+	start         time.Time // request entered the proxy
+	upstreamStart time.Time // request was sent into the tunnel
+	upstreamDone  time.Time // response headers arrived from the client
+}
+
+// timingTransport records the upstream timing for requests carrying a timing.
+type timingTransport struct {
+	http.RoundTripper
+}
+
+func (t timingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	tm, ok := r.Context().Value(timingKey{}).(*timing)
+	if !ok {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	tm.upstreamStart = time.Now()
+	res, err := t.RoundTripper.RoundTrip(r)
+	tm.upstreamDone = time.Now()
+	return res, err
+}
+
+// addServerTiming appends the tunnel and upstream durations to the
+// Server-Timing header, preserving any set by the client.
+func addServerTiming(res *http.Response) error {
+	tm, ok := res.Request.Context().Value(timingKey{}).(*timing)
+	if !ok {
+		return nil
+	}
+	res.Header.Add("Server-Timing", fmt.Sprintf("tunnel;dur=%.1f, upstream;dur=%.1f",
+		ms(time.Since(tm.start)), ms(tm.upstreamDone.Sub(tm.upstreamStart))))
+	return nil
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,66 @@
+package clientproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+)
+
+// TLSHeaders configures forwarding details of the TLS connection a request
+// arrived on to the client in request headers. Values for them sent by the
+// visitor are always removed.
+type TLSHeaders struct {
+	// The header for the TLS version, like TLS 1.3. Defaults to
+	// X-Client-Proxy-TLS-Version.
+	Version string `json:"version,omitempty"`
+
+	// The header for the cipher suite, like TLS_AES_128_GCM_SHA256. Defaults
+	// to X-Client-Proxy-TLS-Cipher.
+	Cipher string `json:"cipher,omitempty"`
+
+	// The header for the server name the visitor asked for. Defaults to
+	// X-Client-Proxy-TLS-Server-Name.
+	ServerName string `json:"server_name,omitempty"`
+
+	// The header for whether the TLS session was resumed, true or false.
+	// Defaults to X-Client-Proxy-TLS-Resumed.
+	Resumed string `json:"resumed,omitempty"`
+}
+
+// set replaces the TLS headers of r with the details of its connection.
+func (t *TLSHeaders) set(r *http.Request) {
+	version, cipher, serverName, resumed := t.Version, t.Cipher, t.ServerName, t.Resumed
+	if version == "" {
+		version = "X-Client-Proxy-TLS-Version"
+	}
+	if cipher == "" {
+		cipher = "X-Client-Proxy-TLS-Cipher"
+	}
+	if serverName == "" {
+		serverName = "X-Client-Proxy-TLS-Server-Name"
+	}
+	if resumed == "" {
+		resumed = "X-Client-Proxy-TLS-Resumed"
+	}
+	for _, h := range []string{version, cipher, serverName, resumed} {
+		r.Header.Del(h)
+	}
+	if r.TLS == nil {
+		return
+	}
+	r.Header.Set(version, tls.VersionName(r.TLS.Version))
+	r.Header.Set(cipher, tls.CipherSuiteName(r.TLS.CipherSuite))
+	if r.TLS.ServerName != "" {
+		r.Header.Set(serverName, r.TLS.ServerName)
+	}
+	r.Header.Set(resumed, strconv.FormatBool(r.TLS.DidResume))
+}
+
+// setSNIHeader replaces the name header of r with the server name its TLS
+// connection was made for.
+func setSNIHeader(r *http.Request, name string) {
+	r.Header.Del(name)
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		r.Header.Set(name, r.TLS.ServerName)
+	}
+}
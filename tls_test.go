@@ -0,0 +1,109 @@
+package clientproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daaku/ensure"
+	"golang.org/x/net/http2"
+)
+
+func TestTLSHeaders(t *testing.T) {
+	m := &Middleware{Secret: secret, TLSHeaders: &TLSHeaders{Cipher: "X-Cipher"}}
+	provision(t, m)
+
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.Header.Set("X-Client-Proxy-TLS-Resumed", "spoofed")
+	r.Header.Set("X-Client-Proxy-TLS-Server-Name", "spoofed")
+	r.TLS = &tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		DidResume:   true,
+	}
+	m.director(r, "example.com")
+	ensure.DeepEqual(t, r.Header, http.Header{
+		"X-Client-Proxy-Tls-Version": {"TLS 1.3"},
+		"X-Cipher":                   {"TLS_AES_128_GCM_SHA256"},
+		"X-Client-Proxy-Tls-Resumed": {"true"},
+	})
+
+	// spoofed values are removed from requests without TLS too
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("X-Cipher", "spoofed")
+	r.Header.Set("X-Other", "kept")
+	m.director(r, "example.com")
+	ensure.DeepEqual(t, r.Header, http.Header{"X-Other": {"kept"}})
+}
+
+func TestForwardSNIHeader(t *testing.T) {
+	m := &Middleware{Secret: secret, ForwardSNIHeader: "X-SNI"}
+	provision(t, m)
+
+	r := httptest.NewRequest(http.MethodGet, "https://a.example.com/", nil)
+	r.Header.Set("X-SNI", "spoofed.example.com")
+	r.TLS = &tls.ConnectionState{ServerName: "a.example.com"}
+	m.director(r, "example.com")
+	ensure.DeepEqual(t, r.Header.Values("X-SNI"), []string{"a.example.com"})
+
+	// spoofed values are removed without TLS, or a server name
+	for _, state := range []*tls.ConnectionState{nil, {}} {
+		r = httptest.NewRequest(http.MethodGet, "https://a.example.com/", nil)
+		r.Header.Set("X-SNI", "spoofed.example.com")
+		r.TLS = state
+		m.director(r, "example.com")
+		ensure.DeepEqual(t, r.Header, http.Header{})
+	}
+}
+
+func TestTLSHeadersForwarded(t *testing.T) {
+	m := &Middleware{Secret: secret, TLSHeaders: &TLSHeaders{}}
+	provision(t, m)
+	connect(t, m, newServer(t, m), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Proxy-TLS-Version")))
+	}))
+	s := newUnstartedServer(m)
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	res, err := s.Client().Get(s.URL)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	var b [16]byte
+	n, _ := res.Body.Read(b[:])
+	ensure.DeepEqual(t, string(b[:n]), tls.VersionName(res.TLS.Version))
+}
+
+func TestAllowedALPN(t *testing.T) {
+	m := &Middleware{Secret: secret, AllowedALPN: []string{"http/1.1"}}
+	provision(t, m)
+	s := newUnstartedServer(m)
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	register := func(protos []string) *tls.Conn {
+		conn, err := tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         protos,
+		})
+		ensure.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Proxy: "+secret+"\r\n\r\n")
+		ensure.Nil(t, err)
+		return conn
+	}
+
+	// a client not negotiating the expected protocol is rejected
+	res, err := http.ReadResponse(bufio.NewReader(register(nil)), nil)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadRequest)
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.StringContains(t, string(body), `negotiated ALPN "", expected one of http/1.1`)
+	ensure.True(t, m.handler.Load() == nil)
+
+	conn := register([]string{"http/1.1"})
+	go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(hello)})
+	eventually(t, func() bool { return m.handler.Load() != nil })
+}
@@ -0,0 +1,44 @@
+package clientproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// finalizeMissingTrailers makes the response end cleanly if the client
+// declares trailers and sends the whole body, but fails before sending the
+// trailers.
+func (m *Middleware) finalizeMissingTrailers(res *http.Response) error {
+	if len(res.Trailer) > 0 {
+		res.Body = &trailerBody{ReadCloser: res.Body, m: m, res: res}
+	}
+	return nil
+}
+
+// trailerBody turns a read failing after the declared Content-Length was read
+// into an io.EOF, so the response is finished with empty trailers instead of
+// being aborted. Other failures, including those of bodies without a
+// Content-Length, are returned as is, as the body may be incomplete.
+type trailerBody struct {
+	io.ReadCloser
+	m    *Middleware
+	res  *http.Response
+	read int64
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && b.res.ContentLength >= 0 && b.read == b.res.ContentLength {
+		b.m.counters.missingTrailers.Add(1)
+		b.m.metrics.missingTrailers.Inc()
+		b.m.logger.Warn("client failed before sending trailers",
+			zap.String("uri", b.res.Request.RequestURI),
+			zap.Error(err))
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+package clientproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+// declaresTrailers writes a response with a Content-Length of length, and
+// then fails before sending the declared trailer.
+func declaresTrailers(length string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		if length != "" {
+			w.Header().Set("Content-Length", length)
+		}
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func TestMissingTrailersFinalized(t *testing.T) {
+	m := &Middleware{Secret: secret, FinalizeMissingTrailers: true}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, declaresTrailers("7"))
+	res, body := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "partial")
+	ensure.DeepEqual(t, res.Trailer.Get("X-Checksum"), "")
+	ensure.DeepEqual(t, m.status().Counters.MissingTrailers, uint64(1))
+}
+
+// readFails ensures reading a response from s fails, before the headers if
+// they were buffered, or while reading the body.
+func readFails(t testing.TB, s *httptest.Server) {
+	t.Helper()
+	res, err := http.Get(s.URL)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	_, err = io.ReadAll(res.Body)
+	ensure.NotNil(t, err)
+}
+
+func TestMissingTrailersAborted(t *testing.T) {
+	m := newMiddleware(t)
+	s := newServer(t, m)
+	connect(t, m, s, declaresTrailers("7"))
+	readFails(t, s)
+	ensure.DeepEqual(t, m.status().Counters.MissingTrailers, uint64(0))
+}
+
+func TestMissingTrailersIncompleteBody(t *testing.T) {
+	m := &Middleware{Secret: secret, FinalizeMissingTrailers: true}
+	provision(t, m)
+	s := newServer(t, m)
+	connect(t, m, s, declaresTrailers(""))
+	readFails(t, s)
+	connect(t, m, s, declaresTrailers("14"))
+	readFails(t, s)
+	ensure.DeepEqual(t, m.status().Counters.MissingTrailers, uint64(0))
+}
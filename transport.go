@@ -0,0 +1,106 @@
+package clientproxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(&Transport{})
+}
+
+// Transport is a reverse_proxy transport sending requests over the connection
+// of the client registered with the named client_proxy handler. The handler
+// only manages registration, while reverse_proxy takes care of rewriting,
+// buffering and retries.
+type Transport struct {
+	// The name of the client_proxy handler.
+	Tunnel string `json:"tunnel,omitempty"`
+}
+
+// NoClientError is returned by the Transport when no client that would serve
+// the request is connected. reverse_proxy responds to it with a 502.
+type NoClientError struct {
+	Tunnel string
+}
+
+func (e NoClientError) Error() string {
+	return fmt.Sprintf("client_proxy transport: no client connected to %s", e.Tunnel)
+}
+
+// Unwrap returns ErrNoClient.
+func (e NoClientError) Unwrap() error { return ErrNoClient }
+
+// CaddyModule returns the Caddy module information.
+func (*Transport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.client_proxy",
+		New: func() caddy.Module { return new(Transport) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (t *Transport) Provision(caddy.Context) error {
+	if t.Tunnel == "" {
+		return fmt.Errorf("client_proxy transport: no tunnel")
+	}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.
+//
+// The handler and its client are looked up on every request, so a client
+// replacing another is used from the next request on, while requests
+// already sent finish on the previous connection.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	m := registry.get(t.Tunnel)
+	if m == nil {
+		return nil, NoClientError{Tunnel: t.Tunnel}
+	}
+	h := m.handler.Load()
+	if h == nil || !h.serves(r) || !h.conn.CanTakeNewRequest() {
+		return nil, NoClientError{Tunnel: t.Tunnel}
+	}
+	out := *r
+	u := *r.URL
+	u.Scheme = "https"
+	out.URL = &u
+	return h.conn.RoundTrip(&out)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	transport client_proxy {
+//		tunnel <name>
+//	}
+func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume transport name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "tunnel":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Tunnel = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized client_proxy transport option %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Transport)(nil)
+	_ http.RoundTripper     = (*Transport)(nil)
+	_ caddyfile.Unmarshaler = (*Transport)(nil)
+)
@@ -0,0 +1,84 @@
+package clientproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+)
+
+func newTransport(t testing.TB, tunnel string) *Transport {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	tr := &Transport{Tunnel: tunnel}
+	ensure.Nil(t, tr.Provision(ctx))
+	return tr
+}
+
+func transportGet(t testing.TB, tr *Transport) (*http.Response, string, error) {
+	t.Helper()
+	// reverse_proxy sends requests to the upstream over http
+	r := httptest.NewRequest(http.MethodGet, "http://client_proxy:80/", nil)
+	r.RequestURI = ""
+	res, err := tr.RoundTrip(r)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	return res, string(body), nil
+}
+
+func TestTransport(t *testing.T) {
+	m := &Middleware{Secret: secret, Name: "transport"}
+	provision(t, m)
+	s := newServer(t, m)
+	tr := newTransport(t, "transport")
+
+	_, _, err := transportGet(t, tr)
+	var noClient NoClientError
+	ensure.True(t, errors.As(err, &noClient))
+	ensure.DeepEqual(t, noClient.Tunnel, "transport")
+
+	connect(t, m, s, http.HandlerFunc(hello))
+	res, body, err := transportGet(t, tr)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, body, "hello")
+
+	// a replacement client is used from the next request on
+	connect(t, m, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "replaced")
+	}))
+	_, body, err = transportGet(t, tr)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, body, "replaced")
+}
+
+func TestTransportUnknown(t *testing.T) {
+	_, _, err := transportGet(t, newTransport(t, "unknown"))
+	ensure.True(t, errors.As(err, &NoClientError{}))
+}
+
+func TestTransportCaddyfile(t *testing.T) {
+	handlers := adapt(t, `
+		example.com {
+			reverse_proxy client_proxy {
+				transport client_proxy {
+					tunnel myapp
+				}
+			}
+		}
+	`)
+	ensure.DeepEqual(t, len(handlers), 1)
+	ensure.DeepEqual(t, handlers[0]["transport"], map[string]any{
+		"protocol": "client_proxy",
+		"tunnel":   "myapp",
+	})
+}
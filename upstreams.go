@@ -0,0 +1,162 @@
+package clientproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&Upstreams{})
+}
+
+// Upstreams is a reverse_proxy dynamic upstreams source, providing the client
+// connected to the named client_proxy handler of the same config as an
+// upstream. Requests reach the client through a Unix socket in a directory
+// only accessible to Caddy's user, and are forwarded just as the handler
+// would.
+type Upstreams struct {
+	// The name of the client_proxy handler.
+	Name string `json:"name,omitempty"`
+
+	dir    string
+	ln     net.Listener
+	server *http.Server
+	load   <-chan struct{}
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Upstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.client_proxy",
+		New: func() caddy.Module { return new(Upstreams) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (u *Upstreams) Provision(ctx caddy.Context) error {
+	if u.Name == "" {
+		return fmt.Errorf("client_proxy upstreams: no name")
+	}
+	u.logger = ctx.Logger()
+	u.load = ctx.Done()
+	// MkdirTemp creates the directory with mode 0700
+	dir, err := os.MkdirTemp("", "caddy-client-proxy-")
+	if err != nil {
+		return fmt.Errorf("client_proxy upstreams: %w", err)
+	}
+	u.dir = dir
+	ln, err := net.Listen("unix", filepath.Join(dir, "upstream.sock"))
+	if err != nil {
+		return fmt.Errorf("client_proxy upstreams: %w", err)
+	}
+	u.ln = ln
+	u.server = &http.Server{
+		Handler:           http.HandlerFunc(u.serveHTTP),
+		ReadHeaderTimeout: time.Minute,
+		ErrorLog:          zap.NewStdLog(u.logger),
+	}
+	go func() {
+		if err := u.server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			u.logger.Error("client_proxy upstreams stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (u *Upstreams) Cleanup() error {
+	var err error
+	if u.server != nil {
+		err = u.server.Close()
+	} else if u.ln != nil {
+		err = u.ln.Close()
+	}
+	if u.dir != "" {
+		err = errors.Join(err, os.RemoveAll(u.dir))
+	}
+	return err
+}
+
+// GetUpstreams implements reverseproxy.UpstreamSource.
+func (u *Upstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	m := registry.named(u.Name, u.load)
+	if m == nil {
+		return nil, fmt.Errorf("client_proxy upstreams: unknown client_proxy: %s", u.Name)
+	}
+	if h := m.handler.Load(); h == nil || !h.serves(r) {
+		return nil, nil
+	}
+	return []*reverseproxy.Upstream{{Dial: "unix/" + u.ln.Addr().String()}}, nil
+}
+
+// serveHTTP forwards requests from the socket to the client.
+func (u *Upstreams) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m := registry.named(u.Name, u.load)
+	if m == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if err := forwardUpstream(m, w, r); err != nil {
+		status := http.StatusInternalServerError
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			status = handlerErr.StatusCode
+		}
+		w.WriteHeader(status)
+	}
+}
+
+// forwardUpstream sends r to the client of m, as its ServeHTTP does for
+// visitors. Registrations and the status_path are only served by the handler
+// itself, so r is forwarded whatever credentials it carries.
+func forwardUpstream(m *Middleware, w http.ResponseWriter, r *http.Request) error {
+	if err := m.checkStopping(w); err != nil {
+		return err
+	}
+	r = m.scrubQueryCredential(r)
+	r.Header.Del("X-Client-Proxy")
+	target, err := m.route(r)
+	if err != nil {
+		return err
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return caddyhttp.Error(http.StatusBadGateway,
+			fmt.Errorf("client_proxy upstreams: %w", ErrNoClient))
+	})
+	return target.forward(w, r, next)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	dynamic client_proxy <name>
+func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume upstream source name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	u.Name = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Upstreams)(nil)
+	_ caddy.CleanerUpper          = (*Upstreams)(nil)
+	_ reverseproxy.UpstreamSource = (*Upstreams)(nil)
+	_ caddyfile.Unmarshaler       = (*Upstreams)(nil)
+)
@@ -0,0 +1,138 @@
+package clientproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+	"go.uber.org/zap"
+)
+
+func newUpstreams(t testing.TB, ctx caddy.Context, name string) *Upstreams {
+	u := &Upstreams{Name: name}
+	ensure.Nil(t, u.Provision(ctx))
+	t.Cleanup(func() { u.Cleanup() })
+	return u
+}
+
+// upstreamClient returns a client sending requests to the socket at addr, as
+// reverse_proxy does.
+func upstreamClient(addr string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		},
+	}}
+}
+
+func TestUpstreams(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &Middleware{Secret: secret, Name: "upstreams"}
+	ensure.Nil(t, m.Provision(ctx))
+	m.logger = zap.NewNop()
+	t.Cleanup(func() { m.Cleanup() })
+	s := newServer(t, m)
+	u := newUpstreams(t, ctx, "upstreams")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	upstreams, err := u.GetUpstreams(r)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(upstreams), 0)
+
+	connect(t, m, s, http.HandlerFunc(hello))
+	upstreams, err = u.GetUpstreams(r)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(upstreams), 1)
+
+	addr, ok := strings.CutPrefix(upstreams[0].Dial, "unix/")
+	ensure.True(t, ok)
+	info, err := os.Stat(filepath.Dir(addr))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, info.Mode().Perm(), os.FileMode(0o700))
+	res, err := upstreamClient(addr).Get("http://upstreams/")
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, string(body), "hello")
+}
+
+func TestUpstreamsCredentials(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &Middleware{
+		Secret:            secret,
+		Name:              "upstreams_credentials",
+		CredentialSources: []string{"header", "bearer"},
+		StatusPath:        "/status",
+	}
+	ensure.Nil(t, m.Provision(ctx))
+	m.logger = zap.NewNop()
+	t.Cleanup(func() { m.Cleanup() })
+	s := newServer(t, m)
+	u := newUpstreams(t, ctx, "upstreams_credentials")
+	connect(t, m, s, http.HandlerFunc(hello))
+	addr := strings.TrimPrefix(u.ln.Addr().String(), "unix/")
+
+	// neither a registration nor a status request, but forwarded to the client
+	for _, path := range []string{"/", "/status"} {
+		req, err := http.NewRequest(http.MethodGet, "http://upstreams"+path, nil)
+		ensure.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		res, err := upstreamClient(addr).Do(req)
+		ensure.Nil(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+		ensure.DeepEqual(t, string(body), "hello")
+	}
+}
+
+func TestUpstreamsUnknown(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	u := newUpstreams(t, ctx, "unknown")
+	_, err := u.GetUpstreams(httptest.NewRequest(http.MethodGet, "/", nil))
+	ensure.NotNil(t, err)
+
+	// handlers of another config are not used
+	m := &Middleware{Secret: secret, Name: "unknown"}
+	provision(t, m)
+	_, err = u.GetUpstreams(httptest.NewRequest(http.MethodGet, "/", nil))
+	ensure.NotNil(t, err)
+}
+
+func TestUpstreamsCleanup(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	u := &Upstreams{Name: "cleanup"}
+	ensure.Nil(t, u.Provision(ctx))
+	ensure.Nil(t, u.Cleanup())
+	_, err := os.Stat(u.dir)
+	ensure.True(t, os.IsNotExist(err))
+}
+
+func TestUpstreamsCaddyfile(t *testing.T) {
+	handlers := adapt(t, `
+		example.com {
+			reverse_proxy {
+				dynamic client_proxy myapp
+			}
+		}
+	`)
+	ensure.DeepEqual(t, len(handlers), 1)
+	ensure.DeepEqual(t, handlers[0]["dynamic_upstreams"], map[string]any{
+		"source": "client_proxy",
+		"name":   "myapp",
+	})
+}
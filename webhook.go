@@ -0,0 +1,149 @@
+package clientproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWebhookInterval = 30 * time.Second
+	defaultWebhookTimeout  = 5 * time.Second
+)
+
+// NoClientWebhook configures a webhook called when a request arrives while no
+// client is connected, for example to wake a suspended machine.
+type NoClientWebhook struct {
+	// The URL to POST to.
+	URL string `json:"url,omitempty"`
+
+	// Call the webhook at most this often. Defaults to 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The maximum time the webhook may take. Defaults to 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+func (w *NoClientWebhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid on_no_client_webhook url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("on_no_client_webhook url must be http or https, got %s", w.URL)
+	}
+	return nil
+}
+
+// NoClientEvent is the JSON payload sent to the NoClientWebhook.
+type NoClientEvent struct {
+	Name     string    `json:"name,omitempty"`
+	Instance string    `json:"instance"`
+	Host     string    `json:"host"`
+	Method   string    `json:"method"`
+	URI      string    `json:"uri"`
+	Time     time.Time `json:"time"`
+}
+
+// callNoClientWebhook calls the on_no_client_webhook in the background, unless
+// it was called within its interval.
+func (m *Middleware) callNoClientWebhook(r *http.Request) {
+	wh := m.OnNoClientWebhook
+	if wh == nil {
+		return
+	}
+	interval := time.Duration(wh.Interval)
+	if interval == 0 {
+		interval = defaultWebhookInterval
+	}
+	now := time.Now()
+	last := m.lastWebhook.Load()
+	if last != 0 && now.Sub(time.Unix(0, last)) < interval {
+		return
+	}
+	if !m.lastWebhook.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	body, err := json.Marshal(NoClientEvent{
+		Name:     m.Name,
+		Instance: m.instanceLabel(),
+		Host:     r.Host,
+		Method:   r.Method,
+		URI:      r.RequestURI,
+		Time:     now,
+	})
+	if err != nil {
+		m.logger.Error("unable to encode on_no_client_webhook payload", zap.Error(err))
+		return
+	}
+	go m.sendNoClientWebhook(body)
+}
+
+// sendNoClientWebhook POSTs body to the webhook. Failures are only logged.
+func (m *Middleware) sendNoClientWebhook(body []byte) {
+	wh := m.OnNoClientWebhook
+	timeout := time.Duration(wh.Timeout)
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		m.logger.Warn("on_no_client_webhook failed", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		m.logger.Warn("on_no_client_webhook failed", zap.Error(err))
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		m.logger.Warn("on_no_client_webhook failed", zap.Int("status", res.StatusCode))
+	}
+}
+
+// waitForClient waits up to wait for a client to register, returning it, or
+// nil if none did.
+func (m *Middleware) waitForClient(ctx context.Context, wait time.Duration) *handler {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		m.mu.Lock()
+		h := m.handler.Load()
+		if h != nil || m.stopping.Load() {
+			m.mu.Unlock()
+			return h
+		}
+		if m.registered == nil {
+			m.registered = make(chan struct{})
+		}
+		registered := m.registered
+		m.mu.Unlock()
+		select {
+		case <-registered:
+		case <-timer.C:
+			return m.handler.Load()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// notifyRegistered wakes the requests waiting for a client. It must be called
+// with mu held.
+func (m *Middleware) notifyRegistered() {
+	if m.registered != nil {
+		close(m.registered)
+		m.registered = nil
+	}
+}
@@ -0,0 +1,113 @@
+package clientproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/daaku/ensure"
+)
+
+func TestNoClientWebhook(t *testing.T) {
+	var calls atomic.Int32
+	events := make(chan NoClientEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var e NoClientEvent
+		ensure.Nil(t, json.NewDecoder(r.Body).Decode(&e))
+		events <- e
+	}))
+	t.Cleanup(hook.Close)
+	m := &Middleware{Secret: secret, Name: "wake", OnNoClientWebhook: &NoClientWebhook{
+		URL:      hook.URL,
+		Interval: caddy.Duration(time.Hour),
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+
+	// rate limited to one call per interval
+	for range 3 {
+		res, _ := get(t, s, "/first")
+		ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+	}
+	e := <-events
+	ensure.DeepEqual(t, e.Name, "wake")
+	ensure.DeepEqual(t, e.Method, http.MethodGet)
+	ensure.DeepEqual(t, e.URI, "/first")
+	time.Sleep(50 * time.Millisecond)
+	ensure.DeepEqual(t, calls.Load(), int32(1))
+
+	// not called while a client is connected
+	m.lastWebhook.Store(0)
+	connect(t, m, s, http.HandlerFunc(hello))
+	get(t, s, "/")
+	time.Sleep(50 * time.Millisecond)
+	ensure.DeepEqual(t, calls.Load(), int32(1))
+}
+
+func TestNoClientWebhookFailure(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	t.Cleanup(hook.Close)
+	m := &Middleware{Secret: secret, OnNoClientWebhook: &NoClientWebhook{
+		URL:     hook.URL,
+		Timeout: caddy.Duration(10 * time.Millisecond),
+	}}
+	provision(t, m)
+	s := newServer(t, m)
+	start := time.Now()
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+	ensure.True(t, time.Since(start) < time.Second)
+}
+
+func TestNoClientWebhookInvalid(t *testing.T) {
+	m := &Middleware{Secret: secret, OnNoClientWebhook: &NoClientWebhook{URL: "ftp://example.com/"}}
+	ensure.Err(t, m.Validate(), regexp.MustCompile("must be http or https"))
+}
+
+func TestWaitForClient(t *testing.T) {
+	m := &Middleware{Secret: secret, WaitForClient: caddy.Duration(5 * time.Second)}
+	provision(t, m)
+	s := newServer(t, m)
+	type result struct {
+		status int
+		body   string
+	}
+	done := make(chan result)
+	go func() {
+		res, err := http.Get(s.URL)
+		if err != nil {
+			done <- result{}
+			return
+		}
+		defer res.Body.Close()
+		var b [5]byte
+		n, _ := res.Body.Read(b[:])
+		done <- result{res.StatusCode, string(b[:n])}
+	}()
+	eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.registered != nil
+	})
+	connect(t, m, s, http.HandlerFunc(hello))
+	ensure.DeepEqual(t, <-done, result{http.StatusOK, "hello"})
+}
+
+func TestWaitForClientTimeout(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	m := &Middleware{Secret: secret, WaitForClient: caddy.Duration(wait)}
+	provision(t, m)
+	s := newServer(t, m)
+	start := time.Now()
+	res, _ := get(t, s, "/")
+	ensure.DeepEqual(t, res.StatusCode, http.StatusNotFound)
+	ensure.True(t, time.Since(start) >= wait)
+}